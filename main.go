@@ -10,15 +10,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 	flags "github.com/jessevdk/go-flags"
 	gitignore "github.com/sabhiram/go-gitignore"
+	"gopkg.in/yaml.v3"
 
+	"github.com/alsosee/thumbnailer/pkg/jpegenc"
 	"github.com/alsosee/thumbnailer/pkg/r2"
 	"github.com/alsosee/thumbnailer/pkg/thumbnailer"
 	"github.com/alsosee/thumbnailer/pkg/uploader"
@@ -30,26 +41,259 @@ type appConfig struct {
 
 	// Cloudflare R2 storage
 	R2AccountID       string `env:"INPUT_R2_ACCOUNT_ID" long:"r2-account-id" description:"r2 account id"`
-	R2AccessKeyID     string `env:"INPUT_R2_ACCESS_KEY_ID" long:"r2-access-key-id" description:"r2 access key id"`
-	R2AccessKeySecret string `env:"INPUT_R2_ACCESS_KEY_SECRET" long:"r2-access-key-secret" description:"r2 access key secret"`
+	R2AccessKeyID     string `env:"INPUT_R2_ACCESS_KEY_ID" long:"r2-access-key-id" description:"r2 access key id" secret:"true"`
+	R2AccessKeySecret string `env:"INPUT_R2_ACCESS_KEY_SECRET" long:"r2-access-key-secret" description:"r2 access key secret" secret:"true"`
 	R2Bucket          string `env:"INPUT_R2_BUCKET" long:"r2-bucket" description:"r2 bucket"`
 
+	// Another S3-compatible storage instead of R2, with the region some providers validate in signatures
+	R2Endpoint string `env:"INPUT_R2_ENDPOINT" long:"r2-endpoint" description:"endpoint of an S3-compatible storage to use instead of R2, e.g. https://s3.eu-central-1.wasabisys.com"`
+	R2Region   string `env:"INPUT_R2_REGION" long:"r2-region" description:"region to sign requests to r2-endpoint for, e.g. eu-central-1 (auto if empty)"`
+
+	// Tells uploads apart from other bucket consumers in storage logs
+	UserAgent string `env:"INPUT_USER_AGENT" long:"user-agent" description:"User-Agent header of r2 requests (alsosee-thumbnailer/<version> if empty)"`
+
+	// Additional buckets receiving the same uploads, for redundancy
+	R2MirrorBuckets []string `env:"INPUT_R2_MIRROR_BUCKETS" env-delim:"," long:"r2-mirror-bucket" description:"additional r2 bucket to upload to"`
+	R2MirrorPolicy  string   `env:"INPUT_R2_MIRROR_POLICY" long:"r2-mirror-policy" description:"fail if uploading to any bucket fails (all) or only if all fail (any)" choice:"all" choice:"any" default:"all"`
+
+	// Print supported formats and exit, e.g. to find out why files are skipped
+	ListFormats bool `env:"INPUT_LIST_FORMATS" long:"list-formats" description:"print supported input file extensions and thumbnail formats and exit"`
+
+	// Print resolved configuration and exit
+	PrintConfig bool `env:"INPUT_PRINT_CONFIG" long:"print-config" description:"print effective configuration with secrets redacted and exit"`
+
 	// Force thumbnail generation
 	ForceThumbnails bool `env:"INPUT_FORCE_THUMBNAILS" long:"force-thumbnails" description:"force thumbnail generation"`
 
-	Include []string `env:"INPUT_INCLUDE" long:"include" description:"include only these directories"`
+	Include     []string `env:"INPUT_INCLUDE" long:"include" description:"include only these directories"`
+	IncludeFile string   `env:"INPUT_INCLUDE_FILE" long:"include-file" description:"path to file with include patterns, one per line"`
+
+	// Directories to process first, relative to the media directory
+	Priority []string `env:"INPUT_PRIORITY" env-delim:"," long:"priority" description:"process directories under this path (relative to media directory) first, can be repeated"`
+
+	// Process a single directory, e.g. for local testing of a gallery
+	SingleDir string `env:"INPUT_SINGLE_DIR" long:"single-dir" description:"only process this directory (relative to media directory), without its subdirectories"`
+
+	// Regenerate a single sprite, e.g. to fix a bad one
+	Batch string `env:"INPUT_BATCH" long:"batch" description:"only regenerate the thumbnail sprite of this batch of a directory (relative to media directory), e.g. People/Jane:3 for thumbnails_3.jpg"`
+
+	// Only process directories that opt in, e.g. in a monorepo with unrelated assets
+	RequireMarker bool `env:"INPUT_REQUIRE_MARKER" long:"require-marker" description:"only process directories with a .thumbs.enable file"`
+
+	ReportUnusedIncludes bool `env:"INPUT_REPORT_UNUSED_INCLUDES" long:"report-unused-includes" description:"warn about include patterns that matched no directory"`
+
+	// Retry reads failing with transient errors, e.g. on network file systems
+	ReadRetries      int           `env:"INPUT_READ_RETRIES" long:"read-retries" description:"number of retries of file reads failing with transient errors such as EIO"`
+	ReadRetryBackoff time.Duration `env:"INPUT_READ_RETRY_BACKOFF" long:"read-retry-backoff" description:"wait before the first read retry, doubled after each one" default:"100ms"`
+
+	// Log and skip directories that can't be read instead of failing
+	SkipUnreadableDirs bool `env:"INPUT_SKIP_UNREADABLE_DIRS" long:"skip-unreadable-dirs" description:"skip directories that can't be read instead of failing"`
+
+	// Fail if a directory without subdirectories has no images, e.g. after a broken upload step
+	FailOnEmpty bool `env:"INPUT_FAIL_ON_EMPTY" long:"fail-on-empty" description:"fail if any directory without subdirectories has no images"`
 
 	SkipImageUpload bool `env:"INPUT_SKIP_IMAGE_UPLOAD" long:"skip-image-upload" description:"skip image upload to R2"`
 
+	// Record full URLs of uploaded files, e.g. with a custom domain of the bucket
+	BaseURL string `env:"INPUT_BASE_URL" long:"base-url" description:"base URL of uploaded files, to store their full URLs in .thumbs.yml"`
+
+	// Keep .thumbs.yml entries of files missing locally, e.g. in a sparse checkout
+	NoPrune bool `env:"INPUT_NO_PRUNE" long:"no-prune" description:"keep .thumbs.yml entries of files that are not present locally, requires --content-addressed-thumbs"`
+
+	// Downscale large originals before uploading them
+	MaxOriginalDimension int `env:"INPUT_MAX_ORIGINAL_DIMENSION" long:"max-original-dimension" description:"downscale JPEG and PNG originals with a longer side before uploading them, 0 to upload them as is"`
+
+	// Upload alt text sidecars such as photo.jpg.txt, their text is stored anyway
+	UploadAltText bool `env:"INPUT_UPLOAD_ALT_TEXT" long:"upload-alt-text" description:"upload alt text sidecar files (photo.jpg.txt) next to images"`
+
+	// Detect edited files by checksums cached by size and modification time
+	DetectChanges bool `env:"INPUT_DETECT_CHANGES" long:"detect-changes" description:"regenerate thumbnails of files whose content changed"`
+	ForceRehash   bool `env:"INPUT_FORCE_REHASH" long:"force-rehash" description:"recalculate checksums of all files, even if their size and modification time didn't change"`
+	DetectRenames bool `env:"INPUT_DETECT_RENAMES" long:"detect-renames" description:"keep thumbnails of renamed files, matched by checksums"`
+
+	// Skip files with given checksums in all directories
+	DenylistFile string `env:"INPUT_DENYLIST_FILE" long:"denylist-file" description:"path to file with checksums (as in .thumbs.yml) of files to skip, one per line"`
+
+	// Themed galleries, e.g. panoramas only
+	MinAspectRatio float64 `env:"INPUT_MIN_ASPECT_RATIO" long:"min-aspect-ratio" description:"skip images with width/height below this, e.g. 2 for panoramas only (0 for no limit)"`
+	MaxAspectRatio float64 `env:"INPUT_MAX_ASPECT_RATIO" long:"max-aspect-ratio" description:"skip images with width/height above this (0 for no limit)"`
+
+	// Share a tile between visually identical images of a sprite
+	Dedup          bool `env:"INPUT_DEDUP" long:"dedup" description:"put a single thumbnail of visually identical images into sprites"`
+	DedupThreshold int  `env:"INPUT_DEDUP_THRESHOLD" long:"dedup-threshold" description:"maximum number of different bits of 64-bit perceptual hashes of identical images" default:"4"`
+
+	// Upload originals and compute blurhashes without generating sprites
+	SkipThumbnails bool `env:"INPUT_SKIP_THUMBNAILS" long:"skip-thumbnails" description:"skip thumbnail generation, only upload images and compute blurhashes"`
+
+	// Serve originals with "Content-Disposition: attachment" to download them under their names
+	OriginalsAsAttachments bool `env:"INPUT_ORIGINALS_AS_ATTACHMENTS" long:"originals-as-attachments" description:"upload originals with Content-Disposition: attachment header"`
+
+	// Maximum number of R2 requests per second
+	UploadRate float64 `env:"INPUT_UPLOAD_RATE" long:"upload-rate" description:"maximum number of R2 requests per second (0 for no limit)"`
+
+	// Fail a stalled request instead of hanging the whole run
+	UploadTimeout time.Duration `env:"INPUT_UPLOAD_TIMEOUT" long:"upload-timeout" description:"maximum duration of each attempt of an R2 request, failed attempts are retried (0 for no limit)" default:"60s"`
+
+	// Local file recording uploaded keys, used to resume interrupted runs
+	UploadJournal string `env:"INPUT_UPLOAD_JOURNAL" long:"upload-journal" description:"path to journal file with uploaded keys"`
+
+	// Safety limit for the total size of uploaded originals and thumbnails
+	MaxUploadBytes int64 `env:"INPUT_MAX_UPLOAD_BYTES" long:"max-upload-bytes" description:"abort if more than this many bytes would be uploaded (0 for no limit)"`
+
 	EscapeQuotes bool `env:"INPUT_ESCAPE_QUOTES" long:"escape-qutes" description:"escape quotes in the output"`
 
+	// Write "updated_hashes" output with thumbnail checksum for each updated file
+	OutputHashes bool `env:"INPUT_OUTPUT_HASHES" long:"output-hashes" description:"write updated_hashes output"`
+
+	// Print media of all processed directories as JSON, keyed by directory
+	OutputJSON bool `env:"INPUT_OUTPUT_JSON" long:"output-json" description:"write media of all processed directories to stdout as JSON"`
+
+	// Stream media as JSON Lines while directories are processed, for libraries too large for --output-json
+	OutputJSONLines string `env:"INPUT_OUTPUT_JSONL" long:"output-jsonl" description:"write media of each processed directory as JSON Lines to this file (- for stdout) as soon as it's done"`
+
+	// Prometheus textfile for node_exporter's textfile collector
+	MetricsFile string `env:"INPUT_METRICS_FILE" long:"metrics-file" description:"write run statistics to this file in Prometheus text format"`
+
+	// Number of images per sprite, independent of the number of images per row
+	BatchSize int `env:"INPUT_BATCH_SIZE" long:"batch-size" description:"number of images per thumbnail sprite" default:"50"`
+
+	// Guardrail for galleries that have grown too large
+	MaxBatches int  `env:"INPUT_MAX_BATCHES" long:"max-batches" description:"warn about directories with more thumbnail sprites of a format than this (0 for no limit)"`
+	Strict     bool `env:"INPUT_STRICT" long:"strict" description:"fail instead of warning about directories exceeding --max-batches"`
+
+	// Never rewrite uploaded sprites, at the cost of partially filled ones
+	AppendOnly bool `env:"INPUT_APPEND_ONLY" long:"append-only" description:"put new files into new thumbnail sprites, leaving existing ones unchanged"`
+
+	// Abort before writing thumbnails when the disk is almost full
+	MinFreeSpace int64 `env:"INPUT_MIN_FREE_SPACE" long:"min-free-space" description:"abort before writing thumbnails if less than this many bytes are free on disk (0 for no check)"`
+
+	// Limits memory used by decoded images on directories with large photos
+	DecodeMemoryBudget int64 `env:"INPUT_DECODE_MEMORY_BUDGET" long:"decode-memory-budget" description:"maximum bytes of images decoded at the same time (0 for no limit)"`
+
+	// Limits concurrent image decodes across all directories
+	MaxDecodeConcurrency int `env:"INPUT_MAX_DECODE_CONCURRENCY" long:"max-decode-concurrency" description:"maximum number of images decoded at the same time (0 for number of CPUs)"`
+
+	// Sizes of additional sprites, e.g. 648 for thumbnails_0_648.jpg
+	ExtraThumbSizes []int `env:"INPUT_EXTRA_THUMB_SIZES" env-delim:"," long:"extra-thumb-size" description:"generate additional thumbnail sprites of this size"`
+
+	// Format of all sprites, regardless of the source images format
+	SpriteFormat string `env:"INPUT_SPRITE_FORMAT" long:"sprite-format" description:"use a single thumbnail format for all images" choice:"" choice:"jpg" choice:"png"`
+
+	// JPEG sprites quality
+	JPEGQuality     int    `env:"INPUT_JPEG_QUALITY" long:"jpeg-quality" description:"quality of JPEG thumbnails (1-100)" default:"95"`
+	JPEGSubsampling string `env:"INPUT_JPEG_SUBSAMPLING" long:"jpeg-subsampling" description:"chroma subsampling of JPEG thumbnails" choice:"4:2:0" choice:"4:4:4" default:"4:2:0"`
+	AdaptiveQuality bool   `env:"INPUT_ADAPTIVE_QUALITY" long:"adaptive-quality" description:"lower JPEG quality down to 80 for thumbnails of simple images"`
+
+	// Stable checksums of unchanged PNG sprites, e.g. after updating Go
+	ReproduciblePNG bool `env:"INPUT_REPRODUCIBLE_PNG" long:"reproducible-png" description:"encode PNG thumbnails with fixed settings, so that the same images always give the same bytes"`
+
+	// Smaller PNG sprites at the cost of encoding time
+	OptimizePNG bool `env:"INPUT_OPTIMIZE_PNG" long:"optimize-png" description:"compress PNG thumbnails harder and optimize them with oxipng if it's installed"`
+
+	// Watermark drawn over each tile
+	WatermarkPath     string `env:"INPUT_WATERMARK" long:"watermark" description:"path to watermark image drawn over each thumbnail"`
+	WatermarkPosition string `env:"INPUT_WATERMARK_POSITION" long:"watermark-position" description:"position of watermark on thumbnails" choice:"top-left" choice:"top-right" choice:"bottom-left" choice:"bottom-right" choice:"center" default:"bottom-right"`
+
+	// Sprite format for file extensions, e.g. ".jpe:jpg" or ".jpeg:jpeg" to keep them apart from .jpg
+	FormatGroups map[string]string `env:"INPUT_FORMAT_GROUPS" env-delim:"," long:"format-group" description:"sprite format (jpg, jpeg or png) for files with given extension, e.g. .jpe:jpg"`
+
+	// Sprite format used for format groups without a sprite encoder instead of failing
+	FallbackFormat string `env:"INPUT_FALLBACK_FORMAT" long:"fallback-format" description:"thumbnail format used for format groups that are not supported, instead of failing" choice:"" choice:"jpg" choice:"png"`
+
+	// Thumbnail formats written as a file per image instead of sprites, e.g. for logos
+	IndividualFormats []string `env:"INPUT_INDIVIDUAL_FORMATS" env-delim:"," long:"individual-format" description:"write a thumbnail file per image (e.g. logo_thumb.png) for this thumbnail format instead of sprites, can be repeated"`
+
+	// Sort key used to pack tiles into sprites
+	SortBy string `env:"INPUT_SORT_BY" long:"sort-by" description:"sort key for packing tiles into sprites" choice:"height" choice:"width" choice:"area" choice:"aspect" choice:"name" default:"height"`
+
+	// Stretch images to square tiles for a regular grid instead of keeping their aspect ratio
+	ThumbMode string `env:"INPUT_THUMB_MODE" long:"thumb-mode" description:"how images are resized into tiles: fit keeps the aspect ratio, stretch distorts them to squares" choice:"fit" choice:"stretch" default:"fit"`
+
+	// Exact long edge of tiles instead of fitting them into a box, e.g. for grid math
+	ResizeMode string `env:"INPUT_RESIZE_MODE" long:"resize-mode" description:"how tiles of fit mode are sized: box fits images into a square without enlarging them, long-edge makes their longer side exactly the tile size" choice:"box" choice:"long-edge" default:"box"`
+
+	// Position of tiles shorter than their row
+	VerticalAlign string `env:"INPUT_VERTICAL_ALIGN" long:"vertical-align" description:"position of tiles in sprite rows taller than them" choice:"top" choice:"center" choice:"bottom" default:"top"`
+
+	// Image put into the first tile of its sprite in every directory that has it
+	CoverImage string `env:"INPUT_COVER_IMAGE" long:"cover-image" description:"file name of an image to put into the first tile of its sprite, e.g. cover.jpg"`
+
+	// Hidden images such as .cover.jpg are skipped unless enabled
+	IncludeHiddenFiles bool `env:"INPUT_INCLUDE_HIDDEN_FILES" long:"include-hidden-files" description:"process files whose names start with a dot"`
+
+	// Prefix of generated sprite file names
+	SpritePrefix string `env:"INPUT_SPRITE_PREFIX" long:"sprite-prefix" description:"prefix of thumbnail file names, files with it are not processed" default:"thumbnails_"`
+
+	// Embed sprite checksum into its file name instead of "?crc=" query
+	ContentAddressedThumbs bool `env:"INPUT_CONTENT_ADDRESSED_THUMBS" long:"content-addressed-thumbs" description:"embed checksum into thumbnail file names"`
+
+	// Reference thumbnails without "?crc=" query, for servers that don't ignore it
+	NoCRCSuffix bool `env:"INPUT_NO_CRC_SUFFIX" long:"no-crc-suffix" description:"don't add ?crc= query to thumbnail paths"`
+
+	// Standalone downscaled copies of large landscape images for srcset
+	VariantWidths   []int `env:"INPUT_VARIANT_WIDTHS" env-delim:"," long:"variant-width" description:"write a downscaled copy of this width (e.g. photo.480w.jpg) of large landscape images, can be repeated"`
+	VariantMinWidth int   `env:"INPUT_VARIANT_MIN_WIDTH" long:"variant-min-width" description:"only write downscaled copies of landscape images at least this wide" default:"1200"`
+
+	// File names under tiles, for reviewing sprites
+	ContactSheet bool `env:"INPUT_CONTACT_SHEET" long:"contact-sheet" description:"draw file names under tiles of sprites"`
+
+	// Resized tiles as separate files, to debug orientation and crop issues
+	DumpTiles string `env:"INPUT_DUMP_TILES" long:"dump-tiles" description:"also write each resized tile as tile_<name>.png into this directory, under the path of its directory"`
+
+	// Animated WebP preview of each directory
+	AnimatedPreview      bool          `env:"INPUT_ANIMATED_PREVIEW" long:"animated-preview" description:"write animated preview.webp for each directory"`
+	PreviewFrameDuration time.Duration `env:"INPUT_PREVIEW_FRAME_DURATION" long:"preview-frame-duration" description:"duration of each frame in animated preview" default:"500ms"`
+
+	// Thumbnail images inside zip archives without extracting them
+	ReadArchives bool `env:"INPUT_READ_ARCHIVES" long:"read-archives" description:"process images inside zip archives"`
+
+	// OpenGraph social preview of each directory
+	SocialCard       bool `env:"INPUT_SOCIAL_CARD" long:"social-card" description:"write og.jpg social preview for each directory"`
+	SocialCardWidth  int  `env:"INPUT_SOCIAL_CARD_WIDTH" long:"social-card-width" description:"width of social preview" default:"1200"`
+	SocialCardHeight int  `env:"INPUT_SOCIAL_CARD_HEIGHT" long:"social-card-height" description:"height of social preview" default:"630"`
+	SocialCardTiles  int  `env:"INPUT_SOCIAL_CARD_TILES" long:"social-card-tiles" description:"maximum number of images in social preview" default:"6"`
+
+	// Atlases of thumbnails of all directories, e.g. for a global search
+	GlobalAtlas bool `env:"INPUT_GLOBAL_ATLAS" long:"global-atlas" description:"compose thumbnails of all directories into atlases in media directory, listed in .atlas.yml"`
+
+	// Image to generate favicon.ico from, next to it
+	FaviconSource string `env:"INPUT_FAVICON_SOURCE" long:"favicon-source" description:"path to image in media directory to generate favicon.ico (16, 32 and 48px) from"`
+
+	// Read GPS coordinates from EXIF
+	ExtractGPS bool `env:"INPUT_EXTRACT_GPS" long:"extract-gps" description:"store GPS coordinates from EXIF data"`
+
+	// Log why thumbnails are regenerated
+	VerboseDiff bool `env:"INPUT_VERBOSE_DIFF" long:"verbose-diff" description:"log what changed in each directory and why thumbnails are regenerated"`
+
+	// Review changes of .thumbs.yml files before they are written
+	ThumbsDiff bool `env:"INPUT_THUMBS_DIFF" long:"thumbs-diff" description:"print a unified diff of .thumbs.yml files to stdout instead of writing them, without uploading anything"`
+
+	// Smaller .thumbs.yml files for directories with many entries, read either way
+	CompressThumbsFile bool `env:"INPUT_COMPRESS_THUMBS_FILE" long:"compress-thumbs-file" description:"write gzipped .thumbs.yml.gz instead of .thumbs.yml"`
+
+	// Integrity audit before deploying, e.g. after manual edits of sprites
+	VerifySprites bool `env:"INPUT_VERIFY_SPRITES" long:"verify-sprites" description:"check that checksums of thumbnail files match their ?crc= in .thumbs.yml files and fail otherwise, without changing anything"`
+
 	// Blurhash
-	ForceBlurhash       bool `env:"INPUT_FORCE_BLURHASH" long:"force-blurhash" description:"force blurhash generation"`
-	ForceBlurhashImages bool `env:"INPUT_FORCE_BLURHASH_IMAGES" long:"force-blurhash-images" description:"force blurhash images generation"`
+	ForceBlurhash       bool   `env:"INPUT_FORCE_BLURHASH" long:"force-blurhash" description:"force blurhash generation"`
+	ForceBlurhashImages bool   `env:"INPUT_FORCE_BLURHASH_IMAGES" long:"force-blurhash-images" description:"force blurhash images generation"`
+	BlurhashImageFormat string `env:"INPUT_BLURHASH_IMAGE_FORMAT" long:"blurhash-image-format" description:"format of blurhash preview images" choice:"jpg" choice:"webp" default:"jpg"`
+	BlurhashImageSize   int    `env:"INPUT_BLURHASH_IMAGE_SIZE" long:"blurhash-image-size" description:"size of the longer side of blurhash preview images in pixels" default:"32"`
+	OnlyBlurhash        bool   `env:"INPUT_ONLY_BLURHASH" long:"only-blurhash" description:"only set missing blurhashes of media in existing .thumbs.yml files, without looking for new files, generating sprites or uploading"`
+	BlurhashMinSize     int    `env:"INPUT_BLURHASH_MIN_SIZE" long:"blurhash-min-size" description:"skip blurhash of images with a side shorter than this many pixels, 0 to always calculate it"`
 }
 
 var cfg appConfig
 
+// enableMarkerFile opts a directory in with --require-marker.
+const enableMarkerFile = ".thumbs.enable"
+
+// filepathWalk is replaced in tests
+var filepathWalk = filepath.Walk
+
+// version is set at build time with -ldflags "-X main.version=…".
+var version = "dev"
+
 func main() {
 	log.Info("Starting...")
 
@@ -60,74 +304,498 @@ func main() {
 	log.Info("Finished")
 }
 
-func run() error {
-	_, err := flags.Parse(&cfg)
+func run() (err error) {
+	_, err = flags.Parse(&cfg)
 	if err != nil {
 		return fmt.Errorf("parsing flags: %w", err)
 	}
 
+	if cfg.PrintConfig {
+		return printConfig(os.Stdout, cfg)
+	}
+
+	// files with mapped extensions are picked up too
+	for ext := range cfg.FormatGroups {
+		thumbnailer.RegisterFormat(strings.ToLower(ext))
+	}
+
+	if cfg.ListFormats {
+		return listFormats(os.Stdout, cfg.FormatGroups)
+	}
+
+	if err = checkStdout(cfg); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	stats := &thumbnailer.Stats{}
+	var counter *uploader.Counter
+
+	// metrics are written for failed runs too, so that failures can be alerted on
+	if cfg.MetricsFile != "" {
+		defer func() {
+			if werr := writeMetricsFile(cfg.MetricsFile, summarize(stats, counter, start), err == nil, time.Now()); werr != nil {
+				if err == nil {
+					err = fmt.Errorf("writing metrics: %w", werr)
+					return
+				}
+				log.Errorf("Writing metrics: %v", werr)
+			}
+		}()
+	}
+
+	individualFormats := make(map[string]bool, len(cfg.IndividualFormats))
+	for _, format := range cfg.IndividualFormats {
+		individualFormats[strings.TrimPrefix(format, ".")] = true
+	}
+
 	var up thumbnailer.Uploader
-	if cfg.SkipImageUpload {
+	if cfg.SkipImageUpload || cfg.ThumbsDiff || cfg.VerifySprites {
 		up = uploader.NewNoOp()
 	} else {
-		r2, err := r2.NewR2(
-			cfg.R2AccountID,
-			cfg.R2AccessKeyID,
-			cfg.R2AccessKeySecret,
-			cfg.R2Bucket,
-		)
+		var targets []uploader.Uploader
+		for _, bucket := range append([]string{cfg.R2Bucket}, cfg.R2MirrorBuckets...) {
+			r2, err := newR2Client(bucket)
+			if err != nil {
+				return fmt.Errorf("creating R2 client for bucket %q: %w", bucket, err)
+			}
+
+			if cfg.UploadRate > 0 {
+				// throttled requests are retried by the rate limiter
+				r2 = r2.WithoutThrottleRetries()
+			}
+
+			r2Uploader := uploader.NewR2(
+				context.Background(),
+				r2,
+				cfg.MediaDir+"/",
+			).WithTimeout(cfg.UploadTimeout)
+			if cfg.OriginalsAsAttachments {
+				opts := thumbnailer.Options{
+					SpritePrefix:      cfg.SpritePrefix,
+					VariantWidths:     cfg.VariantWidths,
+					IndividualFormats: individualFormats,
+					SocialCard:        cfg.SocialCard,
+					AnimatedPreview:   cfg.AnimatedPreview,
+					FaviconSource:     cfg.FaviconSource,
+				}
+				r2Uploader = r2Uploader.WithAttachments(func(key string) bool {
+					return !thumbnailer.IsGenerated(path.Base(key), opts)
+				})
+			}
+
+			var target uploader.Uploader = r2Uploader
+
+			if cfg.UploadRate > 0 {
+				target = uploader.NewRateLimit(target, cfg.UploadRate)
+			}
+
+			targets = append(targets, target)
+		}
+
+		up = targets[0]
+		if len(targets) > 1 {
+			up = uploader.NewMulti(uploader.MultiPolicy(cfg.R2MirrorPolicy), targets...)
+		}
+
+		counter = uploader.NewCounter(up)
+		up = counter
+	}
+
+	if cfg.MaxUploadBytes > 0 {
+		up = uploader.NewLimit(up, cfg.MaxUploadBytes)
+	}
+
+	if cfg.UploadJournal != "" {
+		journal, err := uploader.NewJournal(up, cfg.UploadJournal)
 		if err != nil {
-			return fmt.Errorf("creating R2 client: %w", err)
+			return fmt.Errorf("creating upload journal: %w", err)
+		}
+		defer journal.Close()
+		up = journal
+	}
+
+	maxDecodes := cfg.MaxDecodeConcurrency
+	if maxDecodes <= 0 {
+		maxDecodes = runtime.NumCPU()
+	}
+	decodeLimiter := thumbnailer.NewDecodeLimiter(maxDecodes)
+
+	var denylist map[string]bool
+	if cfg.DenylistFile != "" {
+		// same format as include files
+		lines, err := readIncludeFile(cfg.DenylistFile)
+		if err != nil {
+			return fmt.Errorf("reading denylist: %w", err)
+		}
+		denylist = make(map[string]bool, len(lines))
+		for _, line := range lines {
+			denylist[strings.ToLower(line)] = true
 		}
-		up = uploader.NewR2(
-			context.Background(),
-			r2,
-			cfg.MediaDir+"/",
-		)
 	}
 
-	dirs, err := scanDirectories(cfg.MediaDir)
+	var watermark image.Image
+	if cfg.WatermarkPath != "" {
+		watermark, err = thumbnailer.LoadWatermark(cfg.WatermarkPath)
+		if err != nil {
+			return fmt.Errorf("loading watermark: %w", err)
+		}
+	}
+
+	var (
+		dirs, unusedIncludes, skippedDirs []string
+		batch                             *int
+	)
+	if cfg.Batch != "" {
+		var (
+			dir string
+			n   int
+		)
+		if dir, n, err = parseBatch(cfg.Batch); err != nil {
+			return fmt.Errorf("parsing batch: %w", err)
+		}
+		batch = &n
+		dirs, err = singleDirectory(cfg.MediaDir, dir)
+	} else if cfg.SingleDir != "" {
+		dirs, err = singleDirectory(cfg.MediaDir, cfg.SingleDir)
+	} else {
+		dirs, unusedIncludes, skippedDirs, err = scanDirectories(cfg.MediaDir)
+	}
 	if err != nil {
 		return fmt.Errorf("scanning directories: %w", err)
 	}
 
-	var allUpdated []string
+	opts := thumbnailer.Options{
+		Force:                cfg.ForceThumbnails,
+		SkipThumbnails:       cfg.SkipThumbnails,
+		UploadAltText:        cfg.UploadAltText,
+		MaxOriginalDimension: cfg.MaxOriginalDimension,
+		NoPrune:              cfg.NoPrune,
+		BaseURL:              cfg.BaseURL,
+		MediaDir:             cfg.MediaDir,
+		DetectChanges:        cfg.DetectChanges,
+		DetectRenames:        cfg.DetectRenames,
+		Dedup:                cfg.Dedup,
+		DedupThreshold:       cfg.DedupThreshold,
+		ForceRehash:          cfg.ForceRehash,
+		Denylist:             denylist,
+		MinAspectRatio:       cfg.MinAspectRatio,
+		MaxAspectRatio:       cfg.MaxAspectRatio,
+		ExtractGPS:           cfg.ExtractGPS,
+		ReadArchives:         cfg.ReadArchives,
+		SortBy:               thumbnailer.SortBy(cfg.SortBy),
+		ThumbMode:            thumbnailer.ThumbMode(cfg.ThumbMode),
+		ResizeMode:           thumbnailer.ResizeMode(cfg.ResizeMode),
+		VerticalAlign:        thumbnailer.VerticalAlign(cfg.VerticalAlign),
+		Cover:                cfg.CoverImage,
+		BatchSize:            cfg.BatchSize,
+		MaxBatches:           cfg.MaxBatches,
+		Strict:               cfg.Strict,
+		AppendOnly:           cfg.AppendOnly,
+		Batch:                batch,
+		ExtraSizes:           cfg.ExtraThumbSizes,
+		FormatGroups:         cfg.FormatGroups,
+		FallbackFormat:       cfg.FallbackFormat,
+		IndividualFormats:    individualFormats,
+		SpritePrefix:         cfg.SpritePrefix,
+		IncludeHidden:        cfg.IncludeHiddenFiles,
+		NoCRCSuffix:          cfg.NoCRCSuffix,
+
+		MinFreeSpace:       cfg.MinFreeSpace,
+		DecodeMemoryBudget: cfg.DecodeMemoryBudget,
+		SpriteFormat:       cfg.SpriteFormat,
+		ContentAddressed:   cfg.ContentAddressedThumbs,
+		DecodeLimiter:      decodeLimiter,
+		ReadRetries:        cfg.ReadRetries,
+		ReadRetryBackoff:   cfg.ReadRetryBackoff,
+
+		JPEGQuality:     cfg.JPEGQuality,
+		JPEGSubsampling: jpegenc.Subsampling(cfg.JPEGSubsampling),
+		AdaptiveQuality: cfg.AdaptiveQuality,
+		OptimizePNG:     cfg.OptimizePNG,
+		ReproduciblePNG: cfg.ReproduciblePNG,
+
+		Watermark:         watermark,
+		WatermarkPosition: cfg.WatermarkPosition,
+
+		ForceBlurhash:       cfg.ForceBlurhash,
+		ForceBlurhashImages: cfg.ForceBlurhashImages,
+		BlurhashImageFormat: cfg.BlurhashImageFormat,
+		BlurhashImageSize:   cfg.BlurhashImageSize,
+		BlurhashMinSize:     cfg.BlurhashMinSize,
+
+		VariantWidths:   cfg.VariantWidths,
+		VariantMinWidth: cfg.VariantMinWidth,
+
+		ContactSheet: cfg.ContactSheet,
+		DumpTilesDir: cfg.DumpTiles,
+
+		AnimatedPreview:      cfg.AnimatedPreview,
+		PreviewFrameDuration: cfg.PreviewFrameDuration,
+
+		SocialCard:       cfg.SocialCard,
+		SocialCardWidth:  cfg.SocialCardWidth,
+		SocialCardHeight: cfg.SocialCardHeight,
+		SocialCardTiles:  cfg.SocialCardTiles,
+
+		FaviconSource: cfg.FaviconSource,
+
+		VerboseDiff:        cfg.VerboseDiff,
+		CompressThumbsFile: cfg.CompressThumbsFile,
+
+		Stats: stats,
+	}
+	if cfg.ThumbsDiff {
+		opts.Diff = os.Stdout
+	}
+	if cfg.OutputJSONLines != "" {
+		stream, err := openOutput(cfg.OutputJSONLines)
+		if err != nil {
+			return fmt.Errorf("opening media stream: %w", err)
+		}
+		defer stream.Close()
+		opts.MediaStream = stream
+	}
+
+	if cfg.VerifySprites {
+		return verifySprites(dirs, opts)
+	}
+
+	if cfg.FailOnEmpty {
+		empty, err := findEmptyDirs(dirs, opts)
+		if err != nil {
+			return fmt.Errorf("looking for empty directories: %w", err)
+		}
+		if len(empty) > 0 {
+			return fmt.Errorf("%d directories have no images: %s", len(empty), strings.Join(empty, ", "))
+		}
+	}
+
+	var (
+		allUpdated []string
+		newerDirs  []string // written by a newer version, left as they are
+	)
+	allHashes := map[string]string{}
+	allMedia := map[string][]*thumbnailer.Media{}
+	if cfg.OutputJSON {
+		opts.OnMedia = collectMedia(cfg.MediaDir, allMedia)
+	}
 
 	for _, dir := range dirs {
-		updated, err := thumbnailer.ProcessDirectory(dir, up, cfg.ForceThumbnails)
+		var updated []thumbnailer.Updated
+		if cfg.OnlyBlurhash {
+			err = backfillBlurhashes(dir, opts)
+		} else {
+			updated, err = thumbnailer.ProcessDirectory(dir, up, opts)
+		}
+		if errors.Is(err, thumbnailer.ErrNewerThumbsFile) {
+			log.Warnf("Skipping %s: %v", dir, err)
+			newerDirs = append(newerDirs, dir)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("processing directory %q: %w", dir, err)
 		}
 
-		allUpdated = append(
-			allUpdated,
-			convertToFilePaths(updated, filepath.Base(cfg.MediaDir)+"/")...,
-		)
+		paths := make([]string, len(updated))
+		for i, u := range updated {
+			paths[i] = u.Path
+		}
+
+		paths = convertToFilePaths(paths, filepath.Base(cfg.MediaDir)+"/")
+		for i, path := range paths {
+			allHashes[path] = updated[i].Hash
+		}
+
+		allUpdated = append(allUpdated, paths...)
+
 	}
 
-	// json-encode allUpdated
-	b, err := json.Marshal(allUpdated)
-	if err != nil {
-		return fmt.Errorf("json encoding allUpdated: %w", err)
+	if cfg.OutputJSON {
+		if err = writeMediaJSON(os.Stdout, allMedia); err != nil {
+			return fmt.Errorf("writing media: %w", err)
+		}
 	}
 
-	updated := string(b)
+	// atlases are composed of all directories, they can't be rebuilt from a single one
+	fullScan := cfg.Batch == "" && cfg.SingleDir == ""
+	if cfg.GlobalAtlas && !fullScan {
+		log.Warn("Not updating the global atlas, only a single directory was processed")
+	}
+	if cfg.GlobalAtlas && fullScan && len(newerDirs) > 0 {
+		log.Warnf("Not updating the global atlas, %d directories have thumbs files of a newer version", len(newerDirs))
+	}
+	if cfg.GlobalAtlas && fullScan && len(newerDirs) == 0 && !cfg.OnlyBlurhash && !cfg.ThumbsDiff {
+		if err = thumbnailer.GenerateAtlases(up, cfg.MediaDir, dirs, opts); err != nil {
+			return fmt.Errorf("generating atlases: %w", err)
+		}
+	}
 
-	// escape quotes if needed
-	if cfg.EscapeQuotes {
-		updated = escape(updated)
+	if cfg.FaviconSource != "" && !cfg.OnlyBlurhash && !cfg.ThumbsDiff {
+		if err = thumbnailer.GenerateFavicon(up, cfg.FaviconSource, opts); err != nil {
+			return fmt.Errorf("generating favicon: %w", err)
+		}
 	}
 
-	err = writeOutput("updated", updated)
-	if err != nil {
+	if err = writeJSONOutput("updated", allUpdated); err != nil {
 		return fmt.Errorf("writing output: %w", err)
 	}
 
+	if cfg.OutputHashes {
+		if err = writeJSONOutput("updated_hashes", allHashes); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+
+	if cfg.ReportUnusedIncludes {
+		for _, pattern := range unusedIncludes {
+			log.Warnf("Include pattern %q did not match any directory", pattern)
+		}
+	}
+
+	if len(skippedDirs) > 0 {
+		log.Warnf("Skipped %d unreadable directories: %s", len(skippedDirs), strings.Join(skippedDirs, ", "))
+	}
+
+	summary := summarize(stats, counter, start)
+	log.Infof(
+		"Processed %d directories in %s: %d new file(s), %d deleted, %d sprite(s) written, %d bytes uploaded",
+		summary.Directories,
+		summary.Duration.Round(time.Millisecond),
+		summary.Added,
+		summary.Deleted,
+		summary.Sprites,
+		summary.UploadedBytes,
+	)
+
 	return nil
 }
 
-func scanDirectories(dir string) ([]string, error) {
-	var result []string
+// runSummary aggregates statistics of a run.
+type runSummary struct {
+	thumbnailer.StatsSnapshot
+	UploadedBytes int64
+	Duration      time.Duration
+}
+
+// summarize returns statistics of the run so far.
+func summarize(stats *thumbnailer.Stats, counter *uploader.Counter, start time.Time) runSummary {
+	summary := runSummary{
+		StatsSnapshot: stats.Snapshot(),
+		Duration:      time.Since(start),
+	}
+	if counter != nil {
+		summary.UploadedBytes = counter.Bytes()
+	}
+	return summary
+}
+
+// lastSuccessMetric is kept from the previous metrics file when a run fails.
+const lastSuccessMetric = "thumbnailer_last_success_timestamp_seconds"
+
+// writeMetricsFile writes the summary of the last run in Prometheus text format, as gauges,
+// replacing the file at once so the textfile collector never reads it half-written.
+func writeMetricsFile(path string, summary runSummary, success bool, now time.Time) error {
+	succeeded, lastSuccess := 1, now.Unix()
+	if !success {
+		succeeded, lastSuccess = 0, readLastSuccess(path)
+	}
+
+	var b bytes.Buffer
+	metric := func(name, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	metric("thumbnailer_last_run_directories_processed", "Directories processed by the last run.", summary.Directories)
+	metric("thumbnailer_last_run_files_added", "New files found by the last run.", summary.Added)
+	metric("thumbnailer_last_run_files_deleted", "Entries of deleted files removed by the last run.", summary.Deleted)
+	metric("thumbnailer_last_run_sprites_generated", "Thumbnail sprites written by the last run.", summary.Sprites)
+	metric("thumbnailer_last_run_uploaded_bytes", "Bytes uploaded by the last run.", summary.UploadedBytes)
+	metric("thumbnailer_last_run_duration_seconds", "Duration of the last run.", summary.Duration.Seconds())
+	metric("thumbnailer_last_run_timestamp_seconds", "Time the last run finished.", now.Unix())
+	metric("thumbnailer_last_run_success", "Whether the last run succeeded (1) or failed (0).", succeeded)
+	if lastSuccess > 0 {
+		metric(lastSuccessMetric, "Time the last successful run finished.", lastSuccess)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+
+	if _, err = tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readLastSuccess returns the time of the last successful run from the metrics file,
+// 0 if it's unknown.
+func readLastSuccess(path string) int64 {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, lastSuccessMetric+" "); ok {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// newR2Client creates a client for the bucket on R2
+// or, with --r2-endpoint, on another S3-compatible storage.
+func newR2Client(bucket string) (*r2.R2, error) {
+	var (
+		client *r2.R2
+		err    error
+	)
+	if cfg.R2Endpoint != "" {
+		client, err = r2.NewWithRegion(
+			cfg.R2Endpoint,
+			cfg.R2Region,
+			cfg.R2AccessKeyID,
+			cfg.R2AccessKeySecret,
+			bucket,
+		)
+	} else {
+		if cfg.R2AccountID == "" {
+			return nil, errors.New("either --r2-account-id or --r2-endpoint must be set")
+		}
+		client, err = r2.NewR2(
+			cfg.R2AccountID,
+			cfg.R2AccessKeyID,
+			cfg.R2AccessKeySecret,
+			bucket,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = "alsosee-thumbnailer/" + version
+	}
+	return client.WithUserAgent(userAgent), nil
+}
+
+// scanDirectories returns directories to process,
+// include patterns that did not match any directory
+// and directories skipped because they couldn't be read.
+func scanDirectories(dir string) ([]string, []string, []string, error) {
+	var result, skipped []string
 
 	// filter empty strings from cfg.Include
 	var include []string
@@ -136,12 +804,42 @@ func scanDirectories(dir string) ([]string, error) {
 			include = append(include, item)
 		}
 	}
+
+	if cfg.IncludeFile != "" {
+		lines, err := readIncludeFile(cfg.IncludeFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading include file: %w", err)
+		}
+		include = append(include, lines...)
+	}
+
 	gi := gitignore.CompileIgnoreLines(include...)
+	matched := make(map[string]bool, len(include))
+
+	// each pattern on its own, to tell which of overlapping ones matched
+	patterns := make(map[string]*gitignore.GitIgnore, len(include))
+	for _, item := range include {
+		if !strings.HasPrefix(item, "!") {
+			patterns[item] = gitignore.CompileIgnoreLines(item)
+		}
+	}
 
 	log.Info("Getting directories...")
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	err := filepathWalk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			// the root directory itself must be readable
+			if !cfg.SkipUnreadableDirs || info == nil || !info.IsDir() || path == dir {
+				return err
+			}
+
+			log.Warnf("Skipping %s: %v", path, err)
+			skipped = append(skipped, path)
+
+			// Walk visits a directory before failing to list it
+			if len(result) > 0 && result[len(result)-1] == path {
+				result = result[:len(result)-1]
+			}
+			return filepath.SkipDir
 		}
 
 		if !info.IsDir() { // skip files
@@ -158,15 +856,334 @@ func scanDirectories(dir string) ([]string, error) {
 			return filepath.SkipDir
 		}
 
-		if len(include) > 0 && !gi.MatchesPath(path) {
-			log.Infof("Ignoring %s", path)
+		if len(include) > 0 {
+			if !gi.MatchesPath(path) {
+				log.Infof("Ignoring %s", path)
+				return nil
+			}
+			for item, pattern := range patterns {
+				if !matched[item] && pattern.MatchesPath(path) {
+					matched[item] = true
+				}
+			}
+		}
+
+		// subdirectories may still opt in on their own
+		if cfg.RequireMarker && !hasMarker(path) {
+			log.Infof("Ignoring %s without %s", path, enableMarkerFile)
 			return nil
 		}
 
 		result = append(result, path)
 		return nil
 	})
-	return result, err
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var unused []string
+	for _, item := range include {
+		// negated patterns never match on their own
+		if !matched[item] && !strings.HasPrefix(item, "!") {
+			unused = append(unused, item)
+		}
+	}
+
+	prioritize(result, dir, cfg.Priority)
+
+	return result, unused, skipped, nil
+}
+
+// hasMarker reports whether the directory has an enableMarkerFile.
+func hasMarker(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, enableMarkerFile))
+	return err == nil
+}
+
+// singleDirectory returns the directory relative to root as the only one to process,
+// instead of walking root.
+func singleDirectory(root, dir string) ([]string, error) {
+	path := filepath.Join(root, dir)
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is outside of media directory %s", dir, root)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+
+	return []string{path}, nil
+}
+
+// parseBatch parses a batch selector such as "People/Jane:3".
+func parseBatch(s string) (dir string, batch int, err error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("%q is not in directory:batch format", s)
+	}
+
+	batch, err = strconv.Atoi(s[i+1:])
+	if err != nil || batch < 0 {
+		return "", 0, fmt.Errorf("%q is not a valid batch number", s[i+1:])
+	}
+	return s[:i], batch, nil
+}
+
+// prioritize moves directories under given prefixes (relative to root)
+// to the front, in the order of prefixes, keeping the walk order otherwise.
+func prioritize(dirs []string, root string, prefixes []string) {
+	if len(prefixes) == 0 {
+		return
+	}
+
+	rank := func(dir string) int {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return len(prefixes)
+		}
+		rel = filepath.ToSlash(rel)
+		for i, prefix := range prefixes {
+			prefix = strings.Trim(prefix, "/")
+			if rel == prefix || strings.HasPrefix(rel, prefix+"/") {
+				return i
+			}
+		}
+		return len(prefixes)
+	}
+
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return rank(dirs[i]) < rank(dirs[j])
+	})
+}
+
+// backfillBlurhashes backfills blurhashes of media of the directory.
+// .thumbs.yml is not written for directories without media, so it may only be missing
+// if there are no images in the directory.
+func backfillBlurhashes(dir string, opts thumbnailer.Options) error {
+	err := thumbnailer.BackfillBlurhashes(dir, opts)
+	if !errors.Is(err, thumbnailer.ErrThumbYamlNotFound) {
+		return err
+	}
+
+	files, scanErr := thumbnailer.ScanDirectory(dir, opts)
+	if scanErr != nil {
+		return scanErr
+	}
+	if len(files) > 0 {
+		return err
+	}
+	return nil
+}
+
+// verifySprites logs sprites of the directories that don't match their checksums
+// and fails if there are any.
+func verifySprites(dirs []string, opts thumbnailer.Options) error {
+	var count int
+	for _, dir := range dirs {
+		mismatches, err := thumbnailer.VerifySprites(dir, opts)
+		if err != nil {
+			return fmt.Errorf("verifying sprites of %q: %w", dir, err)
+		}
+		for _, m := range mismatches {
+			log.Error(m.String())
+		}
+		count += len(mismatches)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("%d thumbnail(s) don't match their checksums", count)
+	}
+	log.Infof("Verified thumbnails of %d directories", len(dirs))
+	return nil
+}
+
+// findEmptyDirs returns directories without images to process.
+// Directories with subdirectories are not considered empty,
+// they often only group other directories.
+func findEmptyDirs(dirs []string, opts thumbnailer.Options) ([]string, error) {
+	var empty []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		if hasSubdirectory(entries) {
+			continue
+		}
+
+		files, err := thumbnailer.ScanDirectory(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			empty = append(empty, dir)
+		}
+	}
+	return empty, nil
+}
+
+func hasSubdirectory(entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// listFormats writes supported input file extensions with formats of their sprites,
+// and formats sprites can be encoded in.
+func listFormats(w io.Writer, groups map[string]string) error {
+	supported := thumbnailer.SupportedExtensions(groups)
+	exts := make([]string, 0, len(supported))
+	for ext := range supported {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	var b strings.Builder
+	b.WriteString("Input file extensions:\n")
+	for _, ext := range exts {
+		fmt.Fprintf(&b, "  %-8s %s thumbnails\n", ext, supported[ext])
+	}
+	fmt.Fprintf(&b, "Thumbnail formats: %s\n", strings.Join(thumbnailer.SpriteFormats(), ", "))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// printConfig writes the configuration as YAML keyed by flag names,
+// including applied defaults. Fields tagged with secret:"true" are redacted.
+func printConfig(w io.Writer, cfg appConfig) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("long")
+		if name == "" || name == "print-config" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		switch {
+		case field.Tag.Get("secret") == "true" && !v.Field(i).IsZero():
+			value = "<redacted>"
+		case v.Field(i).Type() == reflect.TypeOf(time.Duration(0)):
+			value = value.(time.Duration).String()
+		}
+
+		var valueNode yaml.Node
+		if err := valueNode.Encode(value); err != nil {
+			return fmt.Errorf("encoding %s: %w", name, err)
+		}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, &valueNode)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	return enc.Close()
+}
+
+// readIncludeFile reads gitignore-style patterns from the file,
+// skipping blank lines and comments.
+func readIncludeFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result, nil
+}
+
+// openOutput creates the file at path, or returns stdout for "-".
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+// nopCloser keeps stdout open when the output is closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// writeMediaJSON writes media of all directories as indented JSON.
+func writeMediaJSON(w io.Writer, media map[string][]*thumbnailer.Media) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(media)
+}
+
+// checkStdout returns an error if more than one output is written to stdout,
+// since their combined output couldn't be parsed.
+func checkStdout(cfg appConfig) error {
+	var writers []string
+	if cfg.OutputJSON {
+		writers = append(writers, "--output-json")
+	}
+	if cfg.OutputJSONLines == "-" {
+		writers = append(writers, "--output-jsonl -")
+	}
+	if cfg.ThumbsDiff {
+		writers = append(writers, "--thumbs-diff")
+	}
+	if len(writers) > 1 {
+		return fmt.Errorf("%s all write to stdout, use only one of them", strings.Join(writers, ", "))
+	}
+	return nil
+}
+
+// collectMedia returns an Options.OnMedia function adding media of directories to all,
+// keyed by their paths relative to root. Directories without media are left out.
+func collectMedia(root string, all map[string][]*thumbnailer.Media) func(string, []*thumbnailer.Media) error {
+	return func(dir string, media []*thumbnailer.Media) error {
+		if len(media) == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return fmt.Errorf("getting relative path of %q: %w", dir, err)
+		}
+		all[filepath.ToSlash(rel)] = media
+		return nil
+	}
+}
+
+// writeJSONOutput writes json-encoded value as GitHub Actions output,
+// escaping quotes if needed.
+func writeJSONOutput(name string, value any) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("json encoding %s: %w", name, err)
+	}
+
+	s := string(b)
+	if cfg.EscapeQuotes {
+		s = escape(s)
+	}
+
+	return writeOutput(name, s)
 }
 
 func writeOutput(name, value string) error {
@@ -189,7 +1206,7 @@ func writeOutput(name, value string) error {
 	}
 	defer f.Close()
 
-	if _, err = f.WriteString(githubOutput); err != nil {
+	if _, err = f.WriteString(githubOutput + "\n"); err != nil {
 		return fmt.Errorf("failed to write result to file %q: %w", path, err)
 	}
 
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/alsosee/thumbnailer/pkg/thumbnailer"
+	"github.com/alsosee/thumbnailer/pkg/uploader"
 )
 
 func TestEscape(t *testing.T) {
@@ -32,3 +45,435 @@ func TestEscape(t *testing.T) {
 		})
 	}
 }
+
+func TestReadIncludeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "include.txt")
+	content := "# people\n*/People\n\n  */Movies  \n#*/Books\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readIncludeFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"*/People", "*/Movies"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestScanDirectoriesUnusedIncludes(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"People", "Movies"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(include []string) { cfg.Include = include }(cfg.Include)
+	cfg.Include = []string{"*/People", "*/Peple"}
+
+	dirs, unused, _, err := scanDirectories(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{filepath.Join(dir, "People")}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got dirs %q; want %q", dirs, want)
+	}
+
+	if want := []string{"*/Peple"}; !reflect.DeepEqual(unused, want) {
+		t.Errorf("got unused %q; want %q", unused, want)
+	}
+}
+
+func TestScanDirectoriesOverlappingIncludes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "People", "Jane"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(include []string) { cfg.Include = include }(cfg.Include)
+	// both patterns match People/Jane
+	cfg.Include = []string{"*/People/Jane", "*/People/*"}
+
+	_, unused, _, err := scanDirectories(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unused) != 0 {
+		t.Errorf("got unused %q; want none", unused)
+	}
+}
+
+func TestScanDirectoriesSkipUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"People", "Private"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	private := filepath.Join(dir, "Private")
+
+	// like filepath.Walk for a directory that can't be listed:
+	// it is visited, then reported with the error
+	defer func() { filepathWalk = filepath.Walk }()
+	filepathWalk = func(root string, fn filepath.WalkFunc) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if path != private || err != nil {
+				return fn(path, info, err)
+			}
+			if err = fn(path, info, nil); err != nil {
+				return err
+			}
+			return fn(path, info, fs.ErrPermission)
+		})
+	}
+
+	defer func(skip bool) { cfg.SkipUnreadableDirs = skip }(cfg.SkipUnreadableDirs)
+
+	cfg.SkipUnreadableDirs = false
+	if _, _, _, err := scanDirectories(dir); err == nil {
+		t.Error("got nil error for unreadable directory")
+	}
+
+	cfg.SkipUnreadableDirs = true
+	dirs, _, skipped, err := scanDirectories(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{dir, filepath.Join(dir, "People")}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got dirs %q; want %q", dirs, want)
+	}
+	if want := []string{private}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("got skipped %q; want %q", skipped, want)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var b bytes.Buffer
+	err := printConfig(&b, appConfig{
+		MediaDir:          "media",
+		R2AccessKeyID:     "id",
+		R2AccessKeySecret: "secret",
+		SortBy:            "height",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := b.String()
+	for _, want := range []string{"media-dir: media\n", "r2-access-key-id: <redacted>\n", "r2-access-key-secret: <redacted>\n", "sort-by: height\n", "preview-frame-duration: 0s\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret\n") {
+		t.Errorf("output contains secret:\n%s", out)
+	}
+}
+
+func TestFindEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"People", "People/Alice", "People/Bob"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"People/Alice/photo.jpg", "People/Bob/notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := []string{dir, filepath.Join(dir, "People"), filepath.Join(dir, "People/Alice"), filepath.Join(dir, "People/Bob")}
+	empty, err := findEmptyDirs(dirs, thumbnailer.Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{filepath.Join(dir, "People/Bob")}; !reflect.DeepEqual(empty, want) {
+		t.Errorf("got %q; want %q", empty, want)
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	dirs := []string{"media", "media/Books", "media/Movies", "media/Movies/2024", "media/People", "media/Peoples"}
+	prioritize(dirs, "media", []string{"People", "Movies/2024/"})
+
+	want := []string{"media/People", "media/Movies/2024", "media", "media/Books", "media/Movies", "media/Peoples"}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got %q; want %q", dirs, want)
+	}
+}
+
+func TestSingleDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "People", "Jane", "2024"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "People", "notes.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := singleDirectory(root, "People/Jane")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{filepath.Join(root, "People", "Jane")}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got %q; want %q", dirs, want)
+	}
+
+	for _, dir := range []string{"People/notes.txt", "People/John", "../elsewhere"} {
+		if _, err = singleDirectory(root, dir); err == nil {
+			t.Errorf("%s: expected an error", dir)
+		}
+	}
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thumbnailer.prom")
+
+	summary := runSummary{
+		StatsSnapshot: thumbnailer.StatsSnapshot{Directories: 3, Added: 5, Deleted: 1, Sprites: 2},
+		UploadedBytes: 12345,
+		Duration:      1500 * time.Millisecond,
+	}
+	if err := writeMetricsFile(path, summary, true, time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE thumbnailer_last_run_directories_processed gauge",
+		"thumbnailer_last_run_directories_processed 3",
+		"thumbnailer_last_run_files_added 5",
+		"thumbnailer_last_run_files_deleted 1",
+		"thumbnailer_last_run_sprites_generated 2",
+		"thumbnailer_last_run_uploaded_bytes 12345",
+		"thumbnailer_last_run_duration_seconds 1.5",
+		"thumbnailer_last_run_timestamp_seconds 1700000000",
+		"thumbnailer_last_run_success 1",
+		"thumbnailer_last_success_timestamp_seconds 1700000000",
+	} {
+		if !strings.Contains(string(content), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, content)
+		}
+	}
+
+	// a failed run keeps the time of the last successful one
+	if err = writeMetricsFile(path, runSummary{}, false, time.Unix(1700003600, 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"thumbnailer_last_run_timestamp_seconds 1700003600",
+		"thumbnailer_last_run_success 0",
+		"thumbnailer_last_success_timestamp_seconds 1700000000",
+	} {
+		if !strings.Contains(string(content), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, content)
+		}
+	}
+	if strings.Contains(string(content), "_total") {
+		t.Errorf("got counters in:\n%s", content)
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	dir, batch, err := parseBatch("People/Jane:3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dir != "People/Jane" || batch != 3 {
+		t.Errorf("got %q, %d; want %q, %d", dir, batch, "People/Jane", 3)
+	}
+
+	for _, s := range []string{"People/Jane", "People/Jane:", "People/Jane:-1", "People/Jane:x"} {
+		if _, _, err = parseBatch(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestScanDirectoriesRequireMarker(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"People", "People/Jane", "Movies", "assets"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []string{"People/Jane", "Movies"} {
+		if err := os.WriteFile(filepath.Join(dir, sub, enableMarkerFile), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(require bool, include []string) {
+		cfg.RequireMarker, cfg.Include = require, include
+	}(cfg.RequireMarker, cfg.Include)
+	cfg.RequireMarker = true
+	cfg.Include = []string{"*/People/*"}
+
+	dirs, _, _, err := scanDirectories(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{filepath.Join(dir, "People", "Jane")}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got dirs %q; want %q", dirs, want)
+	}
+}
+
+func TestListFormats(t *testing.T) {
+	var b bytes.Buffer
+	if err := listFormats(&b, map[string]string{".jpeg": "jpeg"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"  .jpeg    jpeg thumbnails\n",
+		"  .jpg     jpg thumbnails\n",
+		"  .png     png thumbnails\n",
+		"Thumbnail formats: jpeg, jpg, png\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestNewR2ClientAccountOrEndpoint(t *testing.T) {
+	defer func(account, endpoint string) {
+		cfg.R2AccountID, cfg.R2Endpoint = account, endpoint
+	}(cfg.R2AccountID, cfg.R2Endpoint)
+
+	cfg.R2AccountID, cfg.R2Endpoint = "", ""
+	if _, err := newR2Client("bucket"); err == nil {
+		t.Errorf("got no error without account id and endpoint")
+	}
+
+	cfg.R2Endpoint = "http://localhost:9000"
+	if _, err := newR2Client("bucket"); err != nil {
+		t.Errorf("unexpected error with endpoint: %v", err)
+	}
+}
+
+func TestCheckStdout(t *testing.T) {
+	for _, tc := range []struct {
+		cfg     appConfig
+		wantErr bool
+	}{
+		{appConfig{OutputJSON: true}, false},
+		{appConfig{OutputJSON: true, OutputJSONLines: "media.jsonl"}, false},
+		{appConfig{OutputJSON: true, OutputJSONLines: "-"}, true},
+		{appConfig{OutputJSON: true, ThumbsDiff: true}, true},
+		{appConfig{OutputJSONLines: "-", ThumbsDiff: true}, true},
+	} {
+		if err := checkStdout(tc.cfg); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v; want error: %t", tc.cfg, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCollectMedia(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "People")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// media are taken as saved, the thumbs file is not read back
+	all := map[string][]*thumbnailer.Media{}
+	opts := thumbnailer.Options{CompressThumbsFile: true, OnMedia: collectMedia(root, all)}
+	if _, err = thumbnailer.ProcessDirectory(dir, uploader.NewNoOp(), opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = thumbnailer.ProcessDirectory(root, uploader.NewNoOp(), opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err = writeMediaJSON(&b, all); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got map[string][]struct {
+		Path  string `json:"path"`
+		Width int    `json:"width"`
+	}
+	if err = json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("decoding output: %v", err)
+	}
+	if len(got) != 1 || len(got["People"]) != 1 || got["People"][0].Path != "a.png" || got["People"][0].Width != 40 {
+		t.Errorf("got %+v; want a.png of People only", got)
+	}
+}
+
+func TestRunOutputHashes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "media", "People"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(root, "media", "People", "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	output := filepath.Join(root, "github_output")
+	if err = os.WriteFile(output, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_OUTPUT", output)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) //nolint:errcheck
+
+	defer func(c appConfig, args []string) { cfg, os.Args = c, args }(cfg, os.Args)
+	cfg = appConfig{}
+	os.Args = []string{"thumbnailer", "--media-dir=media", "--skip-image-upload", "--output-hashes"}
+	if err = run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := thumbnailer.LoadThumbsFile(filepath.Join(root, "media", "People", ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	_, sum, ok := strings.Cut(media[0].ThumbPath, "?crc=")
+	if !ok {
+		t.Fatalf("got thumb %q without a checksum", media[0].ThumbPath)
+	}
+
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `updated_hashes={"People/a.yml":"` + sum + `"}`
+	if !strings.Contains(string(b), want+"\n") {
+		t.Errorf("got output:\n%s\nwant a line %s", b, want)
+	}
+}
@@ -0,0 +1,232 @@
+// Package blurhash encodes images into BlurHash strings and decodes them back
+// into small placeholder images, see https://blurha.sh.
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode returns BlurHash of the image
+// with given number of horizontal and vertical components (1-9 each).
+func Encode(xComponents, yComponents int, img image.Image) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("components must be between 1 and 9, got %dx%d", xComponents, yComponents)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("empty image")
+	}
+
+	// convert image to linear RGB once
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(int(r >> 8)),
+				sRGBToLinear(int(g >> 8)),
+				sRGBToLinear(int(b >> 8)),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		cosY := cosines(j, height)
+		for i := 0; i < xComponents; i++ {
+			cosX := cosines(i, width)
+
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := cosX[x] * cosY[y]
+					p := linear[y*width+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	sb.WriteString(encode83(
+		linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]),
+		4,
+	))
+
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+
+	return sb.String(), nil
+}
+
+// Decode returns an image of given size described by the BlurHash.
+// punch adjusts contrast, 1 is the default.
+func Decode(hash string, width, height int, punch float64) (image.Image, error) {
+	if len(hash) < 6 {
+		return nil, fmt.Errorf("blurhash %q is too short", hash)
+	}
+
+	sizeFlag, err := decode83(hash[:1])
+	if err != nil {
+		return nil, err
+	}
+	numY := sizeFlag/9 + 1
+	numX := sizeFlag%9 + 1
+
+	if len(hash) != 4+2*numX*numY {
+		return nil, fmt.Errorf("blurhash %q has invalid length", hash)
+	}
+
+	quantisedMax, err := decode83(hash[1:2])
+	if err != nil {
+		return nil, err
+	}
+	maximumValue := float64(quantisedMax+1) / 166 * punch
+
+	colors := make([][3]float64, numX*numY)
+	for i := range colors {
+		if i == 0 {
+			v, err := decode83(hash[2:6])
+			if err != nil {
+				return nil, err
+			}
+			colors[i] = [3]float64{
+				sRGBToLinear(v >> 16),
+				sRGBToLinear((v >> 8) & 255),
+				sRGBToLinear(v & 255),
+			}
+			continue
+		}
+
+		v, err := decode83(hash[4+i*2 : 6+i*2])
+		if err != nil {
+			return nil, err
+		}
+		colors[i] = [3]float64{
+			signPow(float64(v/(19*19)-9)/9, 2) * maximumValue,
+			signPow(float64((v/19)%19-9)/9, 2) * maximumValue,
+			signPow(float64(v%19-9)/9, 2) * maximumValue,
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c [3]float64
+			for j := 0; j < numY; j++ {
+				for i := 0; i < numX; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/float64(width)) *
+						math.Cos(math.Pi*float64(y*j)/float64(height))
+					f := colors[i+j*numX]
+					c[0] += f[0] * basis
+					c[1] += f[1] * basis
+					c[2] += f[2] * basis
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(linearToSRGB(c[0])),
+				G: uint8(linearToSRGB(c[1])),
+				B: uint8(linearToSRGB(c[2])),
+				A: 255,
+			})
+		}
+	}
+
+	return img, nil
+}
+
+// Components returns the number of components to use for an image of given size,
+// 4 along the longer side and 3 along the shorter one.
+func Components(width, height int) (x, y int) {
+	if width >= height {
+		return 4, 3
+	}
+	return 3, 4
+}
+
+func cosines(component, size int) []float64 {
+	result := make([]float64, size)
+	for i := range result {
+		result[i] = math.Cos(math.Pi * float64(component*i) / float64(size))
+	}
+	return result
+}
+
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func encode83(value, length int) string {
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = characters[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+func decode83(s string) (int, error) {
+	var value int
+	for _, c := range s {
+		digit := strings.IndexRune(characters, c)
+		if digit == -1 {
+			return 0, fmt.Errorf("invalid blurhash character %q", c)
+		}
+		value = value*83 + digit
+	}
+	return value, nil
+}
@@ -0,0 +1,47 @@
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{R: 200, G: 100, B: 50, A: 255}), image.Point{}, draw.Src)
+
+	hash, err := Encode(4, 3, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(hash) != 4+2*4*3 {
+		t.Fatalf("got hash %q of length %d; want %d", hash, len(hash), 4+2*4*3)
+	}
+
+	img, err := Decode(hash, 8, 6, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, g, b, _ := img.At(4, 3).RGBA()
+	if diff(r>>8, 200) > 2 || diff(g>>8, 100) > 2 || diff(b>>8, 50) > 2 {
+		t.Errorf("got color (%d, %d, %d); want (200, 100, 50)", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, hash := range []string{"", "LEHV6n", "LEHV6nWB2yk8pyo0adR*.7kCMdn!"} {
+		if _, err := Decode(hash, 4, 4, 1); err == nil {
+			t.Errorf("Decode(%q): expected error", hash)
+		}
+	}
+}
+
+func diff(a uint32, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
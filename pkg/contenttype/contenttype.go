@@ -0,0 +1,27 @@
+// Package contenttype maps file names to the MIME types media and thumbnails
+// are served with. Unlike mime.TypeByExtension, the result doesn't depend
+// on MIME tables of the system the thumbnailer runs on.
+package contenttype
+
+import "path/filepath"
+
+// ByName returns the MIME type of the file by its extension,
+// or "application/octet-stream" for unknown ones.
+func ByName(name string) string {
+	switch filepath.Ext(name) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".mp4":
+		return "video/mp4"
+	case ".pdf":
+		return "application/pdf"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,19 @@
+package contenttype
+
+import "testing"
+
+func TestByName(t *testing.T) {
+	tests := map[string]string{
+		"People/a.jpg":     "image/jpeg",
+		".webp":            "image/webp",
+		"thumbnails_0.png": "image/png",
+		"notes.txt":        "application/octet-stream",
+		"README":           "application/octet-stream",
+	}
+
+	for name, want := range tests {
+		if got := ByName(name); got != want {
+			t.Errorf("ByName(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
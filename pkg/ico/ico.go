@@ -0,0 +1,71 @@
+// Package ico implements an encoder of multi-resolution ICO files.
+//
+// Each image is stored as a PNG, which is supported by all browsers
+// and by Windows since Vista.
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+const (
+	headerSize = 6
+	entrySize  = 16
+
+	// maximum width and height of an image in ICO file
+	maxDimension = 256
+)
+
+// Encode writes the images to w as a single ICO file.
+func Encode(w io.Writer, images []image.Image) error {
+	if len(images) == 0 {
+		return fmt.Errorf("ico: no images")
+	}
+
+	data := make([][]byte, len(images))
+	for i, img := range images {
+		size := img.Bounds().Size()
+		if size.X < 1 || size.Y < 1 || size.X > maxDimension || size.Y > maxDimension {
+			return fmt.Errorf("ico: invalid image size %dx%d", size.X, size.Y)
+		}
+
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			return fmt.Errorf("ico: encoding image %d: %w", i, err)
+		}
+		data[i] = b.Bytes()
+	}
+
+	header := make([]byte, headerSize+entrySize*len(images))
+	binary.LittleEndian.PutUint16(header[2:], 1) // type: icon
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(images)))
+
+	offset := len(header)
+	for i, img := range images {
+		size := img.Bounds().Size()
+		entry := header[headerSize+entrySize*i:]
+		entry[0] = byte(size.X) // 256 is stored as 0
+		entry[1] = byte(size.Y)
+		binary.LittleEndian.PutUint16(entry[4:], 1)  // color planes
+		binary.LittleEndian.PutUint16(entry[6:], 32) // bits per pixel
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(data[i])))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(offset))
+		offset += len(data[i])
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
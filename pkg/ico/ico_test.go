@@ -0,0 +1,51 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	sizes := []int{16, 32, 256}
+	images := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		images[i] = image.NewNRGBA(image.Rect(0, 0, size, size))
+	}
+
+	var b bytes.Buffer
+	if err := Encode(&b, images); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := b.Bytes()
+
+	if n := int(binary.LittleEndian.Uint16(data[4:])); n != len(sizes) {
+		t.Fatalf("got %d images; want %d", n, len(sizes))
+	}
+
+	for i, size := range sizes {
+		entry := data[headerSize+entrySize*i:]
+		if got := int(entry[0]); got != size%256 {
+			t.Errorf("image %d: got width %d; want %d", i, got, size%256)
+		}
+
+		length := binary.LittleEndian.Uint32(entry[8:])
+		offset := binary.LittleEndian.Uint32(entry[12:])
+		img, err := png.Decode(bytes.NewReader(data[offset : offset+length]))
+		if err != nil {
+			t.Fatalf("image %d: decoding png: %v", i, err)
+		}
+		if img.Bounds().Dx() != size {
+			t.Errorf("image %d: got png width %d; want %d", i, img.Bounds().Dx(), size)
+		}
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	err := Encode(&bytes.Buffer{}, []image.Image{image.NewNRGBA(image.Rect(0, 0, 257, 16))})
+	if err == nil {
+		t.Error("expected error for image larger than 256px")
+	}
+}
@@ -0,0 +1,433 @@
+// Package jpegenc encodes images as baseline JPEG with configurable chroma subsampling.
+//
+// Go's image/jpeg always subsamples chroma 4:2:0, which blurs saturated colored edges
+// of small images. 4:2:0 images are still encoded by image/jpeg,
+// 4:4:4 ones by a simple encoder in this package, with standard Huffman tables.
+package jpegenc
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Subsampling is a chroma subsampling mode.
+type Subsampling string
+
+const (
+	// Subsampling420 stores chroma at half the resolution in both directions.
+	Subsampling420 Subsampling = "4:2:0"
+
+	// Subsampling444 stores chroma at full resolution.
+	Subsampling444 Subsampling = "4:4:4"
+)
+
+// Options are the encoding parameters.
+type Options struct {
+	// Quality ranges from 1 to 100 inclusive, higher is better.
+	Quality int
+
+	// Subsampling is 4:2:0 if empty.
+	Subsampling Subsampling
+}
+
+// Encode writes the image to w in JPEG format with the given options.
+// A nil options is equivalent to the default quality and 4:2:0 subsampling.
+func Encode(w io.Writer, img image.Image, o *Options) error {
+	quality := jpeg.DefaultQuality
+	subsampling := Subsampling420
+	if o != nil {
+		quality = o.Quality
+		if o.Subsampling != "" {
+			subsampling = o.Subsampling
+		}
+	}
+
+	switch subsampling {
+	case Subsampling420:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case Subsampling444:
+		return encode444(w, img, quality)
+	default:
+		return fmt.Errorf("jpegenc: unsupported subsampling %q", subsampling)
+	}
+}
+
+const blockSize = 64
+
+// unzig maps the index of a coefficient in zig-zag order to its natural index.
+var unzig = [blockSize]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// unscaledQuant are the quantization tables of section K.1 of the spec
+// for luminance and chrominance, in zig-zag order.
+var unscaledQuant = [2][blockSize]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table as stored in DHT segment:
+// counts of codes of each length from 1 to 16 bits and the values in code order.
+type huffmanSpec struct {
+	class  byte // 0 for DC, 1 for AC
+	id     byte // 0 for luminance, 1 for chrominance
+	counts [16]byte
+	values []byte
+}
+
+// standard Huffman tables of section K.3 of the spec:
+// luminance DC, luminance AC, chrominance DC and chrominance AC
+var huffmanSpecs = [4]huffmanSpec{
+	{
+		class:  0,
+		id:     0,
+		counts: [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		class:  1,
+		id:     0,
+		counts: [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		values: []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		class:  0,
+		id:     1,
+		counts: [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		class:  1,
+		id:     1,
+		counts: [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		values: []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// code is a Huffman code word, written most significant bit first.
+type code struct {
+	bits   uint32
+	length uint32
+}
+
+// codes returns code words of the table values.
+func (s huffmanSpec) codes() [256]code {
+	var result [256]code
+	var c uint32
+	k := 0
+	for i, n := range s.counts {
+		for j := 0; j < int(n); j++ {
+			result[s.values[k]] = code{bits: c, length: uint32(i + 1)}
+			c++
+			k++
+		}
+		c <<= 1
+	}
+	return result
+}
+
+// dctCos[u][x] is C(u)/2 * cos((2x+1)uπ/16), the forward DCT basis.
+var dctCos = func() (result [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			result[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return result
+}()
+
+type encoder struct {
+	w     *bufio.Writer
+	quant [2][blockSize]int
+	codes [4][256]code
+
+	// pending bits, aligned to the most significant bit
+	bits  uint32
+	nBits uint32
+}
+
+func encode444(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width >= 1<<16 || height >= 1<<16 {
+		return fmt.Errorf("jpegenc: invalid image size %dx%d", width, height)
+	}
+
+	quality = max(1, min(100, quality))
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+
+	e := &encoder{w: bufio.NewWriter(w)}
+	for i := range e.quant {
+		for k, q := range unscaledQuant[i] {
+			e.quant[i][k] = max(1, min(255, (q*scale+50)/100))
+		}
+	}
+	for i, spec := range huffmanSpecs {
+		e.codes[i] = spec.codes()
+	}
+
+	e.write([]byte{0xff, 0xd8}) // SOI
+	e.writeDQT()
+	e.writeSOF0(width, height)
+	e.writeDHT()
+	e.writeSOS()
+
+	// planes of Y, Cb and Cr of an 8x8 block, with edge pixels repeated
+	var (
+		planes [3][blockSize]float64
+		prevDC [3]int
+	)
+	for by := 0; by < height; by += 8 {
+		for bx := 0; bx < width; bx += 8 {
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					c := img.At(
+						bounds.Min.X+min(bx+x, width-1),
+						bounds.Min.Y+min(by+y, height-1),
+					)
+					r, g, b, _ := c.RGBA()
+					yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+					planes[0][y*8+x] = float64(yy) - 128
+					planes[1][y*8+x] = float64(cb) - 128
+					planes[2][y*8+x] = float64(cr) - 128
+				}
+			}
+
+			for i := range planes {
+				table := min(i, 1)
+				prevDC[i] = e.writeBlock(&planes[i], table, prevDC[i])
+			}
+		}
+	}
+
+	e.emit(0x7f, 7)             // pad the last byte with ones
+	e.write([]byte{0xff, 0xd9}) // EOI
+
+	return e.w.Flush()
+}
+
+// writeBlock transforms, quantizes and writes a block of level shifted samples,
+// using tables of luminance (0) or chrominance (1), and returns its DC coefficient.
+func (e *encoder) writeBlock(block *[blockSize]float64, table, prevDC int) int {
+	var tmp, coeffs [blockSize]float64
+
+	// rows, then columns
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 8; x++ {
+				sum += dctCos[u][x] * block[y*8+x]
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				sum += dctCos[v][y] * tmp[y*8+u]
+			}
+			coeffs[v*8+u] = sum
+		}
+	}
+
+	var zz [blockSize]int
+	for k := range zz {
+		zz[k] = int(math.Round(coeffs[unzig[k]] / float64(e.quant[table][k])))
+	}
+
+	dc, ac := &e.codes[table*2], &e.codes[table*2+1]
+
+	e.emitValue(dc, 0, zz[0]-prevDC)
+
+	run := 0
+	for k := 1; k < blockSize; k++ {
+		if zz[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitCode(ac[0xf0]) // 16 zeros
+			run -= 16
+		}
+		e.emitValue(ac, run, zz[k])
+		run = 0
+	}
+	if run > 0 {
+		e.emitCode(ac[0x00]) // end of block
+	}
+
+	return zz[0]
+}
+
+// emitValue writes Huffman code of the run length and the value size,
+// followed by the value bits.
+func (e *encoder) emitValue(codes *[256]code, run, value int) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	size := uint32(bits.Len32(uint32(a)))
+
+	e.emitCode(codes[run<<4|int(size)])
+	if size > 0 {
+		e.emit(uint32(b)&(1<<size-1), size)
+	}
+}
+
+func (e *encoder) emitCode(c code) {
+	e.emit(c.bits, c.length)
+}
+
+// emit writes the n least significant bits of value, stuffing 0xff bytes with zeros.
+func (e *encoder) emit(value, n uint32) {
+	e.bits |= value << (32 - e.nBits - n)
+	e.nBits += n
+	for e.nBits >= 8 {
+		b := byte(e.bits >> 24)
+		e.w.WriteByte(b) //nolint:errcheck // checked on Flush
+		if b == 0xff {
+			e.w.WriteByte(0) //nolint:errcheck // checked on Flush
+		}
+		e.bits <<= 8
+		e.nBits -= 8
+	}
+}
+
+func (e *encoder) write(b []byte) {
+	e.w.Write(b) //nolint:errcheck // checked on Flush
+}
+
+func (e *encoder) writeMarker(marker byte, length int) {
+	e.write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+}
+
+func (e *encoder) writeDQT() {
+	e.writeMarker(0xdb, 2+2*(1+blockSize))
+	for i, table := range e.quant {
+		e.write([]byte{byte(i)})
+		for _, q := range table {
+			e.write([]byte{byte(q)})
+		}
+	}
+}
+
+func (e *encoder) writeSOF0(width, height int) {
+	e.writeMarker(0xc0, 2+6+3*3)
+	e.write([]byte{
+		8, // bits per sample
+		byte(height >> 8), byte(height),
+		byte(width >> 8), byte(width),
+		3,          // components
+		1, 0x11, 0, // Y, no subsampling, luminance table
+		2, 0x11, 1, // Cb, no subsampling, chrominance table
+		3, 0x11, 1, // Cr, no subsampling, chrominance table
+	})
+}
+
+func (e *encoder) writeDHT() {
+	length := 2
+	for _, spec := range huffmanSpecs {
+		length += 1 + 16 + len(spec.values)
+	}
+
+	e.writeMarker(0xc4, length)
+	for _, spec := range huffmanSpecs {
+		e.write([]byte{spec.class<<4 | spec.id})
+		e.write(spec.counts[:])
+		e.write(spec.values)
+	}
+}
+
+func (e *encoder) writeSOS() {
+	e.writeMarker(0xda, 2+1+3*2+3)
+	e.write([]byte{
+		3,       // components
+		1, 0x00, // Y, luminance DC and AC tables
+		2, 0x11, // Cb, chrominance DC and AC tables
+		3, 0x11, // Cr, chrominance DC and AC tables
+		0, 63, 0, // spectral selection and successive approximation of baseline
+	})
+}
@@ -0,0 +1,86 @@
+package jpegenc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// stripes returns an image with one pixel wide red and blue stripes,
+// which lose their colors with subsampled chroma.
+func stripes(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x%2 == 1 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// maxError returns the maximum difference of red channel between the images.
+func maxError(a, b image.Image) int {
+	var result int
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ra, _, _, _ := a.At(x, y).RGBA()
+			rb, _, _, _ := b.At(x, y).RGBA()
+			d := int(ra>>8) - int(rb>>8)
+			result = max(result, d, -d)
+		}
+	}
+	return result
+}
+
+func TestEncode(t *testing.T) {
+	// size not divisible by 8 to check edge blocks
+	src := stripes(21, 13)
+
+	errors := map[Subsampling]int{}
+	for _, subsampling := range []Subsampling{Subsampling420, Subsampling444} {
+		var b bytes.Buffer
+		if err := Encode(&b, src, &Options{Quality: 95, Subsampling: subsampling}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", subsampling, err)
+		}
+
+		img, err := jpeg.Decode(&b)
+		if err != nil {
+			t.Fatalf("%s: decoding: %v", subsampling, err)
+		}
+		if img.Bounds() != src.Bounds() {
+			t.Fatalf("%s: got bounds %v; want %v", subsampling, img.Bounds(), src.Bounds())
+		}
+
+		if _, ok := img.(*image.YCbCr); !ok {
+			t.Fatalf("%s: got %T; want *image.YCbCr", subsampling, img)
+		}
+		if want := map[Subsampling]image.YCbCrSubsampleRatio{
+			Subsampling420: image.YCbCrSubsampleRatio420,
+			Subsampling444: image.YCbCrSubsampleRatio444,
+		}[subsampling]; img.(*image.YCbCr).SubsampleRatio != want {
+			t.Errorf("%s: got ratio %v; want %v", subsampling, img.(*image.YCbCr).SubsampleRatio, want)
+		}
+
+		errors[subsampling] = maxError(src, img)
+	}
+
+	if errors[Subsampling444] > 16 {
+		t.Errorf("got 4:4:4 error %d; want at most 16", errors[Subsampling444])
+	}
+	if errors[Subsampling444] >= errors[Subsampling420] {
+		t.Errorf("got 4:4:4 error %d; want less than 4:2:0 error %d", errors[Subsampling444], errors[Subsampling420])
+	}
+}
+
+func TestEncodeUnsupportedSubsampling(t *testing.T) {
+	if err := Encode(&bytes.Buffer{}, stripes(8, 8), &Options{Subsampling: "4:1:1"}); err == nil {
+		t.Error("expected error for unsupported subsampling")
+	}
+}
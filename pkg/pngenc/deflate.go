@@ -0,0 +1,143 @@
+package pngenc
+
+import (
+	"encoding/binary"
+	"hash/adler32"
+	"math/bits"
+	"sort"
+)
+
+const (
+	windowSize = 1 << 15
+	minMatch   = 3
+	maxMatch   = 258
+	hashBits   = 15
+	maxChain   = 64 // candidates tried for each match
+)
+
+// Base values and numbers of extra bits of length and distance codes (RFC 1951, 3.2.5).
+var (
+	lengthBase  = []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = []uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = []int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = []uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// compress returns data as a zlib stream (RFC 1950) of a single deflate block
+// with fixed Huffman codes and greedy LZ77 matches. Unlike compress/zlib,
+// whose output may change between Go versions, it depends on nothing but the data.
+func compress(data []byte) []byte {
+	w := bitWriter{out: []byte{0x78, 0x01}} // 32K window, fastest compression level hint
+	w.writeBits(1, 1)                       // final block
+	w.writeBits(1, 2)                       // fixed Huffman codes
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, windowSize)
+	insert := func(i int) {
+		h := hash(data[i:])
+		prev[i&(windowSize-1)] = head[h]
+		head[h] = int32(i)
+	}
+
+	for i := 0; i < len(data); {
+		var length, dist int
+		if i+minMatch <= len(data) {
+			limit := min(maxMatch, len(data)-i)
+			// candidates may be stale after the window wrapped, they are only a hint
+			for c, n := head[hash(data[i:])], 0; c >= 0 && n < maxChain; c, n = prev[c&(windowSize-1)], n+1 {
+				d := i - int(c)
+				if d <= 0 || d > windowSize {
+					break
+				}
+				l := 0
+				for l < limit && data[int(c)+l] == data[i+l] {
+					l++
+				}
+				if l > length {
+					length, dist = l, d
+					if l == limit {
+						break
+					}
+				}
+			}
+			insert(i)
+		}
+
+		if length < minMatch {
+			w.writeLiteral(int(data[i]))
+			i++
+			continue
+		}
+
+		w.writeMatch(length, dist)
+		for j := i + 1; j < i+length && j+minMatch <= len(data); j++ {
+			insert(j)
+		}
+		i += length
+	}
+	w.writeLiteral(256) // end of block
+	w.flush()
+
+	return binary.BigEndian.AppendUint32(w.out, adler32.Checksum(data))
+}
+
+// hash returns the hash of the first minMatch bytes of b.
+func hash(b []byte) uint32 {
+	return (uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])) * 2654435761 >> (32 - hashBits)
+}
+
+// bitWriter packs bits into bytes starting from the least significant bit.
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint
+}
+
+func (w *bitWriter) writeBits(v int, n uint) {
+	w.bits |= uint64(v) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// writeCode writes a Huffman code, which starts from its most significant bit.
+func (w *bitWriter) writeCode(code int, n uint) {
+	w.writeBits(int(bits.Reverse16(uint16(code))>>(16-n)), n)
+}
+
+// writeLiteral writes a literal/length symbol with its fixed code.
+func (w *bitWriter) writeLiteral(sym int) {
+	switch {
+	case sym < 144:
+		w.writeCode(0x30+sym, 8)
+	case sym < 256:
+		w.writeCode(0x190+sym-144, 9)
+	case sym < 280:
+		w.writeCode(sym-256, 7)
+	default:
+		w.writeCode(0xc0+sym-280, 8)
+	}
+}
+
+func (w *bitWriter) writeMatch(length, dist int) {
+	l := sort.SearchInts(lengthBase, length+1) - 1
+	w.writeLiteral(257 + l)
+	w.writeBits(length-lengthBase[l], lengthExtra[l])
+
+	d := sort.SearchInts(distBase, dist+1) - 1
+	w.writeCode(d, 5)
+	w.writeBits(dist-distBase[d], distExtra[d])
+}
+
+func (w *bitWriter) flush() {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits, w.n = 0, 0
+	}
+}
@@ -0,0 +1,189 @@
+// Package pngenc encodes images as PNG with fixed encoder settings,
+// so that the same image is always encoded to the same bytes.
+//
+// Go's image/png picks a filter for each row by a heuristic and may change it,
+// along with the compression level, between Go versions; so may compress/zlib.
+// This encoder always writes non-premultiplied 8-bit RGBA (or RGB for opaque images),
+// Paeth-filtered rows and a single IDAT chunk, without ancillary chunks such as tIME.
+// It is compressed by a deflate implementation of its own, see compress.
+package pngenc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+const (
+	colorTypeRGB  = 2
+	colorTypeRGBA = 6
+
+	filterPaeth = 4
+)
+
+var signature = []byte("\x89PNG\r\n\x1a\n")
+
+// Encode writes the image to w in PNG format.
+func Encode(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	opaque := isOpaque(img)
+
+	colorType, bpp := byte(colorTypeRGBA), 4
+	if opaque {
+		colorType, bpp = colorTypeRGB, 3
+	}
+
+	stride := b.Dx() * bpp
+	prev := make([]byte, stride)
+	cur := make([]byte, stride)
+	raw := make([]byte, 0, (stride+1)*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		readRow(img, y, bpp, cur)
+
+		raw = append(raw, filterPaeth)
+		for i := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			raw = append(raw, cur[i]-paeth(left, prev[i], upLeft))
+		}
+
+		prev, cur = cur, prev
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(signature); err != nil {
+		return err
+	}
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(b.Dy()))
+	header[8] = 8 // bit depth
+	header[9] = colorType
+	// compression, filter and interlace methods are 0
+
+	for _, chunk := range []struct {
+		name string
+		data []byte
+	}{
+		{"IHDR", header},
+		{"IDAT", compress(raw)},
+		{"IEND", nil},
+	} {
+		if err := writeChunk(bw, chunk.name, chunk.data); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// readRow puts non-premultiplied pixels of row y of the image into row,
+// with bpp bytes per pixel, without alpha if bpp is 3.
+// Pixels of *image.NRGBA and *image.RGBA images are read without converting each color.
+func readRow(img image.Image, y, bpp int, row []byte) {
+	b := img.Bounds()
+	switch img := img.(type) {
+	case *image.NRGBA:
+		pix := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x, i := 0, 0; i < len(row); x, i = x+4, i+bpp {
+			copy(row[i:i+bpp], pix[x:x+bpp])
+		}
+	case *image.RGBA:
+		pix := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x, i := 0, 0; i < len(row); x, i = x+4, i+bpp {
+			c := unpremultiply(pix[x], pix[x+1], pix[x+2], pix[x+3])
+			row[i], row[i+1], row[i+2] = c.R, c.G, c.B
+			if bpp == 4 {
+				row[i+3] = c.A
+			}
+		}
+	default:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			i := (x - b.Min.X) * bpp
+			row[i], row[i+1], row[i+2] = c.R, c.G, c.B
+			if bpp == 4 {
+				row[i+3] = c.A
+			}
+		}
+	}
+}
+
+// unpremultiply converts a premultiplied color the same way as color.NRGBAModel.
+func unpremultiply(r, g, b, a uint8) color.NRGBA {
+	switch a {
+	case 0xff:
+		return color.NRGBA{R: r, G: g, B: b, A: a}
+	case 0:
+		return color.NRGBA{}
+	}
+	a16 := uint32(a) * 0x101
+	scale := func(v uint8) uint8 {
+		return uint8((uint32(v) * 0x101 * 0xffff / a16) >> 8)
+	}
+	return color.NRGBA{R: scale(r), G: scale(g), B: scale(b), A: a}
+}
+
+// writeChunk writes a PNG chunk with its length and checksum.
+func writeChunk(w io.Writer, name string, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	hash := crc32.NewIEEE()
+	hash.Write([]byte(name))
+	hash.Write(data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], hash.Sum32())
+
+	for _, b := range [][]byte{length[:], []byte(name), data, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paeth returns the Paeth predictor of a pixel byte
+// from the ones to the left, above and above left of it.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// isOpaque reports whether all pixels of the image are fully opaque.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package pngenc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+// gradient returns an image with varying colors and, unless opaque, alpha.
+func gradient(width, height int, opaque bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := uint8(255)
+			if !opaque {
+				a = uint8(x * 255 / width)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: a})
+		}
+	}
+	return img
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, opaque := range []bool{true, false} {
+		// large enough for matches beyond the window of the compressor
+		img := gradient(300, 200, opaque)
+
+		var b bytes.Buffer
+		if err := Encode(&b, img); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		decoded, err := png.Decode(&b)
+		if err != nil {
+			t.Fatalf("opaque %t: decoding: %v", opaque, err)
+		}
+		if decoded.Bounds() != img.Bounds() {
+			t.Fatalf("opaque %t: got bounds %v; want %v", opaque, decoded.Bounds(), img.Bounds())
+		}
+		for y := 0; y < 200; y++ {
+			for x := 0; x < 300; x++ {
+				if got, want := color.NRGBAModel.Convert(decoded.At(x, y)), img.At(x, y); got != want {
+					t.Fatalf("opaque %t: pixel %d,%d is %v; want %v", opaque, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestEncodeGolden guards against any change of the output, which would change
+// checksums of all sprites encoded by it.
+func TestEncodeGolden(t *testing.T) {
+	for _, tc := range []struct {
+		opaque bool
+		want   string
+	}{
+		{true, "1633a2641ca770b325e9a308406c897f5c46404426e5f59692fb23236516c02f"},
+		{false, "ade9613130f00968e7d92de44f27416016d6be71d7a9a27ad213b7e34241930c"},
+	} {
+		var b bytes.Buffer
+		if err := Encode(&b, gradient(300, 200, tc.opaque)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := fmt.Sprintf("%x", sha256.Sum256(b.Bytes())); got != tc.want {
+			t.Errorf("opaque %t: got sha256 %s; want %s", tc.opaque, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeRGBA(t *testing.T) {
+	src := gradient(70, 40, false)
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+
+	// an image.Image that is neither *image.RGBA nor *image.NRGBA
+	var want, got bytes.Buffer
+	if err := Encode(&want, struct{ image.Image }{img}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Encode(&got, img); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("*image.RGBA is encoded differently than other images")
+	}
+}
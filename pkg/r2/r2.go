@@ -3,19 +3,33 @@ package r2
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/alsosee/thumbnailer/pkg/contenttype"
 )
 
 // R2 is a struct describing r2 cloudflare storage bucket.
 type R2 struct {
-	Bucket string
-	client *s3.Client
+	Bucket     string
+	client     *s3.Client
+	userAgent  string
+	httpClient s3.HTTPClient // nil for the default one
+	retryer    aws.Retryer   // nil for the default one
 }
 
 // NewR2 creates new R2 struct.
@@ -25,22 +39,74 @@ func NewR2(
 	accessKeySecret string,
 	bucket string,
 ) (*R2, error) {
-	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+	return newR2(
+		fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID),
+		accessKeyID,
+		accessKeySecret,
+		bucket,
+		"auto", // R2 ignores region, but requests can't be signed without it
+		false,
+	)
+}
+
+// NewWithEndpoint creates new R2 struct for another S3-compatible storage,
+// such as a local mock, using path-style addressing.
+func NewWithEndpoint(
+	endpoint string,
+	accessKeyID string,
+	accessKeySecret string,
+	bucket string,
+) (*R2, error) {
+	return newR2(endpoint, accessKeyID, accessKeySecret, bucket, "", true)
+}
+
+// NewWithRegion is like NewWithEndpoint, but signs requests for the given region,
+// for providers that validate it, such as Wasabi.
+func NewWithRegion(
+	endpoint string,
+	region string,
+	accessKeyID string,
+	accessKeySecret string,
+	bucket string,
+) (*R2, error) {
+	return newR2(endpoint, accessKeyID, accessKeySecret, bucket, region, true)
+}
+
+func newR2(
+	endpoint string,
+	accessKeyID string,
+	accessKeySecret string,
+	bucket string,
+	region string,
+	pathStyle bool,
+) (*R2, error) {
+	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, clientRegion string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
-			URL: fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID),
+			URL: endpoint,
+			// without it, requests are signed for no region at all
+			SigningRegion: clientRegion,
 		}, nil
 	})
 
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
+	options := []func(*config.LoadOptions) error{
 		config.WithEndpointResolverWithOptions(r2Resolver),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, accessKeySecret, "")),
-	)
+	}
+	if region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
 	if err != nil {
 		return nil, fmt.Errorf("creating config: %w", err)
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+		if o.Region == "" {
+			o.Region = "auto" // requests can't be signed without a region
+		}
+	})
 
 	return &R2{
 		Bucket: bucket,
@@ -48,14 +114,95 @@ func NewR2(
 	}, nil
 }
 
+// WithUserAgent makes requests with the User-Agent header instead of the one of AWS SDK,
+// e.g. to tell them apart from requests of other bucket consumers in logs.
+func (r2 *R2) WithUserAgent(userAgent string) *R2 {
+	r2.userAgent = userAgent
+	return r2
+}
+
+// WithTimeout makes each attempt of a request fail after d, so that a stalled connection
+// is retried by the client instead of failing the whole request or blocking it.
+func (r2 *R2) WithTimeout(d time.Duration) *R2 {
+	r2.httpClient = awshttp.NewBuildableClient().WithTimeout(d)
+	return r2
+}
+
+// WithoutThrottleRetries makes throttled requests fail right away instead of being
+// retried by the client, for callers that retry them on their own, e.g. after
+// waiting for a rate limiter, so that they are not retried by both.
+// Other errors are still retried.
+func (r2 *R2) WithoutThrottleRetries() *R2 {
+	r2.retryer = retry.NewStandard(func(o *retry.StandardOptions) {
+		// the first check with a definite answer wins
+		o.Retryables = append([]retry.IsErrorRetryable{notThrottled{}}, o.Retryables...)
+	})
+	return r2
+}
+
+// WithoutRetries makes failed requests fail right away instead of being retried by the client.
+func (r2 *R2) WithoutRetries() *R2 {
+	r2.retryer = aws.NopRetryer{}
+	return r2
+}
+
+// notThrottled marks throttling errors as not retryable.
+type notThrottled struct{}
+
+func (notThrottled) IsErrorRetryable(err error) aws.Ternary {
+	if IsThrottled(err) {
+		return aws.FalseTernary
+	}
+	return aws.UnknownTernary
+}
+
+// options applies per-request options to the client options.
+func (r2 *R2) options(o *s3.Options) {
+	if r2.userAgent != "" {
+		o.APIOptions = append(o.APIOptions, smithyhttp.SetHeaderValue("User-Agent", r2.userAgent))
+	}
+	if r2.httpClient != nil {
+		o.HTTPClient = r2.httpClient
+	}
+	if r2.retryer != nil {
+		o.Retryer = r2.retryer
+	}
+}
+
 // Upload uploads given body to given key.
 func (r2 *R2) Upload(ctx context.Context, key string, body []byte) error {
+	return r2.put(ctx, key, bytes.NewReader(body), int64(len(body)), nil)
+}
+
+// UploadReader is like Upload, but streams the body of given size,
+// e.g. from a file, instead of holding it in memory.
+// The body is read again from its start if the request is retried.
+func (r2 *R2) UploadReader(ctx context.Context, key string, body io.ReadSeeker, size int64) error {
+	return r2.put(ctx, key, body, size, nil)
+}
+
+// UploadAttachment uploads given body to given key, to be served
+// with "Content-Disposition: attachment" header, so that browsers
+// download it under its base name.
+func (r2 *R2) UploadAttachment(ctx context.Context, key string, body []byte) error {
+	return r2.UploadAttachmentReader(ctx, key, bytes.NewReader(body), int64(len(body)))
+}
+
+// UploadAttachmentReader is like UploadAttachment, but streams the body like UploadReader.
+func (r2 *R2) UploadAttachmentReader(ctx context.Context, key string, body io.ReadSeeker, size int64) error {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)})
+	return r2.put(ctx, key, body, size, aws.String(disposition))
+}
+
+func (r2 *R2) put(ctx context.Context, key string, body io.ReadSeeker, size int64, disposition *string) error {
 	_, err := r2.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(r2.Bucket),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(body),
-		ContentType: aws.String(getContentType(key)),
-	})
+		Bucket:             aws.String(r2.Bucket),
+		Key:                aws.String(key),
+		Body:               body,
+		ContentLength:      size,
+		ContentType:        aws.String(contenttype.ByName(key)),
+		ContentDisposition: disposition,
+	}, r2.options)
 	if err != nil {
 		return fmt.Errorf("uploading object: %w", err)
 	}
@@ -63,20 +210,33 @@ func (r2 *R2) Upload(ctx context.Context, key string, body []byte) error {
 	return nil
 }
 
-func getContentType(name string) string {
-	ext := filepath.Ext(name)
-	switch {
-	case ext == ".jpg" || ext == ".jpeg":
-		return "image/jpeg"
-	case ext == ".png":
-		return "image/png"
-	case ext == ".gif":
-		return "image/gif"
-	case ext == ".webp":
-		return "image/webp"
-	case ext == ".mp4":
-		return "video/mp4"
-	default:
-		return "application/octet-stream"
+// Delete deletes object with given key.
+func (r2 *R2) Delete(ctx context.Context, key string) error {
+	_, err := r2.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r2.Bucket),
+		Key:    aws.String(key),
+	}, r2.options)
+	if err != nil {
+		return fmt.Errorf("deleting object: %w", err)
 	}
+
+	return nil
+}
+
+// IsThrottled reports whether the error is caused by exceeding R2 request rate limits.
+func IsThrottled(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "TooManyRequests":
+			return true
+		}
+	}
+
+	return false
 }
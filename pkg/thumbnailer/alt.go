@@ -0,0 +1,56 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// altTextExt is the extension of alt text sidecar files, e.g. photo.jpg.txt
+const altTextExt = ".txt"
+
+// readAltTexts sets Alt of local media from their sidecar files.
+// Media without a sidecar get no alt text. If opts.UploadAltText is set,
+// sidecars that changed or were not uploaded yet are uploaded next to the media.
+func readAltTexts(up Uploader, media []*Media, dir string, opts Options) error {
+	for _, file := range media {
+		if isURL(file.Path) {
+			continue
+		}
+		if _, _, ok := splitArchivePath(file.Path); ok {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Path+altTextExt)
+		content, err := opts.readFile(path)
+		if os.IsNotExist(err) {
+			file.Alt = ""
+			file.AltUploaded = false
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading alt text: %w", err)
+		}
+
+		alt := strings.TrimSpace(string(content))
+		if alt != file.Alt {
+			file.Alt = alt
+			file.AltUploaded = false
+		}
+
+		if !opts.UploadAltText {
+			file.AltUploaded = false
+			continue
+		}
+		if file.AltUploaded {
+			continue
+		}
+		if err = up.Upload(path, content); err != nil {
+			return fmt.Errorf("uploading alt text: %w", &UploadError{Path: path, Err: err})
+		}
+		file.AltUploaded = true
+	}
+
+	return nil
+}
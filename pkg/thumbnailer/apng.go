@@ -0,0 +1,30 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// isAnimatedPNG reports whether the content is an APNG,
+// that is a PNG with an animation control chunk before the image data.
+// Go's image/png decodes only the first frame of such files.
+func isAnimatedPNG(content []byte) bool {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return false
+	}
+
+	for pos := len(pngSignature); pos+8 <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[pos:]))
+		switch string(content[pos+4 : pos+8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		pos += 12 + length // length, type, data and CRC
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package thumbnailer
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Images inside zip archives are referenced as "<archive>.zip/<entry>",
+// so that they are processed with the directory the archive is in
+// and uploaded under the same keys.
+const archiveExt = ".zip"
+
+// splitArchivePath returns the archive file name and the entry name of p;
+// ok is false if p doesn't reference an archive entry.
+func splitArchivePath(p string) (archive, entry string, ok bool) {
+	i := strings.Index(p, archiveExt+"/")
+	if i < 0 {
+		return "", "", false
+	}
+	return p[:i+len(archiveExt)], p[i+len(archiveExt)+1:], true
+}
+
+// scanArchives returns supported images in zip archives in dir,
+// skipping entries that ScanDirectory would skip as files.
+func scanArchives(dir string, opts Options) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory %q: %w", dir, err)
+	}
+
+	var result []string
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != archiveExt {
+			continue
+		}
+
+		r, err := zip.OpenReader(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("opening archive %q: %w", file.Name(), err)
+		}
+
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() || !isSupported(path.Ext(f.Name)) {
+				continue
+			}
+
+			// entry names become upload keys and local paths, they must stay inside the archive
+			if !isLocalEntry(f.Name) {
+				opts.logger().Warnf("Skipping %q in %s: path outside of the archive", f.Name, file.Name())
+				continue
+			}
+
+			// the same as for files in the directory, see ScanDirectory
+			name := path.Base(f.Name)
+			if strings.HasPrefix(name, ".") && !opts.IncludeHidden || IsGenerated(name, opts) {
+				continue
+			}
+			if f.UncompressedSize64 == 0 {
+				opts.logger().Warnf("Skipping %q in %s: empty file", f.Name, file.Name())
+				continue
+			}
+			result = append(result, fixUnicode(file.Name())+"/"+fixUnicode(f.Name))
+		}
+
+		r.Close()
+	}
+
+	return result, nil
+}
+
+// isLocalEntry reports whether the archive entry name is relative
+// and doesn't reach outside of the archive, e.g. with "../".
+func isLocalEntry(name string) bool {
+	if strings.Contains(name, `\`) || path.IsAbs(name) || filepath.IsAbs(name) {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// readArchiveEntry returns the content of the entry in the archive in dir.
+// Entries are read up to maxRemoteSize, so that a zip bomb doesn't exhaust memory.
+func readArchiveEntry(dir, archive, entry string) ([]byte, error) {
+	r, err := zip.OpenReader(filepath.Join(dir, archive))
+	if err != nil {
+		return nil, fmt.Errorf("opening archive %q: %w", archive, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if fixUnicode(f.Name) != entry {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("opening %q in %q: %w", entry, archive, err)
+		}
+		defer rc.Close()
+
+		content, err := io.ReadAll(io.LimitReader(rc, maxRemoteSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("reading %q in %q: %w", entry, archive, err)
+		}
+		if int64(len(content)) > maxRemoteSize {
+			return nil, fmt.Errorf("reading %q in %q: larger than %d bytes", entry, archive, maxRemoteSize)
+		}
+		return content, nil
+	}
+
+	return nil, fmt.Errorf("%q not found in %q: %w", entry, archive, os.ErrNotExist)
+}
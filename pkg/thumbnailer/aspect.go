@@ -0,0 +1,55 @@
+package thumbnailer
+
+import "fmt"
+
+// matchesAspectRatio reports whether width/height is within
+// MinAspectRatio and MaxAspectRatio, where 0 means no limit.
+func (o Options) matchesAspectRatio(width, height int) bool {
+	if height == 0 {
+		return true
+	}
+	ratio := float64(width) / float64(height)
+	return (o.MinAspectRatio == 0 || ratio >= o.MinAspectRatio) &&
+		(o.MaxAspectRatio == 0 || ratio <= o.MaxAspectRatio)
+}
+
+// filterAspectRatio returns files with aspect ratio within opts limits.
+// Dimensions of files already in media are reused, others are read from file headers.
+func filterAspectRatio(files []string, media []*Media, dir string, opts Options) ([]string, error) {
+	if opts.MinAspectRatio == 0 && opts.MaxAspectRatio == 0 {
+		return files, nil
+	}
+
+	known := make(map[string]*Media, len(media))
+	for _, file := range media {
+		if file.Width != 0 && file.Height != 0 {
+			known[file.Path] = file
+		}
+	}
+
+	var result []string
+	for _, file := range files {
+		var width, height int
+		if m, ok := known[file]; ok {
+			width, height = m.Width, m.Height
+		} else {
+			config, err := opts.readImageConfig(dir, file)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", file, err)
+			}
+			width, height = config.Width, config.Height
+		}
+
+		if !opts.matchesAspectRatio(width, height) {
+			opts.debugf("%s: excluding %s, %dx%d is out of aspect ratio range", dir, file, width, height)
+			continue
+		}
+		result = append(result, file)
+	}
+
+	if excluded := len(files) - len(result); excluded > 0 {
+		opts.logger().Infof("Excluded %d file(s) by aspect ratio in %s", excluded, dir)
+	}
+
+	return result, nil
+}
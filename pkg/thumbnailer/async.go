@@ -0,0 +1,81 @@
+package thumbnailer
+
+import "sync"
+
+const asyncQueueSize = 16
+
+type uploadJob struct {
+	key    string
+	body   []byte
+	path   string // file to stream instead of body
+	delete bool
+}
+
+// asyncUploader hands uploads off to a background goroutine,
+// so that network-bound uploading overlaps with CPU-bound thumbnail generation.
+// Jobs are processed in order; after the first failure the rest are skipped.
+type asyncUploader struct {
+	up   Uploader
+	jobs chan uploadJob
+	done chan error
+
+	once sync.Once
+	err  error
+}
+
+func newAsyncUploader(up Uploader) *asyncUploader {
+	a := &asyncUploader{
+		up:   up,
+		jobs: make(chan uploadJob, asyncQueueSize),
+		done: make(chan error, 1),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncUploader) run() {
+	var err error
+	for job := range a.jobs {
+		if err != nil {
+			continue // drain the queue
+		}
+
+		switch {
+		case job.delete:
+			err = a.up.Delete(job.key)
+		case job.path != "":
+			err = uploadFile(a.up, job.key, job.path)
+		default:
+			err = a.up.Upload(job.key, job.body)
+		}
+		if err != nil {
+			err = &UploadError{Path: job.key, Err: err}
+		}
+	}
+	a.done <- err
+}
+
+func (a *asyncUploader) Upload(key string, body []byte) error {
+	a.jobs <- uploadJob{key: key, body: body}
+	return nil
+}
+
+func (a *asyncUploader) UploadFile(key, path string) error {
+	a.jobs <- uploadJob{key: key, path: path}
+	return nil
+}
+
+func (a *asyncUploader) Delete(key string) error {
+	a.jobs <- uploadJob{key: key, delete: true}
+	return nil
+}
+
+// Wait waits for queued jobs to finish and returns the first error.
+// It is safe to call Wait multiple times.
+func (a *asyncUploader) Wait() error {
+	a.once.Do(func() {
+		close(a.jobs)
+		a.err = <-a.done
+	})
+	return a.err
+}
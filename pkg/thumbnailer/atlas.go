@@ -0,0 +1,262 @@
+package thumbnailer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// atlasFile lists tiles of global atlases, in the media directory
+	atlasFile = ".atlas.yml"
+
+	// atlasMaxTiles limits the size of a single atlas to 50 rows of tiles
+	atlasMaxTiles = maxPerRow * 50
+)
+
+// AtlasTile describes a thumbnail of a media in a global atlas.
+type AtlasTile struct {
+	Path        string `yaml:"path" json:"path"`   // media path relative to the media directory
+	Atlas       string `yaml:"atlas" json:"atlas"` // atlas file name in the media directory
+	XOffset     int    `yaml:"thumb_x,omitempty" json:"thumb_x,omitempty"`
+	YOffset     int    `yaml:"thumb_y,omitempty" json:"thumb_y,omitempty"`
+	Width       int    `yaml:"thumb_width" json:"thumb_width"`
+	Height      int    `yaml:"thumb_height" json:"thumb_height"`
+	TotalWidth  int    `yaml:"thumb_total_width" json:"thumb_total_width"`
+	TotalHeight int    `yaml:"thumb_total_height" json:"thumb_total_height"`
+
+	// checksum of the directory sprite of the media when the atlas was written,
+	// atlases are only rewritten if a sprite of one of their media changed
+	SpriteChecksum string `yaml:"sprite_crc,omitempty" json:"sprite_crc,omitempty"`
+}
+
+// atlasEntry is a thumbnail to put into an atlas.
+type atlasEntry struct {
+	dir   string
+	media *Media
+	sum   string // checksum of the sprite of the media
+}
+
+// GenerateAtlases composes thumbnails of all media in dirs into atlases
+// in the root media directory, one set per sprite format, and lists
+// the position of each media in them in root/.atlas.yml.
+// Tiles are resized from the originals of media that have thumbnails in sprites
+// generated by ProcessDirectory, so it must be called after all dirs are processed.
+// Atlases whose media and their sprites didn't change are kept as they are.
+// Directories with a .no-upload file are skipped.
+func GenerateAtlases(up Uploader, root string, dirs []string, opts Options) error {
+	// tiles are copied without labels of contact sheets
+	opts.ContactSheet = false
+
+	byFormat := map[string][]atlasEntry{}
+	for _, dir := range dirs {
+		// atlases are uploaded, keep thumbnails of local-only directories out of them
+		if isLocalOnly(dir) {
+			continue
+		}
+
+		media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+		if err != nil {
+			if errors.Is(err, ErrThumbYamlNotFound) {
+				continue
+			}
+			return err
+		}
+
+		for _, file := range media {
+			if file.ThumbPath == "" {
+				continue
+			}
+			sum, err := spriteSum(dir, file.ThumbPath, opts)
+			if err != nil {
+				return err
+			}
+			byFormat[file.ThumbFormat] = append(byFormat[file.ThumbFormat], atlasEntry{dir: dir, media: file, sum: sum})
+		}
+	}
+
+	previous, err := loadAtlasFile(filepath.Join(root, atlasFile))
+	if err != nil {
+		return err
+	}
+
+	formats := make([]string, 0, len(byFormat))
+	for format := range byFormat {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	var tiles []AtlasTile
+	for _, format := range formats {
+		entries := byFormat[format]
+		for i := 0; i*atlasMaxTiles < len(entries); i++ {
+			batch := entries[i*atlasMaxTiles : min((i+1)*atlasMaxTiles, len(entries))]
+			base := opts.spritePrefix() + "atlas_" + strconv.Itoa(i)
+
+			if kept := unchangedAtlas(root, previous, batch, base, format); kept != nil {
+				opts.logger().Infof("Keeping %s %s atlas, its thumbnails didn't change", base, format)
+				tiles = append(tiles, kept...)
+				continue
+			}
+
+			batchTiles, err := writeAtlas(up, root, batch, format, base, opts)
+			if err != nil {
+				return fmt.Errorf("writing %s atlas %d: %w", format, i, err)
+			}
+			tiles = append(tiles, batchTiles...)
+		}
+	}
+
+	if err = deleteStaleSprites(up, root, atlasPaths(previous), atlasPaths(tiles), opts); err != nil {
+		return fmt.Errorf("deleting stale atlases: %w", err)
+	}
+
+	content, err := yaml.Marshal(tiles)
+	if err != nil {
+		return fmt.Errorf("marshaling atlas tiles: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(root, atlasFile), content, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", atlasFile, err)
+	}
+
+	return nil
+}
+
+// writeAtlas writes and uploads an atlas of the entries thumbnails,
+// resized from their originals the same way as for their sprites,
+// rather than cropped from lossy sprites, and returns their positions in it.
+func writeAtlas(up Uploader, root string, entries []atlasEntry, format, base string, opts Options) ([]AtlasTile, error) {
+	containers := make([]MediaContainer, len(entries))
+	for i, entry := range entries {
+		img, err := opts.readImageLimited(entry.dir, entry.media.Path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.media.Path, err)
+		}
+
+		tile := opts.ThumbMode.resize(img, maxThumbSize, opts.ResizeMode)
+		if opts.Watermark != nil {
+			tile = applyWatermark(tile, opts.Watermark, opts.WatermarkPosition)
+		}
+
+		containers[i].Media = &Media{
+			Path:        entry.media.Path,
+			ThumbWidth:  tile.Bounds().Dx(),
+			ThumbHeight: tile.Bounds().Dy(),
+			image:       tile,
+		}
+	}
+
+	totalWidth, totalHeight := pack(containers, 0, AlignTop)
+
+	opts.logger().Infof("Writing %s atlas of %d thumbnails", base, len(entries))
+	ref, _, err := writeSprite(up, root, base, format, opts, func(w io.Writer) error {
+		return drawSprite(w, containers, totalWidth, totalHeight, root, format, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := make([]AtlasTile, len(entries))
+	for i, entry := range entries {
+		rel, err := filepath.Rel(root, filepath.Join(entry.dir, entry.media.Path))
+		if err != nil {
+			return nil, fmt.Errorf("getting relative path of %s: %w", entry.media.Path, err)
+		}
+
+		tile := containers[i].Media
+		tiles[i] = AtlasTile{
+			Path:        filepath.ToSlash(rel),
+			Atlas:       ref,
+			XOffset:     tile.ThumbXOffset,
+			YOffset:     tile.ThumbYOffset,
+			Width:       tile.ThumbWidth,
+			Height:      tile.ThumbHeight,
+			TotalWidth:  totalWidth,
+			TotalHeight: totalHeight,
+
+			SpriteChecksum: entry.sum,
+		}
+	}
+
+	return tiles, nil
+}
+
+// loadAtlasFile returns tiles listed in .atlas.yml written by GenerateAtlases.
+func loadAtlasFile(path string) ([]AtlasTile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	var tiles []AtlasTile
+	if err = yaml.Unmarshal(content, &tiles); err != nil {
+		return nil, fmt.Errorf("unmarshaling %s: %w", path, err)
+	}
+
+	return tiles, nil
+}
+
+// unchangedAtlas returns previous tiles of the atlas with the base name and format
+// if they are of the same media in the same order, with the same sprite checksums,
+// and the atlas file exists; nil otherwise.
+func unchangedAtlas(root string, previous []AtlasTile, entries []atlasEntry, base, format string) []AtlasTile {
+	var kept []AtlasTile
+	for _, tile := range previous {
+		name, _, _ := strings.Cut(tile.Atlas, "?")
+		if strings.HasPrefix(name, base+".") && strings.HasSuffix(name, "."+format) {
+			kept = append(kept, tile)
+		}
+	}
+	if len(kept) != len(entries) {
+		return nil
+	}
+
+	for i, entry := range entries {
+		rel, err := filepath.Rel(root, filepath.Join(entry.dir, entry.media.Path))
+		if err != nil || kept[i].Path != filepath.ToSlash(rel) || kept[i].SpriteChecksum != entry.sum || kept[i].Atlas != kept[0].Atlas {
+			return nil
+		}
+	}
+
+	name, _, _ := strings.Cut(kept[0].Atlas, "?")
+	if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+		return nil
+	}
+
+	return kept
+}
+
+// spriteSum returns the checksum of the sprite referenced by ref:
+// the one in the reference, or of the file content if it has none.
+func spriteSum(dir, ref string, opts Options) (string, error) {
+	if _, sum, ok := spriteChecksum(ref, opts); ok {
+		return sum, nil
+	}
+
+	name, _, _ := strings.Cut(ref, "?")
+	content, err := opts.readFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("reading thumbnail %q: %w", name, err)
+	}
+	return checksum(content), nil
+}
+
+// atlasPaths returns a set of atlas file names referenced by tiles.
+func atlasPaths(tiles []AtlasTile) map[string]bool {
+	result := make(map[string]bool)
+	for _, tile := range tiles {
+		path, _, _ := strings.Cut(tile.Atlas, "?")
+		result[path] = true
+	}
+	return result
+}
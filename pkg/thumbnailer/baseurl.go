@@ -0,0 +1,46 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// setURLs sets URL and ThumbURL of media to their location under opts.BaseURL,
+// with keys relative to opts.MediaDir, the same as uploaded objects.
+// URLs are removed if BaseURL is not set or files of the directory are not uploaded.
+func setURLs(media []*Media, dir string, opts Options) error {
+	if opts.BaseURL == "" || isLocalOnly(dir) {
+		for _, file := range media {
+			file.URL = ""
+			file.ThumbURL = ""
+		}
+		return nil
+	}
+
+	rel, err := filepath.Rel(opts.MediaDir, dir)
+	if err != nil {
+		return fmt.Errorf("getting path of %q relative to %q: %w", dir, opts.MediaDir, err)
+	}
+
+	for _, file := range media {
+		file.URL = objectURL(opts.BaseURL, filepath.Join(rel, localName(file.Path)))
+		file.ThumbURL = ""
+		if file.ThumbPath != "" {
+			// keep the query string, such as ?crc=, as is
+			ref, query, found := strings.Cut(file.ThumbPath, "?")
+			file.ThumbURL = objectURL(opts.BaseURL, filepath.Join(rel, ref))
+			if found {
+				file.ThumbURL += "?" + query
+			}
+		}
+	}
+
+	return nil
+}
+
+// objectURL returns URL of the object with given key under base.
+func objectURL(base, key string) string {
+	return strings.TrimSuffix(base, "/") + "/" + (&url.URL{Path: filepath.ToSlash(key)}).EscapedPath()
+}
@@ -0,0 +1,180 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/nfnt/resize"
+
+	"github.com/alsosee/thumbnailer/pkg/blurhash"
+	"github.com/alsosee/thumbnailer/pkg/webp"
+)
+
+const (
+	// images are downscaled before calculating blurhash, details are lost anyway
+	blurhashSourceSize = 64
+
+	// default size of the longer side of the blurhash preview image
+	blurhashImageSize = 32
+)
+
+// setBlurhash calculates blurhash for the (possibly already resized) image.
+func setBlurhash(file *Media, img image.Image) error {
+	img = resize.Thumbnail(blurhashSourceSize, blurhashSourceSize, img, resize.Bilinear)
+
+	x, y := blurhash.Components(img.Bounds().Dx(), img.Bounds().Dy())
+	hash, err := blurhash.Encode(x, y, img)
+	if err != nil {
+		return fmt.Errorf("encoding blurhash: %w", err)
+	}
+
+	file.Blurhash = hash
+	file.blurhashUpdated = true
+	return nil
+}
+
+// skipBlurhash reports whether the image is too small to need a blurhash.
+// Images of unknown size are not skipped.
+func (o Options) skipBlurhash(file *Media) bool {
+	if o.BlurhashMinSize == 0 || file.Width == 0 || file.Height == 0 {
+		return false
+	}
+	return min(file.Width, file.Height) < o.BlurhashMinSize
+}
+
+// updateBlurhashes sets blurhash for media that don't have it yet
+// (or for all media if forced), and preview images decoded from blurhashes.
+// Blurhashes already calculated by GenerateThumbnail in this run are reused.
+func updateBlurhashes(media []*Media, dir string, opts Options) error {
+	for _, file := range media {
+		if opts.skipBlurhash(file) {
+			file.Blurhash = ""
+			file.BlurhashImageBase64 = ""
+			continue
+		}
+
+		if file.Blurhash == "" || (opts.ForceBlurhash && !file.blurhashUpdated) {
+			opts.debugf("%s: recalculating blurhash, missing: %t, forced: %t", file.Path, file.Blurhash == "", opts.ForceBlurhash)
+			if err := blurhashFromFile(file, dir, opts); err != nil {
+				return err
+			}
+			if file.Blurhash == "" {
+				// too small, which is only known after decoding it
+				file.BlurhashImageBase64 = ""
+				continue
+			}
+		}
+
+		if file.blurhashUpdated || file.BlurhashImageBase64 == "" || opts.ForceBlurhashImages {
+			opts.debugf("%s: regenerating blurhash image", file.Path)
+			dataURI, err := blurhashImage(file, opts.BlurhashImageFormat, opts.blurhashImageSize())
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Path, err)
+			}
+			file.BlurhashImageBase64 = dataURI
+		}
+	}
+
+	return nil
+}
+
+// BackfillBlurhashes sets blurhashes of media listed in .thumbs.yml of the directory
+// that don't have them and saves it, without scanning the directory for new files
+// or generating and uploading sprites. Returns ErrThumbYamlNotFound if there is no .thumbs.yml.
+func BackfillBlurhashes(dir string, opts Options) error {
+	opts.Logger = opts.logger().With("dir", dir)
+
+	thumbsFile := opts.thumbsFilePath(dir)
+	media, err := LoadThumbsFile(thumbsFile)
+	if err != nil {
+		return err
+	}
+
+	if err = updateBlurhashes(media, dir, opts); err != nil {
+		return fmt.Errorf("updating blurhashes: %w", err)
+	}
+
+	if err = SaveThumbsFile(thumbsFile, media); err != nil {
+		return fmt.Errorf("saving media: %w", err)
+	}
+	if err = opts.onMedia(dir, media); err != nil {
+		return err
+	}
+
+	opts.Stats.addDirectory(0, 0)
+
+	return nil
+}
+
+// blurhashFromFile decodes the image and sets its blurhash.
+func blurhashFromFile(file *Media, dir string, opts Options) error {
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	img, err := opts.readImage(dir, file.Path)
+	if err != nil {
+		return fmt.Errorf("reading image: %w", err)
+	}
+	if file.Width == 0 || file.Height == 0 {
+		file.setDimensions(img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if opts.skipBlurhash(file) {
+		file.Blurhash = ""
+		return nil
+	}
+
+	if err = setBlurhash(file, img); err != nil {
+		return fmt.Errorf("%s: %w", file.Path, err)
+	}
+
+	return nil
+}
+
+// blurhashImageSize returns the size of the longer side of blurhash preview images.
+func (o Options) blurhashImageSize() int {
+	if o.BlurhashImageSize > 0 {
+		return o.BlurhashImageSize
+	}
+	return blurhashImageSize
+}
+
+// blurhashImage returns a data URI with a small preview image decoded from blurhash,
+// with the longer side of size pixels.
+func blurhashImage(file *Media, format string, size int) (string, error) {
+	width, height := size, size
+	if file.Width > 0 && file.Height > 0 {
+		if file.Width >= file.Height {
+			height = max(1, size*file.Height/file.Width)
+		} else {
+			width = max(1, size*file.Width/file.Height)
+		}
+	}
+
+	img, err := blurhash.Decode(file.Blurhash, width, height, 1)
+	if err != nil {
+		return "", fmt.Errorf("decoding blurhash: %w", err)
+	}
+
+	var (
+		b        bytes.Buffer
+		mimeType string
+	)
+	switch format {
+	case "webp":
+		mimeType = "image/webp"
+		err = webp.Encode(&b, img)
+	case "jpg", "":
+		mimeType = "image/jpeg"
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: 80})
+	default:
+		return "", fmt.Errorf("unsupported blurhash image format: %s", format)
+	}
+	if err != nil {
+		return "", fmt.Errorf("encoding blurhash image: %w", err)
+	}
+
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
@@ -0,0 +1,84 @@
+package thumbnailer
+
+import (
+	"image"
+	"sync"
+)
+
+// bytesPerPixel is the approximate memory used by a decoded pixel (RGBA).
+const bytesPerPixel = 4
+
+// memoryBudget limits the total size of images decoded at the same time.
+// An image larger than the whole budget is still decoded, but only alone.
+type memoryBudget struct {
+	limit int64 // 0 for no limit
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	b := &memoryBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes fit into the budget.
+func (b *memoryBudget) acquire(n int64) {
+	if b.limit <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b.limit <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// DecodeLimiter bounds the number of images decoded at the same time.
+// A single limiter is meant to be shared by all ProcessDirectory calls
+// through Options, so that the total is bounded regardless of how many
+// directories are processed concurrently. A nil limiter doesn't limit.
+type DecodeLimiter struct {
+	sem chan struct{}
+}
+
+// NewDecodeLimiter returns a limiter allowing n concurrent decodes.
+func NewDecodeLimiter(n int) *DecodeLimiter {
+	return &DecodeLimiter{sem: make(chan struct{}, n)}
+}
+
+func (l *DecodeLimiter) acquire() {
+	if l != nil {
+		l.sem <- struct{}{}
+	}
+}
+
+func (l *DecodeLimiter) release() {
+	if l != nil {
+		<-l.sem
+	}
+}
+
+// readImageLimited reads an image with readImage, counted by opts.DecodeLimiter.
+func (o Options) readImageLimited(dir, path string) (image.Image, error) {
+	o.DecodeLimiter.acquire()
+	defer o.DecodeLimiter.release()
+
+	return o.readImage(dir, path)
+}
@@ -0,0 +1,108 @@
+package thumbnailer
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	const limit = 100
+
+	b := newMemoryBudget(limit)
+
+	var (
+		mu   sync.Mutex
+		used int64
+		peak int64
+		wg   sync.WaitGroup
+	)
+	for _, size := range []int64{60, 30, 50, 10, 150, 40, 20, 70} {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+
+			b.acquire(size)
+			mu.Lock()
+			used += size
+			if used > peak {
+				peak = used
+			}
+			mu.Unlock()
+
+			mu.Lock()
+			used -= size
+			mu.Unlock()
+			b.release(size)
+		}(size)
+	}
+	wg.Wait()
+
+	// 150 exceeds the budget alone and is allowed only without others
+	if peak > 150 {
+		t.Errorf("got peak %d; want at most 150", peak)
+	}
+}
+
+func TestDecodeLimiter(t *testing.T) {
+	l := NewDecodeLimiter(2)
+
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			l.acquire()
+			defer l.release()
+
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("got %d concurrent decodes; want at most 2", peak)
+	}
+
+	// nil limiter doesn't block
+	var nilLimiter *DecodeLimiter
+	nilLimiter.acquire()
+	nilLimiter.release()
+}
+
+func TestResizeMediaReadsOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	defer func() { osReadFile = os.ReadFile }()
+	reads := 0
+	osReadFile = func(name string) ([]byte, error) {
+		reads++
+		return os.ReadFile(name)
+	}
+
+	file := &Media{Path: "a.jpg"}
+	if err := resizeMedia(file, dir, newMemoryBudget(1<<20), Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reads != 1 {
+		t.Errorf("got %d reads; want 1", reads)
+	}
+	if file.Width != 40 || file.Height != 20 {
+		t.Errorf("got %dx%d; want 40x20", file.Width, file.Height)
+	}
+}
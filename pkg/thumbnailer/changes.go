@@ -0,0 +1,96 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// detectChanges sets checksums of local media and returns media whose content
+// changed since their checksums were recorded. Checksums are only recalculated
+// when size or modification time of a file changes, unless opts.ForceRehash is set.
+// Changed media lose their thumbnails, dimensions and blurhashes to be regenerated.
+func detectChanges(media []*Media, dir string, opts Options) ([]*Media, error) {
+	var changed []*Media
+	for _, file := range media {
+		ok, err := updateChecksum(file, dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		opts.logger().Infof("%s was changed", filepath.Join(dir, file.Path))
+		file.clearThumbs()
+		file.Variants = nil
+		file.setDimensions(0, 0)
+		file.Blurhash = ""
+		file.BlurhashImageBase64 = ""
+		changed = append(changed, file)
+	}
+
+	return changed, nil
+}
+
+// recordChecksums sets checksums of local media, like detectChanges,
+// without treating changed files differently.
+func recordChecksums(media []*Media, dir string, opts Options) error {
+	for _, file := range media {
+		if _, err := updateChecksum(file, dir, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateChecksum sets checksum, size and modification time of a local media file
+// and reports whether its content differs from the previously recorded checksum.
+func updateChecksum(file *Media, dir string, opts Options) (changed bool, err error) {
+	if !isLocalFile(file.Path) {
+		return false, nil
+	}
+
+	path := filepath.Join(dir, file.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("checking %s: %w", path, err)
+	}
+
+	if _, ok := storedChecksum(file, info, opts); ok {
+		return false, nil
+	}
+
+	content, err := opts.readFile(path)
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	sum := checksum(content)
+	changed = file.Checksum != "" && file.Checksum != sum
+
+	file.Size = info.Size()
+	file.ModTime = info.ModTime().UnixNano()
+	file.Checksum = sum
+
+	return changed, nil
+}
+
+// storedChecksum returns the checksum recorded for the media,
+// unless size or modification time of its file changed since, or opts.ForceRehash is set.
+func storedChecksum(file *Media, info os.FileInfo, opts Options) (string, bool) {
+	if opts.ForceRehash || file.Checksum == "" || file.Size != info.Size() || file.ModTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return file.Checksum, true
+}
+
+// isLocalFile reports whether the media is a file in the directory,
+// not a URL or an archive entry.
+func isLocalFile(path string) bool {
+	if isURL(path) {
+		return false
+	}
+	_, _, ok := splitArchivePath(path)
+	return !ok
+}
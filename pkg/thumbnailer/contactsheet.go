@@ -0,0 +1,32 @@
+package thumbnailer
+
+import (
+	"image"
+	"image/draw"
+	"path"
+
+	"github.com/alsosee/thumbnailer/pkg/tinyfont"
+)
+
+// space around file names under tiles of contact sheets
+const labelPadding = 3
+
+// labelHeight returns the height of the strip under each tile
+// with its file name, 0 unless ContactSheet is set.
+func (o Options) labelHeight() int {
+	if !o.ContactSheet {
+		return 0
+	}
+	return tinyfont.Height + 2*labelPadding
+}
+
+// drawLabel draws the file name of the media, truncated to the tile width,
+// into the strip under its tile.
+func drawLabel(dst draw.Image, file *Media, height int) {
+	strip := image.Rect(0, 0, file.ThumbWidth, height).
+		Add(image.Pt(file.ThumbXOffset, file.ThumbYOffset+file.ThumbHeight))
+	draw.Draw(dst, strip, image.White, image.Point{}, draw.Src)
+
+	label := tinyfont.Truncate(path.Base(baseName(file.Path)), file.ThumbWidth-2*labelPadding)
+	tinyfont.Draw(dst, strip.Min.Add(image.Pt(labelPadding, labelPadding)), label, image.Black)
+}
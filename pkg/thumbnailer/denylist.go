@@ -0,0 +1,63 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// checksum returns the checksum of file content stored in Media.Checksum.
+func checksum(content []byte) string {
+	return fmt.Sprintf("%x", crc32.ChecksumIEEE(content))
+}
+
+// filterDenied returns files whose checksums are not in opts.Denylist.
+// Checksums recorded in media are reused for files that didn't change.
+func filterDenied(files []string, media []*Media, dir string, opts Options) ([]string, error) {
+	if len(opts.Denylist) == 0 {
+		return files, nil
+	}
+
+	known := make(map[string]*Media, len(media))
+	for _, file := range media {
+		known[file.Path] = file
+	}
+
+	var result []string
+	for _, file := range files {
+		sum, err := fileChecksum(dir, file, known[file], opts)
+		if err != nil {
+			return nil, fmt.Errorf("reading file: %w", err)
+		}
+
+		if opts.Denylist[sum] {
+			opts.debugf("%s: skipping denylisted %s", dir, file)
+			continue
+		}
+		result = append(result, file)
+	}
+
+	if denied := len(files) - len(result); denied > 0 {
+		opts.logger().Warnf("Skipped %d denylisted file(s) in %s", denied, dir)
+	}
+
+	return result, nil
+}
+
+// fileChecksum returns the checksum of the file, the one recorded in its media if any is still valid.
+func fileChecksum(dir, file string, known *Media, opts Options) (string, error) {
+	if known != nil && isLocalFile(file) {
+		if info, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			if sum, ok := storedChecksum(known, info, opts); ok {
+				return sum, nil
+			}
+		}
+	}
+
+	content, err := opts.readMedia(dir, file)
+	if err != nil {
+		return "", err
+	}
+	return checksum(content), nil
+}
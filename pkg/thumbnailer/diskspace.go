@@ -0,0 +1,28 @@
+package thumbnailer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrLowDiskSpace is returned when free disk space is below Options.MinFreeSpace.
+var ErrLowDiskSpace = errors.New("not enough free disk space")
+
+// checkFreeSpace returns ErrLowDiskSpace if the file system of dir
+// has less than required bytes available. It does nothing if required is not positive.
+func checkFreeSpace(dir string, required int64) error {
+	if required <= 0 {
+		return nil
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("checking free disk space: %w", err)
+	}
+
+	if free < uint64(required) {
+		return fmt.Errorf("%w in %s: %d bytes available, %d required", ErrLowDiskSpace, dir, free, required)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package thumbnailer
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := checkFreeSpace(dir, 0); err != nil {
+		t.Errorf("unexpected error without threshold: %v", err)
+	}
+	if err := checkFreeSpace(dir, 1); err != nil {
+		t.Errorf("unexpected error for 1 byte: %v", err)
+	}
+	if err := checkFreeSpace(dir, math.MaxInt64); !errors.Is(err, ErrLowDiskSpace) {
+		t.Errorf("got %v; want ErrLowDiskSpace", err)
+	}
+}
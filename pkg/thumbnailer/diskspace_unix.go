@@ -0,0 +1,16 @@
+//go:build unix
+
+package thumbnailer
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users
+// on the file system of path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,37 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dumpTile writes the resized tile of the media as tile_<name>.png
+// into opts.DumpTilesDir, under the path of dir relative to opts.MediaDir,
+// to inspect how the image was resized.
+func dumpTile(file *Media, dir string, opts Options) error {
+	rel, err := filepath.Rel(opts.MediaDir, dir)
+	if err != nil || opts.MediaDir == "" {
+		rel = filepath.Base(dir)
+	}
+	target := filepath.Join(opts.DumpTilesDir, rel)
+	if err = os.MkdirAll(target, 0o755); err != nil {
+		return fmt.Errorf("creating tiles directory: %w", err)
+	}
+
+	var b bytes.Buffer
+	if err = png.Encode(&b, file.image); err != nil {
+		return &EncodeError{Path: dir, Format: "png", Err: err}
+	}
+
+	// images inside archives have slashes in their paths
+	name := "tile_" + strings.ReplaceAll(localName(file.Path), "/", "_") + ".png"
+	if err = os.WriteFile(filepath.Join(target, name), b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing tile: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package thumbnailer
+
+import "fmt"
+
+// DecodeError is returned when a source image can't be decoded.
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding image %q: %v", e.Path, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// EncodeError is returned when a thumbnail sprite can't be encoded.
+// Path is the directory the sprite was generated for.
+type EncodeError struct {
+	Path   string
+	Format string
+	Err    error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("encoding %s thumbnail for %q: %v", e.Format, e.Path, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error { return e.Err }
+
+// UploadError is returned when a file can't be uploaded or deleted from the storage.
+type UploadError struct {
+	Path string
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("uploading %q: %v", e.Path, e.Err)
+}
+
+func (e *UploadError) Unwrap() error { return e.Err }
+
+// ThumbsFileError is returned when a .thumbs.yml file can't be read, parsed or written.
+type ThumbsFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *ThumbsFileError) Error() string {
+	return fmt.Sprintf("thumbs file %q: %v", e.Path, e.Err)
+}
+
+func (e *ThumbsFileError) Unwrap() error { return e.Err }
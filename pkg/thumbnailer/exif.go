@@ -0,0 +1,196 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	markerSOI  = 0xffd8
+	markerAPP1 = 0xffe1
+	markerSOS  = 0xffda
+
+	tagGPSInfo      = 0x8825
+	tagGPSLatRef    = 0x0001
+	tagGPSLat       = 0x0002
+	tagGPSLngRef    = 0x0003
+	tagGPSLng       = 0x0004
+	typeASCII       = 2
+	typeRational    = 5
+	maxExifBlockLen = 64 * 1024
+)
+
+// readExif returns the raw TIFF block from the JPEG APP1 EXIF segment.
+// It returns nil if the file is not a JPEG or has no EXIF data.
+func readExif(r io.Reader) []byte {
+	var soi uint16
+	if err := binary.Read(r, binary.BigEndian, &soi); err != nil || soi != markerSOI {
+		return nil
+	}
+
+	for {
+		var marker, size uint16
+		if err := binary.Read(r, binary.BigEndian, &marker); err != nil {
+			return nil
+		}
+		if marker>>8 != 0xff || marker == markerSOS {
+			return nil
+		}
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil || size < 2 {
+			return nil
+		}
+
+		block := make([]byte, size-2)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil
+		}
+
+		if marker == markerAPP1 && bytes.HasPrefix(block, []byte("Exif\x00\x00")) {
+			return block[6:]
+		}
+	}
+}
+
+// tiff is a minimal reader for TIFF-structured EXIF data.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiff(data []byte) *tiff {
+	if len(data) < 8 {
+		return nil
+	}
+
+	switch string(data[:2]) {
+	case "II":
+		return &tiff{data: data, order: binary.LittleEndian}
+	case "MM":
+		return &tiff{data: data, order: binary.BigEndian}
+	default:
+		return nil
+	}
+}
+
+type ifdEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset uint32 // value offset, or the value itself if it fits in 4 bytes
+	raw    []byte // raw 4-byte value field
+}
+
+// ifd reads the entries of an IFD at the given offset.
+func (t *tiff) ifd(offset uint32) []ifdEntry {
+	if int(offset)+2 > len(t.data) {
+		return nil
+	}
+
+	n := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+
+	var result []ifdEntry
+	for i := 0; i < n; i++ {
+		p := start + i*12
+		if p+12 > len(t.data) {
+			break
+		}
+		result = append(result, ifdEntry{
+			tag:    t.order.Uint16(t.data[p:]),
+			typ:    t.order.Uint16(t.data[p+2:]),
+			count:  t.order.Uint32(t.data[p+4:]),
+			offset: t.order.Uint32(t.data[p+8:]),
+			raw:    t.data[p+8 : p+12],
+		})
+	}
+
+	return result
+}
+
+// rationals reads count unsigned rationals stored at the entry offset.
+func (t *tiff) rationals(e ifdEntry) []float64 {
+	if e.typ != typeRational {
+		return nil
+	}
+
+	end := int(e.offset) + int(e.count)*8
+	if end > len(t.data) {
+		return nil
+	}
+
+	result := make([]float64, e.count)
+	for i := range result {
+		p := int(e.offset) + i*8
+		num := t.order.Uint32(t.data[p:])
+		den := t.order.Uint32(t.data[p+4:])
+		if den == 0 {
+			return nil
+		}
+		result[i] = float64(num) / float64(den)
+	}
+
+	return result
+}
+
+// ReadGPS returns latitude and longitude stored in EXIF GPS tags of the file.
+// ok is false if the file has no GPS information.
+func ReadGPS(path string) (lat, lng float64, ok bool) {
+	return Options{}.readGPS(path)
+}
+
+// readGPS is like ReadGPS, retrying transient read errors.
+func (o Options) readGPS(path string) (lat, lng float64, ok bool) {
+	head, err := o.readHead(path, maxExifBlockLen)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	t := newTiff(readExif(bytes.NewReader(head)))
+	if t == nil {
+		return 0, 0, false
+	}
+
+	var gpsOffset uint32
+	for _, e := range t.ifd(t.order.Uint32(t.data[4:])) {
+		if e.tag == tagGPSInfo {
+			gpsOffset = e.offset
+			break
+		}
+	}
+	if gpsOffset == 0 {
+		return 0, 0, false
+	}
+
+	var (
+		latRef, lngRef string
+		latDMS, lngDMS []float64
+	)
+	for _, e := range t.ifd(gpsOffset) {
+		switch {
+		case e.tag == tagGPSLatRef && e.typ == typeASCII:
+			latRef = string(e.raw[:1])
+		case e.tag == tagGPSLngRef && e.typ == typeASCII:
+			lngRef = string(e.raw[:1])
+		case e.tag == tagGPSLat:
+			latDMS = t.rationals(e)
+		case e.tag == tagGPSLng:
+			lngDMS = t.rationals(e)
+		}
+	}
+
+	if len(latDMS) != 3 || len(lngDMS) != 3 {
+		return 0, 0, false
+	}
+
+	lat = latDMS[0] + latDMS[1]/60 + latDMS[2]/3600
+	lng = lngDMS[0] + lngDMS[1]/60 + lngDMS[2]/3600
+	if latRef == "S" {
+		lat = -lat
+	}
+	if lngRef == "W" {
+		lng = -lng
+	}
+
+	return lat, lng, true
+}
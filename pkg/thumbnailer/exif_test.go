@@ -0,0 +1,156 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gpsTag is a GPS IFD entry of a test fixture.
+type gpsTag struct {
+	tag uint16
+	ref string    // for ASCII tags
+	dms []float64 // for rational tags, in whole units
+}
+
+// put writes v to the buffer, which never fails for fixed-size values.
+func put(w *bytes.Buffer, order binary.ByteOrder, v any) {
+	binary.Write(w, order, v) //nolint:errcheck
+}
+
+// exifJPEG returns a minimal JPEG with an EXIF segment holding the GPS tags,
+// or without a GPS IFD if tags is nil.
+func exifJPEG(order binary.ByteOrder, tags []gpsTag) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	put(&tiff, order, uint16(42))
+	put(&tiff, order, uint32(8))
+
+	// IFD0 with a single entry: a pointer to the GPS IFD right after it, if any
+	const gpsOffset = 8 + 2 + 12 + 4
+	put(&tiff, order, uint16(1))
+	if tags != nil {
+		put(&tiff, order, []uint16{tagGPSInfo, 4})
+		put(&tiff, order, []uint32{1, gpsOffset})
+	} else {
+		put(&tiff, order, []uint16{0x010f, typeASCII}) // camera make
+		put(&tiff, order, []uint32{4, 0})
+	}
+	put(&tiff, order, uint32(0))
+
+	// GPS IFD, rationals are stored after it
+	dataOffset := uint32(gpsOffset + 2 + 12*len(tags) + 4)
+	var data bytes.Buffer
+	put(&tiff, order, uint16(len(tags)))
+	for _, tag := range tags {
+		if tag.dms == nil {
+			value := make([]byte, 4)
+			copy(value, tag.ref)
+			put(&tiff, order, []uint16{tag.tag, typeASCII})
+			put(&tiff, order, uint32(len(tag.ref)+1))
+			tiff.Write(value)
+			continue
+		}
+
+		put(&tiff, order, []uint16{tag.tag, typeRational})
+		put(&tiff, order, []uint32{uint32(len(tag.dms)), dataOffset + uint32(data.Len())})
+		for _, v := range tag.dms {
+			put(&data, order, []uint32{uint32(v * 100), 100})
+		}
+	}
+	put(&tiff, order, uint32(0))
+	tiff.Write(data.Bytes())
+
+	var jpeg bytes.Buffer
+	put(&jpeg, binary.BigEndian, []uint16{markerSOI, markerAPP1, uint16(2 + 6 + tiff.Len())})
+	jpeg.WriteString("Exif\x00\x00")
+	jpeg.Write(tiff.Bytes())
+	put(&jpeg, binary.BigEndian, uint16(markerSOS))
+
+	return jpeg.Bytes()
+}
+
+func TestReadGPS(t *testing.T) {
+	lat := []float64{48, 51, 29.5}
+	lng := []float64{2, 17, 40.2}
+
+	tt := map[string]struct {
+		content []byte
+		wantLat float64
+		wantLng float64
+		wantOK  bool
+	}{
+		"north east": {
+			content: exifJPEG(binary.LittleEndian, []gpsTag{
+				{tag: tagGPSLatRef, ref: "N"}, {tag: tagGPSLat, dms: lat},
+				{tag: tagGPSLngRef, ref: "E"}, {tag: tagGPSLng, dms: lng},
+			}),
+			wantLat: 48.858194,
+			wantLng: 2.294500,
+			wantOK:  true,
+		},
+		"south west, big endian": {
+			content: exifJPEG(binary.BigEndian, []gpsTag{
+				{tag: tagGPSLatRef, ref: "S"}, {tag: tagGPSLat, dms: lat},
+				{tag: tagGPSLngRef, ref: "W"}, {tag: tagGPSLng, dms: lng},
+			}),
+			wantLat: -48.858194,
+			wantLng: -2.294500,
+			wantOK:  true,
+		},
+		"missing references are positive": {
+			content: exifJPEG(binary.LittleEndian, []gpsTag{
+				{tag: tagGPSLat, dms: lat},
+				{tag: tagGPSLng, dms: lng},
+			}),
+			wantLat: 48.858194,
+			wantLng: 2.294500,
+			wantOK:  true,
+		},
+		"missing longitude": {
+			content: exifJPEG(binary.LittleEndian, []gpsTag{
+				{tag: tagGPSLatRef, ref: "N"}, {tag: tagGPSLat, dms: lat},
+			}),
+		},
+		"incomplete latitude": {
+			content: exifJPEG(binary.LittleEndian, []gpsTag{
+				{tag: tagGPSLat, dms: lat[:2]},
+				{tag: tagGPSLng, dms: lng},
+			}),
+		},
+		"no GPS IFD": {
+			content: exifJPEG(binary.LittleEndian, nil),
+		},
+		"not a JPEG": {
+			content: []byte("\x89PNG\r\n\x1a\n"),
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "photo.jpg")
+			if err := os.WriteFile(path, tc.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			lat, lng, ok := ReadGPS(path)
+			if ok != tc.wantOK {
+				t.Fatalf("got ok %t; want %t", ok, tc.wantOK)
+			}
+			if math.Abs(lat-tc.wantLat) > 1e-6 || math.Abs(lng-tc.wantLng) > 1e-6 {
+				t.Errorf("got %f, %f; want %f, %f", lat, lng, tc.wantLat, tc.wantLng)
+			}
+		})
+	}
+
+	if _, _, ok := ReadGPS(filepath.Join(t.TempDir(), "missing.jpg")); ok {
+		t.Errorf("got GPS for a missing file")
+	}
+}
@@ -0,0 +1,60 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/log"
+	"github.com/nfnt/resize"
+
+	"github.com/alsosee/thumbnailer/pkg/ico"
+)
+
+const faviconFile = "favicon.ico"
+
+// faviconSizes are sizes of square layers of generated favicons.
+var faviconSizes = []int{16, 32, 48}
+
+// GenerateFavicon writes favicon.ico with 16, 32 and 48px layers
+// of the source image next to it and uploads it.
+// Non-square images are centered on a transparent background.
+func GenerateFavicon(up Uploader, source string, opts Options) error {
+	img, err := opts.readImageLimited(filepath.Dir(source), filepath.Base(source))
+	if err != nil {
+		return fmt.Errorf("reading image: %w", err)
+	}
+
+	layers := make([]image.Image, len(faviconSizes))
+	for i, size := range faviconSizes {
+		resized := resize.Thumbnail(uint(size), uint(size), img, resize.Lanczos3)
+
+		layer := image.NewNRGBA(image.Rect(0, 0, size, size))
+		offset := image.Pt(
+			(size-resized.Bounds().Dx())/2,
+			(size-resized.Bounds().Dy())/2,
+		)
+		draw.Draw(layer, resized.Bounds().Add(offset), resized, resized.Bounds().Min, draw.Src)
+		layers[i] = layer
+	}
+
+	var b bytes.Buffer
+	if err = ico.Encode(&b, layers); err != nil {
+		return &EncodeError{Path: source, Format: "ico", Err: err}
+	}
+
+	path := filepath.Join(filepath.Dir(source), faviconFile)
+	log.Infof("Writing %s", path)
+	if err = os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing favicon: %w", err)
+	}
+
+	if err = up.Upload(path, b.Bytes()); err != nil {
+		return fmt.Errorf("uploading favicon: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// spriteEncoders maps sprite formats (used as sprite file extensions)
+// to encoders supported by drawSprite.
+var spriteEncoders = map[string]string{
+	"jpg":  "jpg",
+	"jpeg": "jpg",
+	"png":  "png",
+}
+
+// defaultFormatGroups maps file extensions to sprite formats;
+// files with other extensions are put into "jpg" sprites.
+var defaultFormatGroups = map[string]string{
+	".png": "png",
+}
+
+var (
+	// extensions of files picked up by ScanDirectory
+	extensions   = map[string]bool{".jpg": true, ".jpeg": true, ".png": true}
+	extensionsMu sync.RWMutex
+)
+
+// RegisterFormat adds the file extension (e.g. ".heic")
+// to the set of extensions picked up by ScanDirectory.
+//
+// A decoder for the format must be registered with image.RegisterFormat
+// (usually by importing the decoder package for its side effects)
+// before ProcessDirectory is called, otherwise decoding fails.
+// Images in registered formats are put into JPEG sprites.
+func RegisterFormat(ext string) {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+
+	extensions[ext] = true
+}
+
+// RegisterDecoder registers an image decoder with image.RegisterFormat
+// and adds ext to the set of extensions picked up by ScanDirectory.
+// See image.RegisterFormat for the meaning of name and magic.
+func RegisterDecoder(
+	ext string,
+	name string,
+	magic string,
+	decode func(io.Reader) (image.Image, error),
+	decodeConfig func(io.Reader) (image.Config, error),
+) {
+	image.RegisterFormat(name, magic, decode, decodeConfig)
+	RegisterFormat(ext)
+}
+
+// SupportedExtensions returns extensions of files picked up by ScanDirectory,
+// mapped to formats of sprites they are put into with given format groups.
+func SupportedExtensions(groups map[string]string) map[string]string {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+
+	groups = normalizeFormatGroups(groups)
+	result := make(map[string]string, len(extensions))
+	for ext := range extensions {
+		result[ext] = formatGroup("file"+ext, groups)
+	}
+	return result
+}
+
+// SpriteFormats returns sorted formats sprites can be encoded in.
+func SpriteFormats() []string {
+	formats := make([]string, 0, len(spriteEncoders))
+	for format := range spriteEncoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func isSupported(ext string) bool {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+
+	return extensions[ext]
+}
+
+// normalizeFormatGroups returns groups with extensions lowercased and prefixed
+// with a dot, so that "JPE" matches files with the ".jpe" extension.
+func normalizeFormatGroups(groups map[string]string) map[string]string {
+	if len(groups) == 0 {
+		return groups
+	}
+
+	result := make(map[string]string, len(groups))
+	for ext, group := range groups {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		result[ext] = group
+	}
+	return result
+}
+
+// validateFormatGroups checks that every group maps to a supported sprite encoder,
+// or that there is a supported fallback format for the groups that don't.
+func validateFormatGroups(groups map[string]string, fallback string) error {
+	if fallback != "" {
+		if _, ok := spriteEncoders[fallback]; !ok {
+			return fmt.Errorf("unsupported fallback sprite format %q", fallback)
+		}
+		return nil
+	}
+
+	for ext, group := range groups {
+		if _, ok := spriteEncoders[group]; !ok {
+			return fmt.Errorf("unsupported sprite format %q for %q", group, ext)
+		}
+	}
+	return nil
+}
+
+// applyFallbackFormat moves media of groups without a sprite encoder
+// to the fallback group, if there is one.
+func applyFallbackFormat(grouped map[string][]*Media, opts Options) map[string][]*Media {
+	fallback := opts.FallbackFormat
+	if fallback == "" {
+		return grouped
+	}
+
+	for format, media := range grouped {
+		if _, ok := spriteEncoders[format]; ok {
+			continue
+		}
+
+		opts.logger().Warnf("%s sprites are not supported, using %s", format, fallback)
+		grouped[fallback] = append(grouped[fallback], media...)
+		delete(grouped, format)
+	}
+
+	return grouped
+}
+
+// formatGroup returns the sprite format for the file,
+// using groups to override the default mapping.
+func formatGroup(path string, groups map[string]string) string {
+	ext := filepath.Ext(localName(path))
+	if group, ok := groups[ext]; ok {
+		return group
+	}
+	if group, ok := defaultFormatGroups[ext]; ok {
+		return group
+	}
+	// jpeg and formats registered with RegisterFormat
+	return "jpg"
+}
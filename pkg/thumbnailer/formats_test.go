@@ -0,0 +1,63 @@
+package thumbnailer
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubMagic starts files of the stub format registered by TestRegisterDecoder.
+const stubMagic = "STUB"
+
+func decodeStub(r io.Reader) (image.Image, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 30, 10))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	return img, nil
+}
+
+func decodeStubConfig(r io.Reader) (image.Config, error) {
+	return image.Config{ColorModel: color.RGBAModel, Width: 30, Height: 10}, nil
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.stub", "b.other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(stubMagic+"data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	RegisterDecoder(".stub", "stub", stubMagic, decodeStub, decodeStubConfig)
+
+	files, err := ScanDirectory(dir, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(files, ",") != "a.stub" {
+		t.Errorf("got files %q; want only a.stub", files)
+	}
+
+	img, err := Options{}.readImage(dir, "a.stub")
+	if err != nil {
+		t.Fatalf("decoding registered format: %v", err)
+	}
+	if img.Bounds().Dx() != 30 || img.Bounds().Dy() != 10 {
+		t.Errorf("got image %v; want 30x10", img.Bounds())
+	}
+
+	if got := SupportedExtensions(nil)[".stub"]; got != "jpg" {
+		t.Errorf("got sprite format %q for registered format; want jpg", got)
+	}
+
+	// extensions without a dot are registered too
+	RegisterFormat("other")
+	if !isSupported(".other") {
+		t.Errorf("extension registered without a dot is not supported")
+	}
+}
@@ -0,0 +1,19 @@
+package thumbnailer
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// individualName matches file names of individual thumbnails, such as logo_thumb.png,
+// logo_thumb_648.png or logo_thumb.1a2b3c4d.png with content-addressed names
+var individualName = regexp.MustCompile(`_thumb(_\d+)?(\.[0-9a-f]+)?\.[A-Za-z]+$`)
+
+// individualBase returns the name of the individual thumbnail of the media without extension,
+// e.g. "logo_thumb" for logo.png.
+func individualBase(file *Media) string {
+	name := localName(file.Path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.ReplaceAll(name, "/", "_") + "_thumb"
+}
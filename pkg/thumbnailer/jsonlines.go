@@ -0,0 +1,36 @@
+package thumbnailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// mediaRecord is a line of Options.MediaStream.
+type mediaRecord struct {
+	// Directory of the media relative to Options.MediaDir
+	Dir string `json:"dir"`
+	*Media
+}
+
+// streamMedia writes a JSON Lines record for each media of the directory to opts.MediaStream.
+func streamMedia(media []*Media, dir string, opts Options) error {
+	if opts.MediaStream == nil {
+		return nil
+	}
+
+	rel, err := filepath.Rel(opts.MediaDir, dir)
+	if err != nil {
+		return fmt.Errorf("getting path of %q relative to %q: %w", dir, opts.MediaDir, err)
+	}
+
+	// json.Encoder writes each record followed by a newline at once
+	enc := json.NewEncoder(opts.MediaStream)
+	for _, file := range media {
+		if err = enc.Encode(mediaRecord{Dir: filepath.ToSlash(rel), Media: file}); err != nil {
+			return fmt.Errorf("writing %s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+package thumbnailer
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// noUploadFile marks a directory whose media and thumbnails are kept local
+const noUploadFile = ".no-upload"
+
+// isLocalOnly reports whether the directory has a noUploadFile.
+func isLocalOnly(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, noUploadFile))
+	return err == nil
+}
@@ -0,0 +1,96 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+
+	"github.com/alsosee/thumbnailer/pkg/jpegenc"
+)
+
+// quality of downscaled JPEG originals, they are meant to be viewed in full
+const originalJPEGQuality = 95
+
+// uploadOriginal uploads the media file, downscaled if opts.MaxOriginalDimension is set,
+// and records dimensions of the stored image.
+func uploadOriginal(uploader Uploader, file *Media, dir string, opts Options) error {
+	content, err := opts.readMedia(dir, file.Path)
+	if err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+
+	file.StoredWidth, file.StoredHeight = 0, 0
+	if opts.MaxOriginalDimension > 0 {
+		content, err = downscaleOriginal(file, content, dir, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(dir, localName(file.Path))
+	if err = uploader.Upload(path, content); err != nil {
+		return fmt.Errorf("uploading file: %w", &UploadError{Path: path, Err: err})
+	}
+
+	return nil
+}
+
+// downscaleOriginal returns the image re-encoded with its longer side
+// at most opts.MaxOriginalDimension, setting StoredWidth and StoredHeight.
+// Smaller images and formats that can't be re-encoded are returned as is.
+func downscaleOriginal(file *Media, content []byte, dir string, opts Options) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(file.Path))
+	if !canReencode(ext) {
+		return content, nil
+	}
+
+	path := filepath.Join(dir, file.Path)
+	img, err := decodeImage(content, path)
+	if err != nil {
+		return nil, err
+	}
+
+	size := opts.MaxOriginalDimension
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= size && height <= size {
+		return content, nil
+	}
+
+	img = resize.Thumbnail(uint(size), uint(size), img, resize.Lanczos3)
+
+	b, err := reencode(img, ext)
+	if err != nil {
+		return nil, &EncodeError{Path: path, Format: ext[1:], Err: err}
+	}
+
+	file.StoredWidth = img.Bounds().Dx()
+	file.StoredHeight = img.Bounds().Dy()
+	opts.logger().Infof("Downscaled %s from %dx%d to %dx%d", path, width, height, file.StoredWidth, file.StoredHeight)
+
+	return b, nil
+}
+
+// canReencode reports whether images with the extension can be encoded by reencode.
+func canReencode(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+// reencode encodes the image in the format of files with given extension.
+// No EXIF is written, so the orientation tag of the original is dropped along with the rest.
+func reencode(img image.Image, ext string) ([]byte, error) {
+	var (
+		b   bytes.Buffer
+		err error
+	)
+	if ext == ".png" {
+		err = png.Encode(&b, img)
+	} else {
+		err = jpegenc.Encode(&b, img, &jpegenc.Options{Quality: originalJPEGQuality})
+	}
+	return b.Bytes(), err
+}
@@ -0,0 +1,123 @@
+//go:build pdf
+
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// pdfRenderSize is the size of the longer side of rendered PDF pages,
+	// large enough for thumbnails and blurhashes.
+	pdfRenderSize = 1024
+
+	// pdfRenderTimeout limits rendering of a single page, e.g. of a malformed PDF.
+	pdfRenderTimeout = time.Minute
+
+	// pdfCacheSize is the number of recent renders kept, so that a page
+	// is rendered once for both its config and its image.
+	pdfCacheSize = 8
+)
+
+var (
+	pdfCacheMu sync.Mutex
+	pdfCache   = map[[sha256.Size]byte][]byte{}
+	pdfRecent  [][sha256.Size]byte // keys of pdfCache, oldest first
+
+	// renderPDFPage is replaced in tests
+	renderPDFPage = runPdftoppm
+)
+
+// PDF support renders the first page with pdftoppm from poppler-utils,
+// which must be installed. Build with -tags pdf to enable it.
+func init() {
+	RegisterDecoder(".pdf", "pdf", "%PDF-", decodePDF, decodePDFConfig)
+}
+
+func decodePDF(r io.Reader) (image.Image, error) {
+	b, err := renderPDF(r)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(b))
+}
+
+func decodePDFConfig(r io.Reader) (image.Config, error) {
+	b, err := renderPDF(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return png.DecodeConfig(bytes.NewReader(b))
+}
+
+// renderPDF returns the first page of the PDF as PNG,
+// rendering it only if it's not one of the recently rendered ones.
+func renderPDF(r io.Reader) ([]byte, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading pdf: %w", err)
+	}
+	key := sha256.Sum256(content)
+
+	pdfCacheMu.Lock()
+	b, ok := pdfCache[key]
+	pdfCacheMu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	b, err = renderPDFPage(content)
+	if err != nil {
+		return nil, err
+	}
+
+	pdfCacheMu.Lock()
+	defer pdfCacheMu.Unlock()
+	if _, ok = pdfCache[key]; !ok {
+		if len(pdfRecent) == pdfCacheSize {
+			delete(pdfCache, pdfRecent[0])
+			pdfRecent = pdfRecent[1:]
+		}
+		pdfCache[key] = b
+		pdfRecent = append(pdfRecent, key)
+	}
+
+	return b, nil
+}
+
+func runPdftoppm(content []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdfRenderTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(
+		ctx,
+		"pdftoppm",
+		"-f", "1", "-l", "1",
+		"-singlefile",
+		"-png",
+		"-scale-to", fmt.Sprint(pdfRenderSize),
+		"-", // read PDF from stdin, write PNG to stdout
+	)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w after %s", ctx.Err(), pdfRenderTimeout)
+		}
+		return nil, fmt.Errorf("rendering pdf: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+//go:build pdf
+
+package thumbnailer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// minimalPDF returns a PDF with a single blank page of the size in points.
+func minimalPDF(width, height int) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] >>", width, height),
+	}
+
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return []byte(b.String())
+}
+
+func TestProcessDirectoryPDF(t *testing.T) {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		t.Skip("pdftoppm is not installed")
+	}
+
+	defer func() { renderPDFPage = runPdftoppm }()
+	renders := 0
+	renderPDFPage = func(content []byte) ([]byte, error) {
+		renders++
+		return runPdftoppm(content)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "doc.pdf"), minimalPDF(200, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 {
+		t.Fatalf("got %d media; want 1", len(media))
+	}
+	if m := media[0]; m.Width != pdfRenderSize || m.Height != pdfRenderSize/2 {
+		t.Errorf("got %dx%d; want %dx%d", m.Width, m.Height, pdfRenderSize, pdfRenderSize/2)
+	}
+
+	// the page was rendered once for its config and its image
+	if renders != 1 {
+		t.Errorf("got %d renders; want 1", renders)
+	}
+}
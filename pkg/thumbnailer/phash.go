@@ -0,0 +1,94 @@
+package thumbnailer
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/nfnt/resize"
+)
+
+// images are downscaled to phashSize×phashSize before the DCT
+const phashSize = 32
+
+// phash returns a 64-bit perceptual hash of the image: bits of the lowest
+// 8×8 DCT frequencies of its grayscale version, set if above their median.
+// Hashes of visually identical images differ in a few bits at most.
+func phash(img image.Image) uint64 {
+	small := resize.Resize(phashSize, phashSize, img, resize.Bilinear)
+	bounds := small.Bounds()
+
+	var pixels [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			r, g, b, _ := small.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[y][x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+
+	// 2D DCT of the lowest 8×8 frequencies, rows then columns
+	var rows [phashSize][8]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < phashSize; x++ {
+				rows[y][u] += pixels[y][x] * math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*phashSize))
+			}
+		}
+	}
+	var coeffs [64]float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			for y := 0; y < phashSize; y++ {
+				coeffs[v*8+u] += rows[y][u] * math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*phashSize))
+			}
+		}
+	}
+
+	// the DC coefficient is the average brightness, it is left out of the median
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << i
+		}
+	}
+
+	return hash
+}
+
+// findDuplicates returns media whose resized images are visually identical
+// to an earlier one, mapped to that one, comparing their perceptual hashes.
+// Hashes may differ in at most opts.DedupThreshold bits.
+func findDuplicates(media []*Media, opts Options) map[*Media]*Media {
+	duplicates := map[*Media]*Media{}
+
+	var (
+		kept   []*Media
+		hashes []uint64
+	)
+	for _, file := range media {
+		hash := phash(file.image)
+
+		original := -1
+		for i, h := range hashes {
+			if bits.OnesCount64(hash^h) <= opts.DedupThreshold {
+				original = i
+				break
+			}
+		}
+		if original >= 0 {
+			opts.logger().Infof("%s looks the same as %s, sharing its thumbnail", file.Path, kept[original].Path)
+			duplicates[file] = kept[original]
+			continue
+		}
+
+		kept = append(kept, file)
+		hashes = append(hashes, hash)
+	}
+
+	return duplicates
+}
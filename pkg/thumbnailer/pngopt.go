@@ -0,0 +1,79 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/alsosee/thumbnailer/pkg/pngenc"
+)
+
+// pngOptimizer is run on PNG sprites with OptimizePNG if it's installed.
+var pngOptimizer = []string{"oxipng", "--opt", "2", "--strip", "safe", "-"}
+
+// pngOptimizerTimeout limits optimizing a single sprite,
+// after which the sprite is written as compressed by image/png.
+var pngOptimizerTimeout = time.Minute
+
+// encodePNG encodes the sprite as PNG. With OptimizePNG it's compressed harder
+// and passed through pngOptimizer, keeping the smaller result.
+// With ReproduciblePNG it's encoded by pngenc instead, and not optimized,
+// as the output of the optimizer depends on its version.
+func encodePNG(w io.Writer, img image.Image, opts Options) error {
+	if opts.ReproduciblePNG {
+		return pngenc.Encode(w, img)
+	}
+	if !opts.OptimizePNG {
+		return png.Encode(w, img)
+	}
+
+	var b bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&b, img); err != nil {
+		return err
+	}
+
+	content := b.Bytes()
+	optimized, err := optimizePNG(content)
+	if err != nil {
+		// the optimizer is optional
+		opts.debugf("not optimizing PNG: %v", err)
+	} else if len(optimized) < len(content) {
+		opts.debugf("PNG optimized from %d to %d bytes", len(content), len(optimized))
+		content = optimized
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
+// optimizePNG returns the PNG passed through pngOptimizer.
+func optimizePNG(content []byte) ([]byte, error) {
+	path, err := exec.LookPath(pngOptimizer[0])
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pngOptimizerTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, pngOptimizer[1:]...)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w after %s", ctx.Err(), pngOptimizerTimeout)
+		}
+		return nil, fmt.Errorf("%s: %w: %s", pngOptimizer[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
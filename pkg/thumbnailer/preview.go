@@ -0,0 +1,69 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nfnt/resize"
+
+	"github.com/alsosee/thumbnailer/pkg/webp"
+)
+
+const (
+	previewFile = "preview.webp"
+
+	// frames are smaller than sprite tiles to keep the preview file small
+	previewFrameSize = maxThumbSize / 2
+	previewMaxFrames = 30
+
+	defaultPreviewFrameDuration = 500 * time.Millisecond
+)
+
+// generatePreview writes and uploads an animated WebP cycling through
+// the first previewMaxFrames media of the directory.
+// Tiles resized by GenerateThumbnail are reused, other images are read from disk.
+func generatePreview(up Uploader, media []*Media, dir string, opts Options) error {
+	if len(media) > previewMaxFrames {
+		media = media[:previewMaxFrames]
+	}
+
+	frames := make([]image.Image, 0, len(media))
+	for _, file := range media {
+		img := file.image
+		if img == nil {
+			var err error
+			img, err = opts.readImageLimited(dir, file.Path)
+			if err != nil {
+				return fmt.Errorf("reading image: %w", err)
+			}
+		}
+
+		frames = append(frames, resize.Thumbnail(previewFrameSize, previewFrameSize, img, resize.Lanczos3))
+	}
+
+	duration := opts.PreviewFrameDuration
+	if duration <= 0 {
+		duration = defaultPreviewFrameDuration
+	}
+
+	var b bytes.Buffer
+	if err := webp.EncodeAnimation(&b, frames, duration); err != nil {
+		return &EncodeError{Path: dir, Format: "webp", Err: err}
+	}
+
+	path := filepath.Join(dir, previewFile)
+	opts.logger().Infof("Writing %s", path)
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing preview: %w", err)
+	}
+
+	if err := up.Upload(path, b.Bytes()); err != nil {
+		return fmt.Errorf("uploading preview: %w", err)
+	}
+
+	return nil
+}
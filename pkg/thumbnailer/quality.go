@@ -0,0 +1,71 @@
+package thumbnailer
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	defaultJPEGQuality = 95
+
+	// lowest quality used for sprites of flat, simple images with AdaptiveQuality
+	adaptiveMinQuality = 80
+
+	// average difference between neighbouring pixels (0-255)
+	// at which tiles are considered fully detailed
+	detailedComplexity = 24
+)
+
+// spriteQuality returns JPEG quality for a sprite of given tiles.
+func spriteQuality(containers []MediaContainer, opts Options) int {
+	quality := opts.JPEGQuality
+	if quality <= 0 {
+		quality = defaultJPEGQuality
+	}
+	if !opts.AdaptiveQuality || quality <= adaptiveMinQuality || len(containers) == 0 {
+		return quality
+	}
+
+	var total float64
+	for _, container := range containers {
+		total += complexity(container.Media.image)
+	}
+	avg := total / float64(len(containers))
+
+	return adaptiveMinQuality + int(avg*float64(quality-adaptiveMinQuality)+0.5)
+}
+
+// complexity estimates level of detail of the image from 0 (flat) to 1 (detailed)
+// as the average luma difference between horizontally and vertically adjacent pixels.
+func complexity(img image.Image) float64 {
+	if img == nil {
+		return 0
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() < 2 || bounds.Dy() < 2 {
+		return 0
+	}
+
+	luma := func(x, y int) int {
+		return int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+
+	var sum, n int
+	for y := bounds.Min.Y; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X-1; x++ {
+			l := luma(x, y)
+			sum += abs(l-luma(x+1, y)) + abs(l-luma(x, y+1))
+			n += 2
+		}
+	}
+
+	return min(1, float64(sum)/float64(n)/detailedComplexity)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,48 @@
+package thumbnailer
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func TestSpriteQuality(t *testing.T) {
+	flat := image.NewGray(image.Rect(0, 0, 32, 32))
+
+	r := rand.New(rand.NewSource(1))
+	noise := image.NewGray(image.Rect(0, 0, 32, 32))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(r.Intn(256))
+	}
+
+	tiles := func(images ...image.Image) []MediaContainer {
+		containers := make([]MediaContainer, len(images))
+		for i, img := range images {
+			containers[i].Media = &Media{image: img}
+		}
+		return containers
+	}
+
+	tt := []struct {
+		name  string
+		tiles []MediaContainer
+		opts  Options
+		want  int
+	}{
+		{"default", tiles(noise), Options{}, defaultJPEGQuality},
+		{"configured", tiles(flat), Options{JPEGQuality: 90}, 90},
+		{"adaptive flat", tiles(flat), Options{AdaptiveQuality: true}, adaptiveMinQuality},
+		{"adaptive detailed", tiles(noise), Options{AdaptiveQuality: true}, defaultJPEGQuality},
+	}
+
+	for _, tc := range tt {
+		if got := spriteQuality(tc.tiles, tc.opts); got != tc.want {
+			t.Errorf("%s: got %d; want %d", tc.name, got, tc.want)
+		}
+	}
+
+	mixed := spriteQuality(tiles(flat, noise), Options{AdaptiveQuality: true})
+	if mixed <= adaptiveMinQuality || mixed >= defaultJPEGQuality {
+		t.Errorf("mixed: got %d; want between %d and %d", mixed, adaptiveMinQuality, defaultJPEGQuality)
+	}
+}
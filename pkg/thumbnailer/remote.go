@@ -0,0 +1,166 @@
+package thumbnailer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// urlsFile lists remote media for a directory, one http(s) URL per line
+	urlsFile      = ".urls"
+	remoteTimeout = 30 * time.Second
+)
+
+var (
+	httpClient = &http.Client{Timeout: remoteTimeout}
+
+	// maxRemoteSize is the size of the largest remote media that is downloaded
+	maxRemoteSize int64 = 100 << 20
+)
+
+// remoteCache keeps downloaded remote media by urlHash,
+// so that it is fetched once for both upload and thumbnail generation.
+type remoteCache struct {
+	mu    sync.Mutex
+	media map[string][]byte
+}
+
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// urlHash returns a short hash of the URL, telling apart URLs with the same file name.
+func urlHash(u string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(u)))[:12]
+}
+
+// baseName returns the file name of the media as shown to people:
+// the path itself for local files, the last URL path segment for remote ones.
+func baseName(p string) string {
+	if !isURL(p) {
+		return p
+	}
+
+	u, err := url.Parse(p)
+	if err != nil {
+		return p
+	}
+
+	return path.Base(u.Path)
+}
+
+// localName returns the file name used for the media in the directory:
+// the path itself for local files, the last URL path segment for remote ones
+// with a hash of the URL before its extension, such as photo.0a1b2c3d4e5f.jpg,
+// so that remote media of different URLs are never stored under the same name.
+func localName(p string) string {
+	if !isURL(p) {
+		return p
+	}
+
+	name := baseName(p)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + urlHash(p) + ext
+}
+
+// readURLsFile returns URLs listed in the .urls file in the directory.
+func readURLsFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, urlsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isURL(line) {
+			return nil, fmt.Errorf("%s: not an http(s) URL: %q", urlsFile, line)
+		}
+		result = append(result, line)
+	}
+
+	return result, scanner.Err()
+}
+
+// readMedia returns the content of a local file, an archive entry or a remote URL.
+// Local reads are retried on transient errors.
+func (o Options) readMedia(dir, p string) (content []byte, err error) {
+	if !isURL(p) {
+		if archive, entry, ok := splitArchivePath(p); ok {
+			err = o.retryRead(filepath.Join(dir, archive), func() error {
+				content, err = readArchiveEntry(dir, archive, entry)
+				return err
+			})
+			return content, err
+		}
+		return o.readFile(filepath.Join(dir, p))
+	}
+
+	cache := o.remoteMedia
+	if cache == nil {
+		return fetch(p)
+	}
+
+	key := urlHash(p)
+	cache.mu.Lock()
+	content, ok := cache.media[key]
+	cache.mu.Unlock()
+	if ok {
+		return content, nil
+	}
+
+	content, err = fetch(p)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mu.Lock()
+	cache.media[key] = content
+	cache.mu.Unlock()
+
+	return content, nil
+}
+
+func fetch(u string) ([]byte, error) {
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", u, resp.Status)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		return nil, fmt.Errorf("fetching %s: not an image, content type %q", u, ct)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", u, err)
+	}
+	if int64(len(content)) > maxRemoteSize {
+		return nil, fmt.Errorf("fetching %s: larger than %d bytes", u, maxRemoteSize)
+	}
+
+	return content, nil
+}
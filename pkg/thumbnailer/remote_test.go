@@ -0,0 +1,131 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// servePNG serves a PNG image of given width at each path.
+func servePNG(t *testing.T, widths map[string]int) *httptest.Server {
+	t.Helper()
+
+	images := map[string][]byte{}
+	for p, width := range widths {
+		var b bytes.Buffer
+		if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, width, 10))); err != nil {
+			t.Fatal(err)
+		}
+		images[p] = b.Bytes()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := images[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(content) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProcessDirectoryRemoteNameCollision(t *testing.T) {
+	srv := servePNG(t, map[string]int{"/a/img.png": 20, "/b/img.png": 30})
+
+	dir := t.TempDir()
+	urls := srv.URL + "/a/img.png\n" + srv.URL + "/b/img.png\n"
+	if err := os.WriteFile(filepath.Join(dir, urlsFile), []byte(urls), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var originals []string
+	for _, key := range up.uploaded {
+		if name := filepath.Base(key); strings.HasPrefix(name, "img.") {
+			originals = append(originals, name)
+		}
+	}
+	sort.Strings(originals)
+	if len(originals) != 2 || originals[0] == originals[1] {
+		t.Errorf("got originals %q; want two different names", originals)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	widths := map[int]bool{}
+	for _, m := range media {
+		widths[m.Width] = true
+	}
+	if !widths[20] || !widths[30] {
+		t.Errorf("got media %+v; want both images", media)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := servePNG(t, map[string]int{"/img.png": 20})
+
+	if _, err := fetch(srv.URL + "/img.png"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := fetch(srv.URL + "/missing.png"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v; want an error with status 404", err)
+	}
+
+	defer func(size int64) { maxRemoteSize = size }(maxRemoteSize)
+	maxRemoteSize = 10
+	if _, err := fetch(srv.URL + "/img.png"); err == nil || !strings.Contains(err.Error(), "larger than 10 bytes") {
+		t.Errorf("got %v; want an error for size over the limit", err)
+	}
+}
+
+func TestProcessDirectoryRemoteFetchedOncePerCall(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 20, 10))); err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(b.Bytes()) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, urlsFile), []byte(srv.URL+"/img.png\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploaded and decoded from a single download
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests; want 1", n)
+	}
+
+	// downloads are not kept after the call
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{Force: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d requests after another call; want 2", n)
+	}
+}
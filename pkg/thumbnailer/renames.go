@@ -0,0 +1,90 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// detectRenames matches new files with entries of deleted files by checksum
+// and moves such entries to the new paths, keeping their thumbnails and blurhashes.
+// Only entries with recorded checksums (see Options.DetectRenames) can be matched.
+// The storage has no rename, so the file is uploaded under its new name
+// and deleted under the old one. Returns renamed media.
+func detectRenames(uploader Uploader, media []*Media, toAdd, toDelete []string, dir string, opts Options) ([]*Media, error) {
+	bySum := make(map[string]*Media)
+	for _, file := range media {
+		if file.Checksum != "" && isLocalFile(file.Path) && contains(toDelete, file.Path) {
+			bySum[file.Checksum] = file
+		}
+	}
+	if len(bySum) == 0 {
+		return nil, nil
+	}
+
+	var renamed []*Media
+	for _, path := range toAdd {
+		if !isLocalFile(path) {
+			continue
+		}
+
+		fullPath := filepath.Join(dir, path)
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %w", fullPath, err)
+		}
+		content, err := opts.readFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", fullPath, err)
+		}
+
+		sum := checksum(content)
+		file, ok := bySum[sum]
+		if !ok {
+			continue
+		}
+		delete(bySum, sum)
+
+		opts.logger().Infof("%s was renamed to %s", filepath.Join(dir, file.Path), path)
+		if err = deleteRenamed(uploader, file, dir, opts); err != nil {
+			return nil, err
+		}
+
+		file.Path = path
+		file.Size = info.Size()
+		file.ModTime = info.ModTime().UnixNano()
+
+		if err = uploadOriginal(uploader, file, dir, opts); err != nil {
+			return nil, err
+		}
+		renamed = append(renamed, file)
+	}
+
+	return renamed, nil
+}
+
+// deleteRenamed deletes the media file and its variants under their old names from the storage,
+// variants are regenerated under the new name. Local variants are kept in a dry run.
+func deleteRenamed(uploader Uploader, file *Media, dir string, opts Options) error {
+	keys := []string{file.Path}
+	for _, variant := range file.Variants {
+		if opts.dryRun() {
+			keys = append(keys, variant.Path)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, variant.Path)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %q: %w", variant.Path, err)
+		}
+		keys = append(keys, variant.Path)
+	}
+	file.Variants = nil
+
+	for _, key := range keys {
+		path := filepath.Join(dir, key)
+		if err := uploader.Delete(path); err != nil {
+			return fmt.Errorf("deleting %q: %w", key, &UploadError{Path: path, Err: err})
+		}
+	}
+
+	return nil
+}
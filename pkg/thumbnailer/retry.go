@@ -0,0 +1,63 @@
+package thumbnailer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// osReadFile is replaced in tests
+var osReadFile = os.ReadFile
+
+// retryRead calls read until it succeeds, fails with a non-transient error,
+// or Options.ReadRetries retries are used up, waiting ReadRetryBackoff
+// before the first retry and doubling it after each one.
+func (o Options) retryRead(path string, read func() error) error {
+	backoff := o.ReadRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := read()
+		if err == nil || attempt >= o.ReadRetries || !isTransient(err) {
+			return err
+		}
+
+		log.Warnf("Reading %s failed: %v, retrying in %s", path, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// readFile reads the file, retrying transient errors.
+func (o Options) readFile(path string) (content []byte, err error) {
+	err = o.retryRead(path, func() error {
+		content, err = osReadFile(path)
+		return err
+	})
+	return content, err
+}
+
+// readHead reads up to n first bytes of the file, retrying transient errors.
+func (o Options) readHead(path string, n int64) (content []byte, err error) {
+	err = o.retryRead(path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		content, err = io.ReadAll(io.LimitReader(f, n))
+		return err
+	})
+	return content, err
+}
+
+// isTransient reports whether the error may go away if the operation is retried.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,62 @@
+package thumbnailer
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReadFileRetry(t *testing.T) {
+	defer func() { osReadFile = os.ReadFile }()
+
+	tt := map[string]struct {
+		err       error
+		retries   int
+		wantCalls int
+		wantErr   bool
+	}{
+		"transient error is retried": {
+			err:       syscall.EIO,
+			retries:   2,
+			wantCalls: 2,
+		},
+		"no retries by default": {
+			err:       syscall.EIO,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		"missing file is not retried": {
+			err:       fs.ErrNotExist,
+			retries:   2,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			osReadFile = func(name string) ([]byte, error) {
+				calls++
+				if calls == 1 {
+					return nil, &fs.PathError{Op: "read", Path: name, Err: tc.err}
+				}
+				return []byte("ok"), nil
+			}
+			opts := Options{ReadRetries: tc.retries}
+
+			// media are read through the same retries
+			content, err := opts.readMedia("dir", "a.jpg")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tc.wantErr)
+			}
+			if !tc.wantErr && string(content) != "ok" {
+				t.Errorf("got content %q; want %q", content, "ok")
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("got %d calls; want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
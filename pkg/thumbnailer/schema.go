@@ -0,0 +1,95 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+// thumbsFileVersion is the current schema version of .thumbs.yml.
+// Version 1 files are a plain list of media without a version marker.
+const thumbsFileVersion = 3
+
+// thumbsFile is the persisted format of .thumbs.yml.
+type thumbsFile struct {
+	Version int      `yaml:"version"`
+	Media   []*Media `yaml:"media"`
+}
+
+// migrations upgrade media from the version (index) to the next one.
+var migrations = map[int]func(media []*Media) []*Media{
+	1: func(media []*Media) []*Media {
+		// thumb_format was added later, derive it from the sprite name
+		for _, file := range media {
+			if file.ThumbFormat != "" || file.ThumbPath == "" {
+				continue
+			}
+			path, _, _ := strings.Cut(file.ThumbPath, "?")
+			file.ThumbFormat = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+		return media
+	},
+	2: func(media []*Media) []*Media {
+		// remote media were stored without a hash of their URL in their names,
+		// drop them so that they are uploaded again under the new ones
+		var result []*Media
+		for _, file := range media {
+			if !isURL(file.Path) {
+				result = append(result, file)
+				continue
+			}
+			// the old upload is not referenced anymore, it's left to be deleted by hand
+			log.Warnf("Uploading %s again as %s, the previous upload %s is not deleted", file.Path, localName(file.Path), baseName(file.Path))
+		}
+		return result
+	},
+}
+
+// unmarshalThumbsFile decodes .thumbs.yml content of any known version
+// and migrates it to the current one.
+func unmarshalThumbsFile(content []byte) ([]*Media, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 {
+		return nil, nil // empty file
+	}
+
+	var file thumbsFile
+	switch root := node.Content[0]; root.Kind {
+	case yaml.SequenceNode:
+		file.Version = 1
+		if err := root.Decode(&file.Media); err != nil {
+			return nil, err
+		}
+	case yaml.MappingNode:
+		if err := root.Decode(&file); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected content at line %d", root.Line)
+	}
+
+	if file.Version > thumbsFileVersion {
+		return nil, fmt.Errorf("%w: %d, at most %d", ErrNewerThumbsFile, file.Version, thumbsFileVersion)
+	}
+
+	for v := file.Version; v < thumbsFileVersion; v++ {
+		if migrate, ok := migrations[v]; ok {
+			file.Media = migrate(file.Media)
+		}
+	}
+
+	return file.Media, nil
+}
+
+func marshalThumbsFile(media []*Media) ([]byte, error) {
+	return yaml.Marshal(thumbsFile{
+		Version: thumbsFileVersion,
+		Media:   media,
+	})
+}
@@ -0,0 +1,50 @@
+package thumbnailer
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnmarshalThumbsFileMigration(t *testing.T) {
+	// version 1: a plain list, without thumb_format
+	old := []byte(`- path: a.png
+  thumb: thumbnails_0.png?crc=abc
+- path: b.jpg
+  thumb: thumbnails_0.c0ffee.jpg
+`)
+
+	media, err := unmarshalThumbsFile(old)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if media[0].ThumbFormat != "png" || media[1].ThumbFormat != "jpg" {
+		t.Errorf("got formats %q, %q; want png, jpg", media[0].ThumbFormat, media[1].ThumbFormat)
+	}
+
+	path := filepath.Join(t.TempDir(), ".thumbs.yml")
+	if err = SaveThumbsFile(path, media); err != nil {
+		t.Fatalf("saving: %v", err)
+	}
+	loaded, err := LoadThumbsFile(path)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if len(loaded) != 2 || loaded[1].ThumbPath != media[1].ThumbPath {
+		t.Errorf("got %+v after round trip", loaded)
+	}
+
+	// version 2: remote media are uploaded again under names with a hash of their URL
+	media, err = unmarshalThumbsFile([]byte("version: 2\nmedia:\n- path: a.png\n- path: https://example.com/b.png\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(media) != 1 || media[0].Path != "a.png" {
+		t.Errorf("got %+v; want only a.png", media)
+	}
+
+	// newer versions are not loaded, so that they are not rewritten without their unknown fields
+	if _, err = unmarshalThumbsFile([]byte("version: 99\nmedia:\n- path: a.png\n")); !errors.Is(err, ErrNewerThumbsFile) {
+		t.Errorf("got %v for newer version; want ErrNewerThumbsFile", err)
+	}
+}
@@ -0,0 +1,118 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	socialCardFile = "og.jpg"
+
+	defaultSocialCardWidth  = 1200
+	defaultSocialCardHeight = 630
+	defaultSocialCardTiles  = 6
+
+	// gap between tiles and around them
+	socialCardGap = 8
+)
+
+var socialCardBackground = color.RGBA{R: 0x22, G: 0x22, B: 0x22, A: 0xff}
+
+// generateSocialCard writes and uploads a social preview image composed
+// of the first media of the directory in a grid, each cropped to fill its cell.
+// Tiles resized by GenerateThumbnail are reused, other images are read from disk.
+func generateSocialCard(up Uploader, media []*Media, dir string, opts Options) error {
+	width, height := opts.SocialCardWidth, opts.SocialCardHeight
+	if width <= 0 || height <= 0 {
+		width, height = defaultSocialCardWidth, defaultSocialCardHeight
+	}
+
+	n := opts.SocialCardTiles
+	if n <= 0 {
+		n = defaultSocialCardTiles
+	}
+	if len(media) < n {
+		n = len(media)
+	}
+
+	// grid with cells close to square
+	cols := int(math.Ceil(math.Sqrt(float64(n) * float64(width) / float64(height))))
+	cols = min(cols, n)
+	rows := (n + cols - 1) / cols
+
+	cellWidth := (width - socialCardGap*(cols+1)) / cols
+	cellHeight := (height - socialCardGap*(rows+1)) / rows
+	if cellWidth < 1 || cellHeight < 1 {
+		return fmt.Errorf("social card %dx%d is too small for %d tiles", width, height, n)
+	}
+
+	card := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(card, card.Bounds(), image.NewUniform(socialCardBackground), image.Point{}, draw.Src)
+
+	for i, file := range media[:n] {
+		img := file.image
+		if img == nil {
+			var err error
+			img, err = opts.readImageLimited(dir, file.Path)
+			if err != nil {
+				return fmt.Errorf("reading image: %w", err)
+			}
+		}
+
+		x := socialCardGap + (i%cols)*(cellWidth+socialCardGap)
+		y := socialCardGap + (i/cols)*(cellHeight+socialCardGap)
+		cell := image.Rect(x, y, x+cellWidth, y+cellHeight)
+
+		tile := cover(img, cellWidth, cellHeight)
+		draw.Draw(card, cell, tile, tile.Bounds().Min, draw.Over)
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, card, &jpeg.Options{Quality: 90}); err != nil {
+		return &EncodeError{Path: dir, Format: "jpg", Err: err}
+	}
+
+	path := filepath.Join(dir, socialCardFile)
+	opts.logger().Infof("Writing %s", path)
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing social card: %w", err)
+	}
+
+	if err := up.Upload(path, b.Bytes()); err != nil {
+		return fmt.Errorf("uploading social card: %w", err)
+	}
+
+	return nil
+}
+
+// cover scales the image to fill width x height and crops it around the center.
+func cover(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	scale := math.Max(
+		float64(width)/float64(bounds.Dx()),
+		float64(height)/float64(bounds.Dy()),
+	)
+
+	scaled := resize.Resize(
+		uint(math.Ceil(float64(bounds.Dx())*scale)),
+		uint(math.Ceil(float64(bounds.Dy())*scale)),
+		img,
+		resize.Lanczos3,
+	)
+
+	sb := scaled.Bounds()
+	offset := sb.Min.Add(image.Pt((sb.Dx()-width)/2, (sb.Dy()-height)/2))
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(result, result.Bounds(), scaled, offset, draw.Src)
+	return result
+}
@@ -0,0 +1,60 @@
+package thumbnailer
+
+import "sync"
+
+// Stats counts what was done across ProcessDirectory calls sharing it through Options,
+// e.g. for a summary of the run. A nil Stats doesn't count.
+type Stats struct {
+	mu          sync.Mutex
+	directories int
+	added       int
+	deleted     int
+	sprites     int
+}
+
+// StatsSnapshot holds values of Stats at some point.
+type StatsSnapshot struct {
+	Directories int // directories processed
+	Added       int // new files
+	Deleted     int // entries of deleted files removed from .thumbs.yml
+	Sprites     int // sprites written, including ones of extra sizes
+}
+
+// Snapshot returns current values of the counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return StatsSnapshot{
+		Directories: s.directories,
+		Added:       s.added,
+		Deleted:     s.deleted,
+		Sprites:     s.sprites,
+	}
+}
+
+func (s *Stats) addDirectory(added, deleted int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.directories++
+	s.added += added
+	s.deleted += deleted
+	s.mu.Unlock()
+}
+
+func (s *Stats) addSprite() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.sprites++
+	s.mu.Unlock()
+}
@@ -7,358 +7,1963 @@ import (
 	"hash/crc32"
 	"image"
 	"image/draw"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/disintegration/imageorient"
 	"github.com/nfnt/resize"
 	"golang.org/x/text/unicode/norm"
-	"gopkg.in/yaml.v3"
+
+	"github.com/alsosee/thumbnailer/pkg/contenttype"
+	"github.com/alsosee/thumbnailer/pkg/jpegenc"
+	"github.com/alsosee/thumbnailer/pkg/uploader"
 )
 
 const (
 	maxThumbSize = 324 /* 162 * 2 */
 	maxPerRow    = 10
 	maxRows      = 5
+
+	defaultSpritePrefix = "thumbnails_"
 )
 
 var ErrThumbYamlNotFound = fmt.Errorf(".thumbs.yml not found")
 
+// ErrFilenameCollision is returned when two files in a directory
+// have the same name after Unicode normalization.
+var ErrFilenameCollision = errors.New("file names collide after Unicode normalization")
+
+// ErrTooManyBatches is returned with Strict when a directory has more sprites of a format than MaxBatches.
+var ErrTooManyBatches = errors.New("too many thumbnail batches")
+
+// ErrNewerThumbsFile is returned for a .thumbs.yml of a newer schema version than supported,
+// which would lose fields unknown to this version if it was rewritten.
+// Such directories should be skipped rather than fail the whole run.
+var ErrNewerThumbsFile = errors.New("thumbs file schema version is newer than supported")
+
 // Media struct for items in .thumbs.yml file.
 type Media struct {
-	Path                string
-	Width               int    `yaml:"width,omitempty"`
-	Height              int    `yaml:"height,omitempty"`
-	ThumbPath           string `yaml:"thumb,omitempty"`
-	ThumbXOffset        int    `yaml:"thumb_x,omitempty"`
-	ThumbYOffset        int    `yaml:"thumb_y,omitempty"`
-	ThumbWidth          int    `yaml:"thumb_width,omitempty"`
-	ThumbHeight         int    `yaml:"thumb_height,omitempty"`
-	ThumbTotalWidth     int    `yaml:"thumb_total_width,omitempty"`
-	ThumbTotalHeight    int    `yaml:"thumb_total_height,omitempty"`
-	Blurhash            string `yaml:"blurhash,omitempty"`
-	BlurhashImageBase64 string `yaml:"blurhash_image_base64,omitempty"`
+	Path                string  `json:"path"`
+	Width               int     `yaml:"width,omitempty" json:"width,omitempty"`
+	Height              int     `yaml:"height,omitempty" json:"height,omitempty"`
+	AspectRatio         float64 `yaml:"aspect_ratio,omitempty" json:"aspect_ratio,omitempty"` // Width / Height
+	ThumbPath           string  `yaml:"thumb,omitempty" json:"thumb,omitempty"`
+	ThumbFormat         string  `yaml:"thumb_format,omitempty" json:"thumb_format,omitempty"`
+	ThumbContentType    string  `yaml:"thumb_content_type,omitempty" json:"thumb_content_type,omitempty"`
+	ThumbXOffset        int     `yaml:"thumb_x,omitempty" json:"thumb_x,omitempty"`
+	ThumbYOffset        int     `yaml:"thumb_y,omitempty" json:"thumb_y,omitempty"`
+	ThumbWidth          int     `yaml:"thumb_width,omitempty" json:"thumb_width,omitempty"`
+	ThumbHeight         int     `yaml:"thumb_height,omitempty" json:"thumb_height,omitempty"`
+	ThumbTotalWidth     int     `yaml:"thumb_total_width,omitempty" json:"thumb_total_width,omitempty"`
+	ThumbTotalHeight    int     `yaml:"thumb_total_height,omitempty" json:"thumb_total_height,omitempty"`
+	Blurhash            string  `yaml:"blurhash,omitempty" json:"blurhash,omitempty"`
+	BlurhashImageBase64 string  `yaml:"blurhash_image_base64,omitempty" json:"blurhash_image_base64,omitempty"`
+	Lat                 float64 `yaml:"lat,omitempty" json:"lat,omitempty"`
+	Lng                 float64 `yaml:"lng,omitempty" json:"lng,omitempty"`
+
+	// Height of the strip with the file name under the tile, see Options.ContactSheet
+	ThumbLabelHeight int `yaml:"thumb_label_height,omitempty" json:"thumb_label_height,omitempty"`
+
+	// Resize mode of the tile, empty for ResizeBox, see Options.ResizeMode
+	ThumbResizeMode ResizeMode `yaml:"thumb_resize_mode,omitempty" json:"thumb_resize_mode,omitempty"`
+
+	// Position of the tile within its row, empty for AlignTop, see Options.VerticalAlign
+	ThumbVerticalAlign VerticalAlign `yaml:"thumb_vertical_align,omitempty" json:"thumb_vertical_align,omitempty"`
+
+	// Dimensions of the uploaded file if it was downscaled, see Options.MaxOriginalDimension
+	StoredWidth  int `yaml:"stored_width,omitempty" json:"stored_width,omitempty"`
+	StoredHeight int `yaml:"stored_height,omitempty" json:"stored_height,omitempty"`
+
+	// URLs of the uploaded file and sprite, see Options.BaseURL
+	URL      string `yaml:"url,omitempty" json:"url,omitempty"`
+	ThumbURL string `yaml:"thumb_url,omitempty" json:"thumb_url,omitempty"`
+
+	// Alt text from the photo.jpg.txt sidecar file
+	Alt string `yaml:"alt,omitempty" json:"alt,omitempty"`
+
+	// Set when the sidecar file with Alt was uploaded, see Options.UploadAltText
+	AltUploaded bool `yaml:"alt_uploaded,omitempty" json:"alt_uploaded,omitempty"`
+
+	// Content checksum, recalculated only if size or modification time (in ns) change
+	Size     int64  `yaml:"size,omitempty" json:"size,omitempty"`
+	ModTime  int64  `yaml:"mtime,omitempty" json:"mtime,omitempty"`
+	Checksum string `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+
+	// Source is an animated PNG, only its first frame is used for thumbnails
+	Animated bool `yaml:"animated,omitempty" json:"animated,omitempty"`
+
+	// Thumbnails in additional sprites, keyed by their size
+	Thumbs map[int]Thumb `yaml:"thumbs,omitempty" json:"thumbs,omitempty"`
+
+	// Standalone downscaled copies, narrowest first, see Options.VariantWidths
+	Variants []Variant `yaml:"variants,omitempty" json:"variants,omitempty"`
 
 	// Temporary image.Image field used to generate thumbnails
 	image image.Image `yaml:"-"`
+
+	// Temporary images resized to additional sizes
+	sizedImages map[int]image.Image `yaml:"-"`
+
+	// Set when blurhash was calculated during this run
+	blurhashUpdated bool `yaml:"-"`
+}
+
+// setDimensions sets original dimensions of the media and its aspect ratio.
+func (m *Media) setDimensions(width, height int) {
+	m.Width = width
+	m.Height = height
+	m.AspectRatio = 0
+	if height != 0 {
+		m.AspectRatio = float64(width) / float64(height)
+	}
+}
+
+// setThumbFormat sets the format of sprites of the media
+// and the MIME type they are uploaded with.
+func (m *Media) setThumbFormat(format string) {
+	m.ThumbFormat = format
+	m.ThumbContentType = contenttype.ByName("." + format)
+}
+
+// clearThumbs removes references to sprites from the media.
+func (m *Media) clearThumbs() {
+	m.ThumbPath = ""
+	m.ThumbFormat = ""
+	m.ThumbContentType = ""
+	m.ThumbXOffset = 0
+	m.ThumbYOffset = 0
+	m.ThumbWidth = 0
+	m.ThumbHeight = 0
+	m.ThumbTotalWidth = 0
+	m.ThumbTotalHeight = 0
+	m.ThumbLabelHeight = 0
+	m.ThumbResizeMode = ""
+	m.ThumbVerticalAlign = ""
+	m.Thumbs = nil
+}
+
+// Thumb describes a tile in a sprite of an additional size.
+type Thumb struct {
+	Path        string `yaml:"thumb" json:"thumb"`
+	XOffset     int    `yaml:"thumb_x,omitempty" json:"thumb_x,omitempty"`
+	YOffset     int    `yaml:"thumb_y,omitempty" json:"thumb_y,omitempty"`
+	Width       int    `yaml:"thumb_width" json:"thumb_width"`
+	Height      int    `yaml:"thumb_height" json:"thumb_height"`
+	TotalWidth  int    `yaml:"thumb_total_width" json:"thumb_total_width"`
+	TotalHeight int    `yaml:"thumb_total_height" json:"thumb_total_height"`
+}
+
+// Options controls how ProcessDirectory handles a directory.
+type Options struct {
+	// Force thumbnail generation even if existing thumbnails are up to date
+	Force bool
+
+	// Read GPS coordinates from EXIF data into Media
+	ExtractGPS bool
+
+	// Keep entries of files that are absent locally, e.g. in a sparse checkout,
+	// instead of removing them from .thumbs.yml; requires ContentAddressed,
+	// so that sprites with tiles of absent files are not overwritten
+	NoPrune bool
+
+	// Process images inside zip archives in the directory as "<archive>.zip/<entry>"
+	ReadArchives bool
+
+	// Don't generate sprites, only upload originals and compute
+	// their dimensions and blurhashes; media have no thumb fields
+	SkipThumbnails bool
+
+	// Upload alt text sidecar files (photo.jpg.txt) when their text changes
+	UploadAltText bool
+
+	// Store URLs of originals and sprites under this base URL (e.g. a custom domain of the bucket)
+	// in Media, next to their paths. Object keys are relative to MediaDir.
+	BaseURL  string
+	MediaDir string
+
+	// Downscale JPEG and PNG originals with a longer side before uploading them,
+	// thumbnails are still generated from local files; 0 uploads them as is
+	MaxOriginalDimension int
+
+	// Detect changed files by their checksums, re-uploading them
+	// and regenerating their thumbnails and blurhashes
+	DetectChanges bool
+
+	// Recalculate checksums even if size and modification time of files didn't change
+	ForceRehash bool
+
+	// Treat a new file with the same checksum as a deleted one as its rename,
+	// keeping its thumbnail and blurhash. Checksums of all local files are recorded.
+	DetectRenames bool
+
+	// Checksums (as in Media.Checksum) of files to skip, such as known placeholder images
+	Denylist map[string]bool
+
+	// Only process images with width/height within these limits, 0 for no limit,
+	// e.g. 2 as minimum for a panorama gallery; other images are left out of .thumbs.yml
+	MinAspectRatio float64
+	MaxAspectRatio float64
+
+	// Put a single tile of visually identical images of a sprite into it,
+	// such as an original and its rotated copy. Images are identical if
+	// their perceptual hashes differ in at most DedupThreshold bits of 64.
+	Dedup          bool
+	DedupThreshold int
+
+	// Sort key used to order tiles in a sprite, height by default
+	SortBy SortBy
+
+	// How images are resized into tiles, fit by default
+	ThumbMode ThumbMode
+
+	// How sizes of tiles of ThumbModeFit are calculated, ResizeBox by default
+	ResizeMode ResizeMode
+
+	// Position of tiles shorter than their row, top by default
+	VerticalAlign VerticalAlign
+
+	// File name of an image to put into the first tile of its sprite,
+	// regardless of SortBy; other tiles are sorted as usual
+	Cover string
+
+	// Process files whose names start with a dot, skipped by default
+	IncludeHidden bool
+
+	// Prefix of generated sprite file names, "thumbnails_" by default;
+	// files with this prefix are not treated as media
+	SpritePrefix string
+
+	// Embed sprite checksum into its file name instead of a query string
+	ContentAddressed bool
+
+	// Reference sprites by bare file names, without "?crc=" query string
+	NoCRCSuffix bool
+
+	// Number of images per sprite, maxPerRow*maxRows by default
+	BatchSize int
+
+	// Warn about directories with more sprites of a format than this, 0 for no limit
+	MaxBatches int
+
+	// Fail instead of warning about directories exceeding MaxBatches
+	Strict bool
+
+	// Put new files into new sprites after existing ones, which are never regenerated,
+	// unless Force is set. Tiles of deleted files are left in their sprites.
+	AppendOnly bool
+
+	// Regenerate only the sprite of this batch number, e.g. 3 for thumbnails_3.jpg,
+	// from the files referencing it; other sprites and their files are left as is,
+	// and the directory is not scanned for new or deleted files
+	Batch *int
+
+	// Abort with ErrLowDiskSpace before writing sprites
+	// if the directory file system has less bytes available, 0 for no check
+	MinFreeSpace int64
+
+	// Maximum bytes of full-size images decoded at the same time, 0 for no limit
+	DecodeMemoryBudget int64
+
+	// Limits the number of images decoded at the same time across all directories
+	DecodeLimiter *DecodeLimiter
+
+	// Number of retries of local file reads failing with transient errors,
+	// such as EIO or ETIMEDOUT on network file systems, 0 for none
+	ReadRetries int
+
+	// Wait before the first read retry, doubled after each one
+	ReadRetryBackoff time.Duration
+
+	// Counts processed directories, files and sprites across all directories
+	Stats *Stats
+
+	// Sizes of additional sprites generated next to the default one,
+	// e.g. 648 for thumbnails_0_648.jpg
+	ExtraSizes []int
+
+	// Sprite format ("jpg" or "png") used for all images regardless of their format;
+	// if empty, a separate set of sprites is generated for each format
+	SpriteFormat string
+
+	// Sprite format ("jpg", "jpeg" or "png") for file extensions, e.g. ".jpe": "jpg",
+	// overriding the default: ".png" files go to "png" sprites, the rest to "jpg"
+	FormatGroups map[string]string
+
+	// Sprite format ("jpg" or "png") used instead of formats of FormatGroups
+	// without a sprite encoder; if empty, such formats are an error
+	FallbackFormat string
+
+	// Sprite formats whose images get a thumbnail file each, e.g. logo_thumb.png,
+	// instead of being packed into sprites
+	IndividualFormats map[string]bool
+
+	// Quality of JPEG sprites, 95 by default
+	JPEGQuality int
+
+	// Chroma subsampling of JPEG sprites, 4:2:0 by default;
+	// 4:4:4 keeps saturated colored edges sharp at the cost of size
+	JPEGSubsampling jpegenc.Subsampling
+
+	// Lower JPEG quality down to 80 for sprites of simple, flat images,
+	// based on the average level of detail of their tiles
+	AdaptiveQuality bool
+
+	// Compress PNG sprites harder and pass them through oxipng if it's installed
+	OptimizePNG bool
+
+	// Encode PNG sprites with fixed settings, so that the same tiles
+	// always give the same bytes and checksums, regardless of the Go version
+	ReproduciblePNG bool
+
+	// Image drawn over each tile, scaled relative to the tile size
+	Watermark image.Image
+
+	// Watermark position: "top-left", "top-right", "bottom-left", "bottom-right" (default) or "center"
+	WatermarkPosition string
+
+	// Recalculate blurhashes and their preview images.
+	// Without Force, sprites are not regenerated unless files were added or deleted.
+	ForceBlurhash       bool
+	ForceBlurhashImages bool
+
+	// Format of blurhash preview images, "jpg" (default) or "webp"
+	BlurhashImageFormat string
+
+	// Size of the longer side of blurhash preview images, 32 if 0
+	BlurhashImageSize int
+
+	// If set, a unified diff of .thumbs.yml is written to it instead of saving the file,
+	// and nothing is written, removed or uploaded: sprites are only encoded to get their checksums.
+	Diff io.Writer
+
+	// If set, media of each directory is written to it as JSON Lines once the directory is saved,
+	// with "dir" relative to MediaDir
+	MediaStream io.Writer
+
+	// If set, called with media of each directory once the directory is saved,
+	// so that they don't have to be read back from the thumbs file
+	OnMedia func(dir string, media []*Media) error
+
+	// Write .thumbs.yml.gz instead of .thumbs.yml, removing the plain one
+	CompressThumbsFile bool
+
+	// Leave blurhash of images with a side shorter than this empty, 0 to always calculate it
+	BlurhashMinSize int
+
+	// Widths of standalone downscaled copies (e.g. photo.480w.jpg) of JPEG and PNG
+	// landscape images at least VariantMinWidth wide, for srcset of responsive images
+	VariantWidths   []int
+	VariantMinWidth int
+
+	// Draw file names under tiles of sprites, for reviewing them
+	ContactSheet bool
+
+	// Directory to also write each resized tile to as tile_<name>.png, for debugging
+	DumpTilesDir string
+
+	// Write animated preview.webp cycling through directory images,
+	// showing each for PreviewFrameDuration, 500ms by default
+	AnimatedPreview      bool
+	PreviewFrameDuration time.Duration
+
+	// Write og.jpg social preview of up to SocialCardTiles images,
+	// 1200x630 with 6 tiles by default
+	SocialCard       bool
+	SocialCardWidth  int
+	SocialCardHeight int
+	SocialCardTiles  int
+
+	// Image favicon.ico is generated from by GenerateFavicon;
+	// favicon.ico files are only treated as generated if it is set
+	FaviconSource string
+
+	// Log why batches, blurhashes and previews are regenerated or skipped
+	VerboseDiff bool
+
+	// sprites referenced by entries of absent files kept with NoPrune,
+	// they must not be deleted as stale
+	keepSprites map[string]bool
+
+	// remote media downloaded during a ProcessDirectory call, nil outside of it
+	remoteMedia *remoteCache
+
+	// Logger to log to, the default one if nil; ProcessDirectory adds
+	// a "dir" field to it, so that logs of concurrent calls can be told apart
+	Logger *log.Logger
+}
+
+func (o Options) spritePrefix() string {
+	if o.SpritePrefix == "" {
+		return defaultSpritePrefix
+	}
+	return o.SpritePrefix
+}
+
+// onMedia calls OnMedia with saved media of the directory, if it is set.
+func (o Options) onMedia(dir string, media []*Media) error {
+	if o.OnMedia == nil {
+		return nil
+	}
+	if err := o.OnMedia(dir, media); err != nil {
+		return fmt.Errorf("handling media: %w", err)
+	}
+	return nil
+}
+
+// logger returns Logger, or the default logger if it is not set.
+func (o Options) logger() *log.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return log.Default()
+}
+
+// dryRun reports whether files of directories are left as they are, see Diff.
+func (o Options) dryRun() bool {
+	return o.Diff != nil
+}
+
+// debugf logs decisions made while processing a directory if VerboseDiff is set.
+func (o Options) debugf(format string, args ...any) {
+	if o.VerboseDiff {
+		o.logger().Infof(format, args...)
+	}
+}
+
+// Updated describes a media file whose thumbnail was regenerated.
+type Updated struct {
+	Path string // path to the media file
+	Hash string // CRC32 checksum of the new thumbnail sprite
 }
 
 type Uploader interface {
 	Upload(key string, body []byte) error
+	Delete(key string) error
+}
+
+// FileUploader is implemented by uploaders that can stream the file at path
+// to key instead of holding its content in memory.
+type FileUploader interface {
+	UploadFile(key, path string) error
+}
+
+// uploadFile uploads the file at path to key, streaming it if uploader supports it.
+func uploadFile(uploader Uploader, key, path string) error {
+	if f, ok := uploader.(FileUploader); ok {
+		return f.UploadFile(key, path)
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return uploader.Upload(key, body)
+}
+
+// MediaContainer is a wrapper for Photo struct, used for sorting,
+// so that references are not swapped and still can be modified.
+type MediaContainer struct {
+	Media *Media
+}
+
+type ByThumbHeightDesc []MediaContainer
+
+func (a ByThumbHeightDesc) Len() int      { return len(a) }
+func (a ByThumbHeightDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByThumbHeightDesc) Less(i, j int) bool {
+	return a[i].Media.ThumbHeight > a[j].Media.ThumbHeight
+}
+
+type ByThumbWidthDesc []MediaContainer
+
+func (a ByThumbWidthDesc) Len() int      { return len(a) }
+func (a ByThumbWidthDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByThumbWidthDesc) Less(i, j int) bool {
+	return a[i].Media.ThumbWidth > a[j].Media.ThumbWidth
+}
+
+type ByThumbAreaDesc []MediaContainer
+
+func (a ByThumbAreaDesc) Len() int      { return len(a) }
+func (a ByThumbAreaDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByThumbAreaDesc) Less(i, j int) bool {
+	return a[i].Media.ThumbWidth*a[i].Media.ThumbHeight >
+		a[j].Media.ThumbWidth*a[j].Media.ThumbHeight
 }
 
-// MediaContainer is a wrapper for Photo struct, used for sorting,
-// so that references are not swapped and still can be modified.
-type MediaContainer struct {
-	Media *Media
+// ByThumbAspectDesc sorts from the widest to the tallest thumbnail.
+type ByThumbAspectDesc []MediaContainer
+
+func (a ByThumbAspectDesc) Len() int      { return len(a) }
+func (a ByThumbAspectDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByThumbAspectDesc) Less(i, j int) bool {
+	// compare w1/h1 > w2/h2 without division
+	return a[i].Media.ThumbWidth*a[j].Media.ThumbHeight >
+		a[j].Media.ThumbWidth*a[i].Media.ThumbHeight
+}
+
+// ByPath keeps tiles in file name order, so that the sprite reads
+// left-to-right, top-to-bottom by name, at the cost of worse packing.
+type ByPath []MediaContainer
+
+func (a ByPath) Len() int      { return len(a) }
+func (a ByPath) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByPath) Less(i, j int) bool {
+	return a[i].Media.Path < a[j].Media.Path
+}
+
+// SortBy is a sort key used to order tiles before packing them into a sprite.
+type SortBy string
+
+const (
+	SortByHeight SortBy = "height"
+	SortByWidth  SortBy = "width"
+	SortByArea   SortBy = "area"
+	SortByAspect SortBy = "aspect"
+	SortByName   SortBy = "name"
+)
+
+// pinCover moves the container of the cover image, if any, to the front
+// of the sorted containers, keeping the order of the others.
+func pinCover(containers []MediaContainer, cover string) {
+	if cover == "" {
+		return
+	}
+	for i, container := range containers {
+		if container.Media.Path == cover {
+			copy(containers[1:i+1], containers[:i])
+			containers[0] = container
+			return
+		}
+	}
+}
+
+func (s SortBy) sorter(containers []MediaContainer) sort.Interface {
+	switch s {
+	case SortByWidth:
+		return ByThumbWidthDesc(containers)
+	case SortByArea:
+		return ByThumbAreaDesc(containers)
+	case SortByAspect:
+		return ByThumbAspectDesc(containers)
+	case SortByName:
+		return ByPath(containers)
+	default:
+		return ByThumbHeightDesc(containers)
+	}
+}
+
+// ThumbMode is a way images are resized into sprite tiles.
+type ThumbMode string
+
+const (
+	// ThumbModeFit keeps the aspect ratio, with the longer side of a tile maxThumbSize.
+	ThumbModeFit ThumbMode = "fit"
+	// ThumbModeStretch distorts images to maxThumbSize squares, laying them out in a regular grid.
+	ThumbModeStretch ThumbMode = "stretch"
+)
+
+// ResizeMode is a way sizes of tiles keeping the aspect ratio of images are calculated.
+type ResizeMode string
+
+const (
+	// ResizeBox fits images into a size×size box: images smaller than it are kept as they are,
+	// and the shorter side of larger ones is rounded down.
+	ResizeBox ResizeMode = "box"
+	// ResizeLongEdge scales images so that their longer side is exactly size, enlarging smaller ones,
+	// with the shorter side rounded to the nearest pixel.
+	ResizeLongEdge ResizeMode = "long-edge"
+)
+
+// recorded returns the mode as recorded on media: empty for the default ResizeBox,
+// so that thumbs files written before it was recorded are up to date.
+func (r ResizeMode) recorded() ResizeMode {
+	if r != ResizeLongEdge {
+		return ""
+	}
+	return r
+}
+
+// VerticalAlign is a position of tiles within rows of a sprite taller than them.
+type VerticalAlign string
+
+const (
+	AlignTop    VerticalAlign = "top"
+	AlignCenter VerticalAlign = "center"
+	AlignBottom VerticalAlign = "bottom"
+)
+
+// recorded returns the alignment as recorded on media: empty for the default AlignTop,
+// so that thumbs files written before it was recorded are up to date.
+func (a VerticalAlign) recorded() VerticalAlign {
+	if a != AlignCenter && a != AlignBottom {
+		return ""
+	}
+	return a
+}
+
+// align moves tiles shorter than their row down within it;
+// tiles of a row are the ones with the same top, as placed by Layout.
+func (a VerticalAlign) align(tiles []image.Rectangle) {
+	if a != AlignCenter && a != AlignBottom {
+		return
+	}
+
+	rowHeights := make(map[int]int)
+	for _, tile := range tiles {
+		rowHeights[tile.Min.Y] = max(rowHeights[tile.Min.Y], tile.Dy())
+	}
+
+	for i, tile := range tiles {
+		space := rowHeights[tile.Min.Y] - tile.Dy()
+		if a == AlignCenter {
+			space /= 2
+		}
+		tiles[i] = tile.Add(image.Pt(0, space))
+	}
+}
+
+// resize returns the image resized to fit into or fill a size×size square.
+func (m ThumbMode) resize(img image.Image, size int, r ResizeMode) image.Image {
+	if m == ThumbModeStretch {
+		return resize.Resize(uint(size), uint(size), img, resize.Lanczos3)
+	}
+	if r == ResizeLongEdge {
+		width, height := m.size(img.Bounds().Dx(), img.Bounds().Dy(), size, r)
+		if width == img.Bounds().Dx() && height == img.Bounds().Dy() {
+			return img
+		}
+		return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+	}
+	return resize.Thumbnail(uint(size), uint(size), img, resize.Lanczos3)
+}
+
+// size returns the size resize resizes an image of given size to.
+func (m ThumbMode) size(width, height, size int, r ResizeMode) (int, int) {
+	switch {
+	case m == ThumbModeStretch:
+		return size, size
+	case r == ResizeLongEdge:
+		return longEdgeSize(width, height, size)
+	default:
+		return thumbSize(width, height, size)
+	}
+}
+
+// longEdgeSize returns the size of an image scaled to have the longer side of size.
+func longEdgeSize(width, height, size int) (int, int) {
+	if width >= height {
+		return size, max(1, (height*size+width/2)/width)
+	}
+	return max(1, (width*size+height/2)/height), size
+}
+
+// matches reports whether the tile of the media was resized in this mode.
+func (m ThumbMode) matches(file *Media) bool {
+	square := file.ThumbWidth == maxThumbSize && file.ThumbHeight == maxThumbSize
+	if m == ThumbModeStretch {
+		return square
+	}
+	return !square || file.Width == file.Height || file.Width == 0
+}
+
+// LoadThumbsFile reads media from the thumbs file,
+// or from its gzipped (.thumbs.yml.gz) or plain counterpart if it doesn't exist.
+func LoadThumbsFile(path string) ([]*Media, error) {
+	fileContent, err := readThumbsFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrThumbYamlNotFound
+	}
+	if err != nil {
+		return nil, &ThumbsFileError{Path: path, Err: fmt.Errorf("reading file: %w", err)}
+	}
+
+	media, err := unmarshalThumbsFile(fileContent)
+	if err != nil {
+		return nil, &ThumbsFileError{Path: path, Err: fmt.Errorf("unmarshaling file: %w", err)}
+	}
+
+	return media, nil
+}
+
+// SaveThumbsFile writes media to the thumbs file, gzipped if path ends with .gz.
+// Its plain or gzipped counterpart is removed.
+func SaveThumbsFile(path string, media []*Media) error {
+	if len(media) == 0 {
+		return nil
+	}
+
+	fileContent, err := marshalThumbsFile(media)
+	if err != nil {
+		return &ThumbsFileError{Path: path, Err: fmt.Errorf("marshaling media: %w", err)}
+	}
+
+	if err = writeThumbsFile(path, fileContent); err != nil {
+		return &ThumbsFileError{Path: path, Err: fmt.Errorf("writing file: %w", err)}
+	}
+
+	return nil
+}
+
+func ProcessDirectory(dir string, up Uploader, opts Options) ([]Updated, error) {
+	opts.Logger = opts.logger().With("dir", dir)
+	opts.logger().Infof("Processing %s", dir)
+
+	// downloads are kept until the directory is done, not for the whole run
+	opts.remoteMedia = &remoteCache{media: map[string][]byte{}}
+
+	if isLocalOnly(dir) {
+		opts.logger().Infof("Not uploading files of %s, it has a %s file", dir, noUploadFile)
+		up = uploader.NewNoOp()
+	}
+	if opts.Diff != nil {
+		up = uploader.NewNoOp()
+	}
+
+	opts.FormatGroups = normalizeFormatGroups(opts.FormatGroups)
+	if err := validateFormatGroups(opts.FormatGroups, opts.FallbackFormat); err != nil {
+		return nil, err
+	}
+	if opts.NoPrune && !opts.ContentAddressed {
+		return nil, errors.New("keeping entries of absent files requires content addressed thumbnails")
+	}
+
+	thumbsFile := opts.thumbsFilePath(dir)
+
+	if opts.Batch != nil {
+		return processBatch(dir, thumbsFile, up, opts)
+	}
+
+	// look for .thumb.yml file
+	media, err := LoadThumbsFile(thumbsFile)
+	if err != nil && !errors.Is(err, ErrThumbYamlNotFound) {
+		return nil, fmt.Errorf("loading thumbs file: %w", err)
+	}
+
+	// scan directory for all image files
+	files, err := ScanDirectory(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("scanning directory: %w", err)
+	}
+
+	if opts.ReadArchives {
+		entries, err := scanArchives(dir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("scanning archives: %w", err)
+		}
+		files = append(files, entries...)
+		sort.Strings(files)
+	}
+
+	files, err = filterDenied(files, media, dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("checking denylist: %w", err)
+	}
+
+	files, err = filterAspectRatio(files, media, dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("checking aspect ratios: %w", err)
+	}
+
+	toAdd, toDelete := diff(media, files)
+	opts.debugf("%s: %d new file(s) %q, %d deleted file(s) %q", dir, len(toAdd), toAdd, len(toDelete), toDelete)
+
+	// entries of absent files are set aside as they are and saved back,
+	// the rest of media is processed as if they were not there
+	var absent []*Media
+	if opts.NoPrune && len(toDelete) > 0 {
+		for _, file := range media {
+			if contains(toDelete, file.Path) {
+				absent = append(absent, file)
+			}
+		}
+		opts.debugf("%s: keeping %d entries of absent files", dir, len(absent))
+		opts.keepSprites = spritePaths(absent)
+		toDelete = nil
+	}
+
+	// fail before anything is uploaded
+	if err = checkBatchCount(withNewFiles(media, files), dir, opts); err != nil {
+		return nil, err
+	}
+
+	// upload originals and thumbnails in the background,
+	// while thumbnails are being generated
+	async := newAsyncUploader(up)
+	defer async.Wait() //nolint:errcheck // checked below, this covers early returns
+
+	if opts.DetectRenames && len(toAdd) > 0 && len(toDelete) > 0 {
+		renamed, err := detectRenames(async, media, toAdd, toDelete, dir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("detecting renames: %w", err)
+		}
+		if len(renamed) > 0 {
+			toAdd, toDelete = diff(media, files)
+		}
+	}
+
+	// remember sprites and variants before files are deleted or changed, to clean up stale ones
+	previousSprites := spritePaths(media)
+	previousVariants := variantPaths(media)
+
+	media, err = UploadNewMedia(async, media, files, dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("uploading new media: %w", err)
+	}
+
+	if err = readAltTexts(async, media, dir, opts); err != nil {
+		return nil, fmt.Errorf("reading alt texts: %w", err)
+	}
+
+	if opts.DetectChanges {
+		changed, err := detectChanges(media, dir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("detecting changes: %w", err)
+		}
+
+		for _, file := range changed {
+			if err = uploadOriginal(async, file, dir, opts); err != nil {
+				return nil, err
+			}
+		}
+	} else if opts.DetectRenames || len(opts.Denylist) > 0 {
+		if err = recordChecksums(media, dir, opts); err != nil {
+			return nil, fmt.Errorf("recording checksums: %w", err)
+		}
+	}
+
+	if opts.ExtractGPS {
+		extractGPS(media, dir, opts)
+	}
+
+	mediaGrouped := applyFallbackFormat(groupByType(media, opts.FormatGroups), opts)
+	if opts.SpriteFormat != "" {
+		mediaGrouped = map[string][]*Media{opts.SpriteFormat: media}
+	}
+
+	var updatedGrouped []Updated
+
+	if opts.SkipThumbnails {
+		mediaGrouped = nil
+		for _, file := range media {
+			file.clearThumbs()
+		}
+	}
+
+	if len(mediaGrouped) > 0 {
+		if err = checkFreeSpace(dir, opts.MinFreeSpace); err != nil {
+			return nil, err
+		}
+	}
+
+	for format, media := range mediaGrouped {
+		updated, err := GenerateThumbnails(async, media, dir, format, opts)
+		if err != nil {
+			return nil, fmt.Errorf("generating thumbnails: %w", err)
+		}
+
+		updatedGrouped = append(updatedGrouped, updated...)
+	}
+
+	// with SkipThumbnails, sprites are not referenced anymore and are deleted too
+	if opts.ContentAddressed {
+		if err = deleteStaleSprites(async, dir, previousSprites, spritePaths(media), opts); err != nil {
+			return nil, fmt.Errorf("deleting stale thumbnails: %w", err)
+		}
+	}
+
+	// entries from older .thumbs.yml files in skipped batches have no dimensions
+	if err = backfillDimensions(media, dir, opts); err != nil {
+		return nil, fmt.Errorf("reading dimensions: %w", err)
+	}
+
+	if err = updateBlurhashes(media, dir, opts); err != nil {
+		return nil, fmt.Errorf("updating blurhashes: %w", err)
+	}
+
+	if err = updateVariants(async, media, dir, opts); err != nil {
+		return nil, fmt.Errorf("updating variants: %w", err)
+	}
+	if err = deleteStaleSprites(async, dir, previousVariants, variantPaths(media), opts); err != nil {
+		return nil, fmt.Errorf("deleting stale variants: %w", err)
+	}
+
+	if opts.AnimatedPreview && !opts.dryRun() && len(media) > 0 && outdated(dir, previewFile, updatedGrouped, opts) {
+		if err = generatePreview(async, media, dir, opts); err != nil {
+			return nil, fmt.Errorf("generating preview: %w", err)
+		}
+	}
+
+	if opts.SocialCard && !opts.dryRun() && len(media) > 0 && outdated(dir, socialCardFile, updatedGrouped, opts) {
+		if err = generateSocialCard(async, media, dir, opts); err != nil {
+			return nil, fmt.Errorf("generating social card: %w", err)
+		}
+	}
+
+	if err = async.Wait(); err != nil {
+		return nil, fmt.Errorf("uploading: %w", err)
+	}
+
+	media = append(media, absent...)
+
+	if err = setURLs(media, dir, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Diff != nil {
+		if err = writeThumbsFileDiff(opts.Diff, thumbsFile, media); err != nil {
+			return nil, fmt.Errorf("comparing media: %w", err)
+		}
+		return updatedGrouped, nil
+	}
+
+	if err = SaveThumbsFile(thumbsFile, media); err != nil {
+		return nil, fmt.Errorf("saving media: %w", err)
+	}
+	if err = opts.onMedia(dir, media); err != nil {
+		return nil, err
+	}
+
+	if err = streamMedia(media, dir, opts); err != nil {
+		return nil, fmt.Errorf("streaming media: %w", err)
+	}
+
+	opts.Stats.addDirectory(len(toAdd), len(toDelete))
+
+	return updatedGrouped, nil
+}
+
+// processBatch regenerates the sprite of opts.Batch from the media referencing it
+// and updates their tiles in .thumbs.yml. Nothing else is uploaded or updated:
+// new, deleted or changed files are left for the next full run.
+func processBatch(dir, thumbsFile string, up Uploader, opts Options) ([]Updated, error) {
+	media, err := LoadThumbsFile(thumbsFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading thumbs file: %w", err)
+	}
+
+	previous := spritePaths(media)
+
+	if err = checkBatchCount(media, dir, opts); err != nil {
+		return nil, err
+	}
+
+	grouped := map[string][]*Media{}
+	for _, file := range media {
+		if opts.SkipThumbnails {
+			file.clearThumbs()
+			continue
+		}
+		if file.ThumbPath != "" {
+			format := spriteFormat(file.ThumbPath)
+			grouped[format] = append(grouped[format], file)
+		}
+	}
+
+	var updatedGrouped []Updated
+	for format, media := range grouped {
+		updated, err := GenerateThumbnails(up, media, dir, format, opts)
+		if err != nil {
+			return nil, fmt.Errorf("generating thumbnails: %w", err)
+		}
+		updatedGrouped = append(updatedGrouped, updated...)
+	}
+
+	if opts.ContentAddressed {
+		if err = deleteStaleSprites(up, dir, previous, spritePaths(media), opts); err != nil {
+			return nil, fmt.Errorf("deleting stale thumbnails: %w", err)
+		}
+	}
+
+	if err = setURLs(media, dir, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Diff != nil {
+		if err = writeThumbsFileDiff(opts.Diff, thumbsFile, media); err != nil {
+			return nil, fmt.Errorf("comparing media: %w", err)
+		}
+		return updatedGrouped, nil
+	}
+
+	if err = SaveThumbsFile(thumbsFile, media); err != nil {
+		return nil, fmt.Errorf("saving media: %w", err)
+	}
+	if err = opts.onMedia(dir, media); err != nil {
+		return nil, err
+	}
+
+	return updatedGrouped, nil
+}
+
+// outdated reports whether a file composed of directory images
+// is missing or needs to be regenerated because thumbnails were updated.
+func outdated(dir, name string, updated []Updated, opts Options) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	if len(updated) > 0 || os.IsNotExist(err) {
+		opts.debugf("%s: regenerating %s, %d thumbnail(s) updated, missing: %t", dir, name, len(updated), os.IsNotExist(err))
+		return true
+	}
+	return false
+}
+
+func UploadNewMedia(
+	uploader Uploader,
+	media []*Media,
+	files []string,
+	dir string,
+	opts Options,
+) ([]*Media, error) {
+	toAdd, toDelete := diff(media, files)
+
+	for _, file := range toAdd {
+		m := &Media{Path: file}
+		media = append(media, m)
+
+		if err := uploadOriginal(uploader, m, dir, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range toDelete {
+		for i, existing := range media {
+			if existing.Path == file {
+				media = append(media[:i], media[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return media, nil
+}
+
+func extractGPS(media []*Media, dir string, opts Options) {
+	for _, file := range media {
+		if file.Lat != 0 || file.Lng != 0 || isURL(file.Path) {
+			continue
+		}
+
+		lat, lng, ok := opts.readGPS(filepath.Join(dir, file.Path))
+		if !ok {
+			continue
+		}
+
+		file.Lat = lat
+		file.Lng = lng
+	}
+}
+
+// backfillDimensions sets Width, Height and AspectRatio of media that don't have them,
+// reading only image headers.
+func backfillDimensions(media []*Media, dir string, opts Options) error {
+	for _, file := range media {
+		if file.Width != 0 && file.Height != 0 {
+			if file.AspectRatio == 0 {
+				file.setDimensions(file.Width, file.Height)
+			}
+			continue
+		}
+
+		config, err := opts.readImageConfig(dir, file.Path)
+		if err != nil {
+			return fmt.Errorf("reading image config: %w", err)
+		}
+
+		file.setDimensions(config.Width, config.Height)
+	}
+
+	return nil
+}
+
+// IsGenerated reports whether the file name is one of the files
+// written by ProcessDirectory rather than a media file.
+// Names of variants, individual thumbnails and other optional files are only matched
+// if they are enabled, so that media such as hero.800w.jpg or og.jpg are not skipped otherwise.
+func IsGenerated(name string, opts Options) bool {
+	return strings.HasPrefix(name, opts.spritePrefix()) ||
+		opts.AnimatedPreview && name == previewFile ||
+		opts.SocialCard && name == socialCardFile ||
+		opts.FaviconSource != "" && name == faviconFile ||
+		len(opts.VariantWidths) > 0 && variantName.MatchString(name) ||
+		len(opts.IndividualFormats) > 0 && individualName.MatchString(name)
+}
+
+// ScanDirectory returns sorted names of supported images in dir
+// and URLs from its .urls file, skipping generated sprites and previews.
+func ScanDirectory(dir string, opts Options) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory %q: %w", dir, err)
+	}
+
+	var (
+		result []string
+		seen   = map[string]string{} // normalized name -> original name
+		folded = map[string]string{} // lowercased name -> normalized name
+	)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// hidden files such as .cover.jpg are often metadata, not gallery content
+		if strings.HasPrefix(file.Name(), ".") && !opts.IncludeHidden {
+			continue
+		}
+
+		if IsGenerated(file.Name(), opts) {
+			continue
+		}
+
+		ext := filepath.Ext(file.Name())
+		if !isSupported(ext) {
+			continue
+		}
+
+		name := fixUnicode(file.Name())
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf(
+				"%w: %q and %q in %q",
+				ErrFilenameCollision,
+				other,
+				file.Name(),
+				dir,
+			)
+		}
+		seen[name] = file.Name()
+
+		if other, ok := folded[strings.ToLower(name)]; ok {
+			opts.logger().Warnf("Files %q and %q in %s differ only in case", other, name, dir)
+		}
+		folded[strings.ToLower(name)] = name
+
+		// e.g. left by an interrupted copy, it would fail to decode mid-batch
+		info, err := file.Info()
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", filepath.Join(dir, file.Name()), err)
+		}
+		if info.Size() == 0 {
+			opts.logger().Warnf("Skipping %s: empty file", filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		result = append(result, name)
+	}
+
+	urls, err := readURLsFile(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading remote media list: %w", err)
+	}
+	for _, u := range urls {
+		ext := filepath.Ext(localName(u))
+		if !isSupported(ext) {
+			opts.logger().Warnf("Skipping %s: unsupported extension", u)
+			continue
+		}
+		result = append(result, u)
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// GenerateThumbnails writes and uploads sprites of media in the format and updates
+// their tiles. Sprites that are not referenced anymore are not deleted,
+// since ProcessDirectory only knows them once all formats are generated.
+func GenerateThumbnails(
+	uploader Uploader,
+	media []*Media,
+	dir string,
+	format string,
+	opts Options,
+) ([]Updated, error) {
+	batchSize := opts.batchSize()
+
+	// split files into batches of batchSize files each,
+	// or of a single file for individual thumbnails
+	individual := opts.IndividualFormats[format]
+	if individual {
+		batchSize = 1
+	}
+	batches := make([][]*Media, 0)
+	for i := 0; i < len(media); i += batchSize {
+		end := i + batchSize
+		if end > len(media) {
+			end = len(media)
+		}
+		batches = append(batches, media[i:end])
+	}
+
+	if opts.Batch != nil {
+		batches = selectBatch(media, *opts.Batch, individual, format, opts)
+	} else if opts.AppendOnly && !opts.Force && !individual {
+		batches = appendBatches(media, batchSize, format, opts)
+	} else if !opts.Force {
+		// filter out batches if all files in it already have thumbnails
+		for batch, files := range batches {
+			allHaveThumbs := true
+			allHaveSameThumb := true
+			for _, file := range files {
+				if file.ThumbPath == "" {
+					opts.logger().Infof("Batch %d has no thumbnails", batch)
+					allHaveThumbs = false
+					break
+				}
+				if spriteFormat(file.ThumbPath) != format {
+					opts.logger().Infof("Batch %d has thumbnails of another format", batch)
+					allHaveThumbs = false
+					break
+				}
+				if individual && !strings.HasPrefix(file.ThumbPath, individualBase(file)+".") {
+					opts.logger().Infof("Batch %d has no individual thumbnail", batch)
+					allHaveThumbs = false
+					break
+				}
+				if file.ThumbPath != files[0].ThumbPath {
+					opts.logger().Infof("Batch %d has different ThumbPath: want %q, have %q", batch, file.ThumbPath, files[0].ThumbPath)
+					allHaveSameThumb = false
+					break
+				}
+				if file.Path == opts.Cover && (file.ThumbXOffset != 0 || file.ThumbYOffset != 0) {
+					opts.logger().Infof("Batch %d has cover %s in another tile", batch, file.Path)
+					allHaveThumbs = false
+					break
+				}
+				if !opts.ThumbMode.matches(file) {
+					opts.logger().Infof("Batch %d has thumbnails of another mode", batch)
+					allHaveThumbs = false
+					break
+				}
+				if file.ThumbLabelHeight != opts.labelHeight() {
+					opts.logger().Infof("Batch %d has thumbnails with another label height", batch)
+					allHaveThumbs = false
+					break
+				}
+				if file.ThumbResizeMode != opts.ResizeMode.recorded() {
+					opts.logger().Infof("Batch %d has thumbnails of another resize mode", batch)
+					allHaveThumbs = false
+					break
+				}
+				if file.ThumbVerticalAlign != opts.VerticalAlign.recorded() {
+					opts.logger().Infof("Batch %d has thumbnails of another vertical alignment", batch)
+					allHaveThumbs = false
+					break
+				}
+				if missing := missingSize(file, files[0], opts.ExtraSizes); missing != 0 {
+					opts.logger().Infof("Batch %d has no %dpx thumbnails", batch, missing)
+					allHaveThumbs = false
+					break
+				}
+			}
+			if !allHaveThumbs {
+				opts.debugf("%s: %s batch %d regenerated, it has new files", dir, format, batch)
+			} else if !allHaveSameThumb {
+				opts.debugf("%s: %s batch %d regenerated, its files were moved between batches", dir, format, batch)
+			}
+			if allHaveThumbs && allHaveSameThumb {
+				// batch did not change, ignore it
+				opts.debugf("%s: %s batch %d skipped, all %d file(s) have up to date thumbnails", dir, format, batch, len(files))
+				batches[batch] = nil
+			}
+		}
+	} else {
+		opts.logger().Info("Forcing thumbnail generation")
+	}
+
+	var updated []Updated
+
+	// generate thumbnails for each batch
+	for batch, files := range batches {
+		if files == nil {
+			continue
+		}
+
+		base := fmt.Sprintf("%s%d", opts.spritePrefix(), batch)
+		if individual {
+			base = individualBase(files[0])
+		}
+
+		opts.logger().Infof("Generating %s thumbnail for batch %d in %s", format, batch, dir)
+		var info SpriteInfo
+		thumbRef, sum, err := writeSprite(uploader, dir, base, format, opts, func(w io.Writer) (err error) {
+			info, err = WriteThumbnail(w, files, dir, format, opts)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("generating thumbnail for %s / %d: %w", dir, batch, err)
+		}
+		opts.logger().Infof("Batch %d thumbnail is %dx%d with %d tiles", batch, info.TotalWidth, info.TotalHeight, info.Tiles)
+
+		// update thumb path with CRC32 checksum for each photo
+		for _, file := range files {
+			opts.logger().Infof("Updating thumb path for %s", file.Path)
+			file.ThumbPath = thumbRef
+			file.ThumbLabelHeight = opts.labelHeight()
+			file.ThumbResizeMode = opts.ResizeMode.recorded()
+			file.ThumbVerticalAlign = opts.VerticalAlign.recorded()
+			file.setThumbFormat(format)
+			updated = append(updated, Updated{
+				Path: filepath.Join(dir, localName(file.Path)),
+				Hash: sum,
+			})
+		}
+
+		for _, size := range opts.ExtraSizes {
+			opts.logger().Infof("Generating %dpx %s thumbnail for batch %d in %s", size, format, batch, dir)
+			thumbRef, _, err := writeSprite(uploader, dir, fmt.Sprintf("%s_%d", base, size), format, opts, func(w io.Writer) error {
+				return writeSizedThumbnail(w, files, dir, format, size, opts)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("generating %dpx thumbnail for %s / %d: %w", size, dir, batch, err)
+			}
+
+			for _, file := range files {
+				thumb := file.Thumbs[size]
+				thumb.Path = thumbRef
+				file.Thumbs[size] = thumb
+			}
+		}
+
+		// resized images are not needed anymore
+		for _, file := range files {
+			file.sizedImages = nil
+		}
+	}
+
+	return updated, nil
+}
+
+// batchSize returns the number of files per sprite.
+func (o Options) batchSize() int {
+	if o.BatchSize <= 0 {
+		return maxPerRow * maxRows
+	}
+	return o.BatchSize
+}
+
+// checkBatchCount warns about a directory with more than opts.MaxBatches sprites of a format,
+// which should probably be split, or returns ErrTooManyBatches with opts.Strict.
+// media are the entries of the directory once new files are added, so that it is checked
+// before anything is uploaded.
+func checkBatchCount(media []*Media, dir string, opts Options) error {
+	if opts.MaxBatches <= 0 || opts.SkipThumbnails {
+		return nil
+	}
+
+	grouped := map[string][]*Media{}
+	for _, file := range media {
+		format := opts.SpriteFormat
+		if format == "" {
+			format = formatGroup(file.Path, opts.FormatGroups)
+			if _, ok := spriteEncoders[format]; !ok && opts.FallbackFormat != "" {
+				format = opts.FallbackFormat
+			}
+		}
+		grouped[format] = append(grouped[format], file)
+	}
+
+	for format, media := range grouped {
+		if opts.IndividualFormats[format] {
+			continue
+		}
+
+		count := spriteCount(media, format, opts)
+		if count <= opts.MaxBatches {
+			continue
+		}
+		if opts.Strict {
+			return fmt.Errorf("%w in %s: %d %s sprites, at most %d allowed", ErrTooManyBatches, dir, count, format, opts.MaxBatches)
+		}
+		opts.logger().Warnf("%s has %d %s sprites, more than %d, consider splitting it", dir, count, format, opts.MaxBatches)
+	}
+	return nil
+}
+
+// spriteCount returns the number of sprites of the format media are in once GenerateThumbnails is done.
+func spriteCount(media []*Media, format string, opts Options) int {
+	if opts.Batch != nil {
+		// a single batch is regenerated, the rest of sprites are kept as they are
+		sprites := map[int]bool{}
+		for _, file := range media {
+			if batch, ok := spriteBatch(file.ThumbPath, opts); ok && spriteFormat(file.ThumbPath) == format {
+				sprites[batch] = true
+			}
+		}
+		return len(sprites)
+	}
+
+	size := opts.batchSize()
+	if opts.AppendOnly && !opts.Force {
+		next, added := 0, 0
+		for _, file := range media {
+			if file.ThumbPath == "" || spriteFormat(file.ThumbPath) != format {
+				added++
+				continue
+			}
+			if batch, ok := spriteBatch(file.ThumbPath, opts); ok && batch >= next {
+				next = batch + 1
+			}
+		}
+		return next + (added+size-1)/size
+	}
+	return (len(media) + size - 1) / size
+}
+
+// appendBatches puts media without thumbnails into batches numbered after existing sprites.
+// Batches of media that have thumbnails are left nil, so that their sprites are not regenerated.
+// Media with thumbnails of another format are treated as new.
+func appendBatches(media []*Media, batchSize int, format string, opts Options) [][]*Media {
+	var (
+		next  int
+		added []*Media
+	)
+	for _, file := range media {
+		if file.ThumbPath == "" || spriteFormat(file.ThumbPath) != format {
+			added = append(added, file)
+			continue
+		}
+		if batch, ok := spriteBatch(file.ThumbPath, opts); ok && batch >= next {
+			next = batch + 1
+		}
+	}
+
+	opts.debugf("%d new %s file(s) go into sprites from batch %d, existing ones are kept", len(added), format, next)
+
+	batches := make([][]*Media, next)
+	for i := 0; i < len(added); i += batchSize {
+		batches = append(batches, added[i:min(i+batchSize, len(added))])
+	}
+	return batches
+}
+
+// selectBatch returns batches where only the given one is not nil,
+// with media referencing its sprite. Batches are addressed by sprite names,
+// so that the same files are selected regardless of files added or deleted since.
+// Individual thumbnails are not in batches and never selected.
+func selectBatch(media []*Media, batch int, individual bool, format string, opts Options) [][]*Media {
+	var files []*Media
+	for _, file := range media {
+		if file.ThumbPath == "" || spriteFormat(file.ThumbPath) != format {
+			continue
+		}
+		if n, ok := spriteBatch(file.ThumbPath, opts); ok && n == batch && !individual {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		opts.logger().Warnf("No %s files in batch %d, nothing to regenerate", format, batch)
+		return nil
+	}
+
+	batches := make([][]*Media, batch+1)
+	batches[batch] = files
+	return batches
 }
 
-type ByThumbHeightDesc []MediaContainer
+// spriteBatch returns the batch number of a sprite reference such as "thumbnails_3.jpg?crc=…".
+func spriteBatch(ref string, opts Options) (int, bool) {
+	name, _, _ := strings.Cut(ref, "?")
+	rest, ok := strings.CutPrefix(name, opts.spritePrefix())
+	if !ok {
+		return 0, false
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end <= 0 {
+		return 0, false
+	}
+	batch, err := strconv.Atoi(rest[:end])
+	return batch, err == nil
+}
 
-func (a ByThumbHeightDesc) Len() int      { return len(a) }
-func (a ByThumbHeightDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByThumbHeightDesc) Less(i, j int) bool {
-	return a[i].Media.ThumbHeight > a[j].Media.ThumbHeight
+// spriteFormat returns the format of a sprite reference such as "thumbnails_3.jpg?crc=…",
+// which is the extension of its file name.
+func spriteFormat(ref string) string {
+	name, _, _ := strings.Cut(ref, "?")
+	return strings.TrimPrefix(filepath.Ext(name), ".")
 }
 
-func LoadThumbsFile(path string) ([]*Media, error) {
-	// check if file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return nil, ErrThumbYamlNotFound
+// writeSprite streams a sprite written by encode into a file in dir,
+// calculating its checksum on the way, so that the encoded sprite
+// is not held in memory together with the decoded one. The file is then uploaded.
+// Returns a reference to the sprite to be stored in Media and its checksum.
+// In a dry run the sprite is only encoded to calculate its checksum.
+func writeSprite(
+	uploader Uploader,
+	dir, base, format string,
+	opts Options,
+	encode func(w io.Writer) error,
+) (ref, sum string, err error) {
+	if opts.dryRun() {
+		hash := crc32.NewIEEE()
+		if err = encode(hash); err != nil {
+			return "", "", err
+		}
+		sum = fmt.Sprintf("%x", hash.Sum32())
+		_, ref = spriteName(base, format, sum, opts)
+		return ref, sum, nil
+	}
+
+	// sprites of a directory may be large, check before each of them
+	if err = checkFreeSpace(dir, opts.MinFreeSpace); err != nil {
+		return "", "", err
 	}
 
-	// read .thumbs.yml file
-	fileContent, err := os.ReadFile(path)
+	tmp, err := os.CreateTemp(dir, base+".*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("reading file: %w", err)
+		return "", "", fmt.Errorf("creating thumbnail file: %w", err)
 	}
+	defer os.Remove(tmp.Name()) // no-op after rename
 
-	var media []*Media
-	if err = yaml.Unmarshal(fileContent, &media); err != nil {
-		return nil, fmt.Errorf("unmarshaling file: %w", err)
+	hash := crc32.NewIEEE()
+	if err = encode(io.MultiWriter(tmp, hash)); err != nil {
+		tmp.Close()
+		return "", "", err
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return "", "", fmt.Errorf("writing thumbnail %q: %w", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return "", "", fmt.Errorf("writing thumbnail %q: %w", tmp.Name(), err)
 	}
 
-	return media, nil
+	sum = fmt.Sprintf("%x", hash.Sum32())
+	thumbPath, ref := spriteName(base, format, sum, opts)
+	path := filepath.Join(dir, thumbPath)
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", "", fmt.Errorf("writing thumbnail %q: %w", thumbPath, err)
+	}
+
+	// upload thumbnail to R2, streaming it from the file
+	if err = uploadFile(uploader, path, path); err != nil {
+		return "", "", fmt.Errorf(
+			"uploading thumbnail %q: %w",
+			thumbPath,
+			&UploadError{Path: path, Err: err},
+		)
+	}
+	opts.Stats.addSprite()
+
+	return ref, sum, nil
 }
 
-func SaveThumbsFile(path string, media []*Media) error {
-	if len(media) == 0 {
-		return nil
+// spriteName returns file name of a sprite with given base name
+// and a reference to it stored in Media, both including the checksum.
+func spriteName(base, format, sum string, opts Options) (path, ref string) {
+	if opts.ContentAddressed {
+		path = fmt.Sprintf("%s.%s.%s", base, sum, format)
+		return path, path
 	}
 
-	fileContent, err := yaml.Marshal(media)
-	if err != nil {
-		return fmt.Errorf("marshaling media: %w", err)
+	path = base + "." + format
+	if opts.NoCRCSuffix {
+		return path, path
 	}
+	return path, path + "?crc=" + sum
+}
 
-	if err = os.WriteFile(path, fileContent, 0o644); err != nil {
-		return fmt.Errorf("writing file: %w", err)
+// missingSize returns the first of sizes that file has no thumbnail of,
+// or that is in a different sprite than the one of first; 0 if there is none.
+func missingSize(file, first *Media, sizes []int) int {
+	for _, size := range sizes {
+		thumb, ok := file.Thumbs[size]
+		if !ok || thumb.Path == "" || thumb.Path != first.Thumbs[size].Path {
+			return size
+		}
 	}
+	return 0
+}
 
-	return nil
+// spritePaths returns a set of sprite file names referenced by media.
+func spritePaths(media []*Media) map[string]bool {
+	result := make(map[string]bool)
+	add := func(ref string) {
+		if ref == "" {
+			return
+		}
+		path, _, _ := strings.Cut(ref, "?")
+		result[path] = true
+	}
+	for _, file := range media {
+		add(file.ThumbPath)
+		for _, thumb := range file.Thumbs {
+			add(thumb.Path)
+		}
+	}
+	return result
 }
 
-func ProcessDirectory(dir string, up Uploader, force bool) ([]string, error) {
-	log.Infof("Processing %s", dir)
+// deleteStaleSprites removes sprites that were referenced before
+// but are not referenced anymore, both locally and from the storage.
+func deleteStaleSprites(uploader Uploader, dir string, previous, current map[string]bool, opts Options) error {
+	for path := range previous {
+		if current[path] || opts.keepSprites[path] {
+			continue
+		}
+		if opts.dryRun() {
+			opts.logger().Infof("Would delete stale thumbnail %s", filepath.Join(dir, path))
+			continue
+		}
 
-	thumbsFile := filepath.Join(dir, ".thumbs.yml")
+		opts.logger().Infof("Deleting stale thumbnail %s", filepath.Join(dir, path))
+		if err := os.Remove(filepath.Join(dir, path)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %q: %w", path, err)
+		}
 
-	// look for .thumb.yml file
-	media, err := LoadThumbsFile(thumbsFile)
-	if err != nil && !errors.Is(err, ErrThumbYamlNotFound) {
-		return nil, fmt.Errorf("loading thumbs file: %w", err)
+		if err := uploader.Delete(filepath.Join(dir, path)); err != nil {
+			return fmt.Errorf("deleting %q: %w", path, &UploadError{Path: filepath.Join(dir, path), Err: err})
+		}
 	}
 
-	// scan directory for all image files
-	files, err := ScanDirectory(dir)
-	if err != nil {
-		return nil, fmt.Errorf("scanning directory: %w", err)
-	}
+	return nil
+}
+
+// SpriteInfo describes a generated sprite.
+type SpriteInfo struct {
+	TotalWidth  int
+	TotalHeight int
+	Tiles       int // fewer than media if some of them share a tile
+}
 
-	media, err = UploadNewMedia(up, media, files, dir)
+// GenerateThumbnail returns a sprite of media encoded in given format.
+func GenerateThumbnail(media []*Media, dir, format string, opts Options) ([]byte, SpriteInfo, error) {
+	var b bytes.Buffer
+	info, err := WriteThumbnail(&b, media, dir, format, opts)
 	if err != nil {
-		return nil, fmt.Errorf("uploading new media: %w", err)
+		return nil, SpriteInfo{}, err
 	}
+	return b.Bytes(), info, nil
+}
 
-	mediaGrouped := groupByType(media)
+// WriteThumbnail writes a sprite of media encoded in given format to w,
+// without buffering the encoded sprite.
+func WriteThumbnail(w io.Writer, media []*Media, dir, format string, opts Options) (SpriteInfo, error) {
+	// each thumbnail should fit into 140x140px square, maximum 10 files in a row
+	if err := resizeAll(media, dir, opts); err != nil {
+		return SpriteInfo{}, err
+	}
 
-	var updatedGrouped []string
+	// visually identical images share a single tile
+	var duplicates map[*Media]*Media
+	if opts.Dedup {
+		duplicates = findDuplicates(media, opts)
+	}
 
-	for format, media := range mediaGrouped {
-		updated, err := GenerateThumbnails(up, media, dir, format, force)
-		if err != nil {
-			return nil, fmt.Errorf("generating thumbnails: %w", err)
+	// sort media, aiming to have less empty space
+	// create a slice of pointers to the original files
+	containers := make([]MediaContainer, 0, len(media))
+	for _, file := range media {
+		if _, ok := duplicates[file]; !ok {
+			containers = append(containers, MediaContainer{Media: file})
 		}
+	}
 
-		updatedGrouped = append(updatedGrouped, updated...)
+	sort.Sort(opts.SortBy.sorter(containers))
+	pinCover(containers, opts.Cover)
+
+	// calculate thumbnail image size and tile offsets
+	totalWidth, totalHeight := pack(containers, opts.labelHeight(), opts.VerticalAlign)
+
+	for file, original := range duplicates {
+		file.ThumbXOffset = original.ThumbXOffset
+		file.ThumbYOffset = original.ThumbYOffset
+		file.ThumbWidth = original.ThumbWidth
+		file.ThumbHeight = original.ThumbHeight
+		file.ThumbTotalWidth = totalWidth
+		file.ThumbTotalHeight = totalHeight
 	}
 
-	if err = SaveThumbsFile(thumbsFile, media); err != nil {
-		return nil, fmt.Errorf("saving media: %w", err)
+	if err := drawSprite(w, containers, totalWidth, totalHeight, dir, format, opts); err != nil {
+		return SpriteInfo{}, err
 	}
 
-	return updatedGrouped, nil
+	return SpriteInfo{TotalWidth: totalWidth, TotalHeight: totalHeight, Tiles: len(containers)}, nil
 }
 
-func UploadNewMedia(
-	uploader Uploader,
-	media []*Media,
-	files []string,
-	dir string,
-) ([]*Media, error) {
-	toAdd, toDelete := diff(media, files)
-
-	for _, file := range toAdd {
-		media = append(media, &Media{
-			Path: file,
-		})
+// resizeAll decodes and resizes media concurrently,
+// keeping decoded images within opts.DecodeMemoryBudget.
+func resizeAll(media []*Media, dir string, opts Options) error {
+	budget := newMemoryBudget(opts.DecodeMemoryBudget)
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	errs := make([]error, len(media))
+
+	var wg sync.WaitGroup
+	for i, file := range media {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, file *Media) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			errs[i] = resizeMedia(file, dir, budget, opts)
+		}(i, file)
+	}
+	wg.Wait()
 
-		path := filepath.Join(dir, file)
-		content, err := os.ReadFile(path)
+	// report the first error in media order, regardless of timing
+	for _, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("reading file: %w", err)
-		}
-
-		if err = uploader.Upload(path, content); err != nil {
-			return nil, fmt.Errorf("uploading file: %w", err)
+			return err
 		}
 	}
 
-	for _, file := range toDelete {
-		for i, existing := range media {
-			if existing.Path == file {
-				// todo: delete from r2
+	return nil
+}
 
-				media = append(media[:i], media[i+1:]...)
-				break
-			}
+// resizeMedia decodes the image and sets its thumbnail and blurhash.
+func resizeMedia(file *Media, dir string, budget *memoryBudget, opts Options) error {
+	// the file is read once, both for its dimensions and decoding
+	content, err := opts.readMedia(dir, file.Path)
+	if err != nil {
+		return fmt.Errorf("reading image: %w", err)
+	}
+
+	var size int64
+	if budget.limit > 0 {
+		config, err := decodeImageConfig(content, filepath.Join(dir, file.Path))
+		if err != nil {
+			return fmt.Errorf("reading image: %w", err)
 		}
+		size = int64(config.Width) * int64(config.Height) * bytesPerPixel
 	}
 
-	return media, nil
-}
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
 
-func ScanDirectory(dir string) ([]string, error) {
-	files, err := os.ReadDir(dir)
+	budget.acquire(size)
+	defer budget.release(size)
+
+	// decode photo
+	file.Animated = isAnimatedPNG(content)
+	if file.Animated {
+		opts.logger().Warnf("%s is an animated PNG, only its first frame is used", filepath.Join(dir, file.Path))
+	}
+
+	img, err := decodeImage(content, filepath.Join(dir, file.Path))
 	if err != nil {
-		return nil, fmt.Errorf("reading directory %q: %w", dir, err)
+		return fmt.Errorf("reading image: %w", err)
+	}
+	file.setDimensions(img.Bounds().Dx(), img.Bounds().Dy())
+
+	// resize to additional sizes while the original is decoded,
+	// thumbnails of sizes that are not configured anymore are dropped
+	file.Thumbs = nil
+	file.sizedImages = make(map[int]image.Image, len(opts.ExtraSizes))
+	for _, size := range opts.ExtraSizes {
+		file.sizedImages[size] = opts.ThumbMode.resize(img, size, opts.ResizeMode)
 	}
 
-	var result []string
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+	// resize photo to 140x140px
+	thumb := opts.ThumbMode.resize(img, maxThumbSize, opts.ResizeMode)
+	file.image = thumb
+	file.ThumbWidth = thumb.Bounds().Dx()
+	file.ThumbHeight = thumb.Bounds().Dy()
 
-		if strings.HasPrefix(file.Name(), "thumbnails_") {
-			continue
+	// reuse resized image for blurhash, unless it's distorted
+	if opts.ThumbMode != ThumbModeStretch {
+		img = thumb
+	}
+	if opts.skipBlurhash(file) {
+		file.Blurhash = ""
+	} else if file.Blurhash == "" || opts.ForceBlurhash {
+		opts.debugf("%s: recalculating blurhash, missing: %t, forced: %t", file.Path, file.Blurhash == "", opts.ForceBlurhash)
+		if err = setBlurhash(file, img); err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
 		}
+	}
 
-		ext := filepath.Ext(file.Name())
-		if !contains([]string{".jpg", ".jpeg", ".png"}, ext) {
-			continue
+	// watermark is drawn after blurhash is calculated, so it doesn't affect it
+	if opts.Watermark != nil {
+		file.image = applyWatermark(file.image, opts.Watermark, opts.WatermarkPosition)
+		for size, sized := range file.sizedImages {
+			file.sizedImages[size] = applyWatermark(sized, opts.Watermark, opts.WatermarkPosition)
 		}
-
-		result = append(result, fixUnicode(file.Name()))
 	}
 
-	sort.Strings(result)
+	if opts.DumpTilesDir != "" {
+		if err = dumpTile(file, dir, opts); err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
 
-	return result, nil
+	return nil
 }
 
-func GenerateThumbnails(
-	uploader Uploader,
-	media []*Media,
-	dir string,
-	format string,
-	force bool,
-) ([]string, error) {
-	// split files into batches of 100 files each
-	batches := make([][]*Media, 0)
-	for i := 0; i < len(media); i += maxPerRow * maxRows {
-		end := i + maxPerRow*maxRows
-		if end > len(media) {
-			end = len(media)
+// writeSizedThumbnail writes a sprite of images resized to size by WriteThumbnail
+// and sets Thumbs[size] offsets of each media. Path of the sprite is set by the caller.
+func writeSizedThumbnail(w io.Writer, media []*Media, dir, format string, size int, opts Options) error {
+	// pack temporary tiles, so that offsets of the default sprite are kept
+	tiles := make([]*Media, len(media))
+	containers := make([]MediaContainer, len(media))
+	for i, file := range media {
+		img := file.sizedImages[size]
+		if img == nil {
+			return fmt.Errorf("%s was not resized to %dpx", file.Path, size)
 		}
-		batches = append(batches, media[i:end])
+		tiles[i] = &Media{
+			Path:        file.Path,
+			ThumbWidth:  img.Bounds().Dx(),
+			ThumbHeight: img.Bounds().Dy(),
+			image:       img,
+		}
+		containers[i].Media = tiles[i]
 	}
 
-	// filter out batches if all files in it already have thumbnails
-	if !force {
-		for batch, files := range batches {
-			allHaveThumbs := true
-			allHaveSameThumb := true
-			for _, file := range files {
-				if file.ThumbPath == "" {
-					log.Infof("Batch %d has no thumbnails", batch)
-					allHaveThumbs = false
-					break
-				}
-				if file.ThumbPath != files[0].ThumbPath {
-					log.Infof("Batch %d has different ThumbPath: want %q, have %q", batch, file.ThumbPath, files[0].ThumbPath)
-					allHaveSameThumb = false
-					break
-				}
-			}
-			if allHaveThumbs && allHaveSameThumb {
-				// batch did not change, ignore it
-				batches[batch] = nil
-			}
+	sort.Sort(opts.SortBy.sorter(containers))
+	pinCover(containers, opts.Cover)
+	totalWidth, totalHeight := pack(containers, opts.labelHeight(), opts.VerticalAlign)
+
+	for i, file := range media {
+		if file.Thumbs == nil {
+			file.Thumbs = make(map[int]Thumb)
+		}
+		file.Thumbs[size] = Thumb{
+			XOffset:     tiles[i].ThumbXOffset,
+			YOffset:     tiles[i].ThumbYOffset,
+			Width:       tiles[i].ThumbWidth,
+			Height:      tiles[i].ThumbHeight,
+			TotalWidth:  totalWidth,
+			TotalHeight: totalHeight,
 		}
-	} else {
-		log.Info("Forcing thumbnail generation")
 	}
 
-	var updated []string
+	return drawSprite(w, containers, totalWidth, totalHeight, dir, format, opts)
+}
 
-	// generate thumbnails for each batch
-	for batch, files := range batches {
-		if files == nil {
-			continue
-		}
+// drawSprite draws images of packed containers into a sprite and writes it to w in given format.
+func drawSprite(w io.Writer, containers []MediaContainer, totalWidth, totalHeight int, dir, format string, opts Options) error {
+	img := image.NewRGBA(image.Rect(0, 0, totalWidth, totalHeight))
 
-		thumbPath := fmt.Sprintf("thumbnails_%d.%s", batch, format)
+	// JPEG has no alpha channel, fill the background
+	// so that transparent images don't turn black.
+	// PNG sprites are not filled: tiles are copied with their alpha,
+	// and space around them stays transparent.
+	op := draw.Src
+	encoder := spriteEncoders[format]
+	if encoder == "jpg" {
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+		op = draw.Over
+	}
 
-		log.Infof("Generating %s thumbnail for batch %d in %s", format, batch, dir)
-		b, err := GenerateThumbnail(files, dir, format)
-		if err != nil {
-			return nil, fmt.Errorf("generating thumbnail for %s / %d: %w", dir, batch, err)
-		}
+	// draw files on thumbnail
+	for _, container := range containers {
+		x := container.Media.ThumbXOffset
+		y := container.Media.ThumbYOffset
 
-		// update thumb path with CRC32 checksum for each photo
-		for _, file := range files {
-			log.Infof("Updating thumb path for %s", file.Path)
-			file.ThumbPath = thumbPath + "?crc=" + crc32sum(b)
-			updated = append(updated, filepath.Join(dir, file.Path))
-		}
+		draw.Draw(
+			img,
+			image.Rect(x, y, x+container.Media.ThumbWidth, y+container.Media.ThumbHeight),
+			container.Media.image,
+			container.Media.image.Bounds().Min,
+			op,
+		)
 
-		err = os.WriteFile(filepath.Join(dir, thumbPath), b, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("writing thumbnail %q: %w", thumbPath, err)
+		if opts.ContactSheet {
+			drawLabel(img, container.Media, opts.labelHeight())
 		}
+	}
 
-		// upload thumbnail to R2
-		if err := uploader.Upload(filepath.Join(dir, thumbPath), b); err != nil {
-			return nil, fmt.Errorf("uploading thumbnail %q: %w", thumbPath, err)
+	switch encoder {
+	case "png":
+		// encode thumbnail into PNG
+		if err := encodePNG(w, img, opts); err != nil {
+			return &EncodeError{Path: dir, Format: format, Err: err}
+		}
+	case "jpg":
+		jpegOptions := jpegenc.Options{
+			Quality:     spriteQuality(containers, opts),
+			Subsampling: opts.JPEGSubsampling,
 		}
+		if err := jpegenc.Encode(w, img, &jpegOptions); err != nil {
+			return &EncodeError{Path: dir, Format: format, Err: err}
+		}
+	default:
+		return &EncodeError{Path: dir, Format: format, Err: errors.New("unsupported format")}
 	}
 
-	return updated, nil
+	return nil
 }
 
-func GenerateThumbnail(media []*Media, dir, format string) ([]byte, error) {
-	// each thumbnail should fit into 140x140px square, maximum 10 files in a row
-	for _, file := range media {
-		// decode photo
-		img, err := readImage(dir, file.Path)
-		if err != nil {
-			return nil, fmt.Errorf("reading image: %w", err)
+// Pack sets tile offsets and sprite dimensions of media the same way
+// GenerateThumbnail does with the same opts, without decoding or encoding images,
+// so that sprites can be drawn by other tools. Media without ThumbWidth
+// and ThumbHeight get tile sizes calculated from their Width and Height
+// as of opts.ThumbMode and opts.ResizeMode. Duplicates are not detected,
+// as it needs decoded images, so each media gets its own tile even with opts.Dedup.
+func Pack(media []*Media, opts Options) (totalWidth, totalHeight int) {
+	containers := make([]MediaContainer, len(media))
+	for i, file := range media {
+		if file.ThumbWidth == 0 || file.ThumbHeight == 0 {
+			file.ThumbWidth, file.ThumbHeight = opts.ThumbMode.size(file.Width, file.Height, maxThumbSize, opts.ResizeMode)
 		}
-		file.Width = img.Bounds().Dx()
-		file.Height = img.Bounds().Dy()
+		containers[i].Media = file
+	}
 
-		// resize photo to 140x140px
-		img = resize.Thumbnail(
-			maxThumbSize,
-			maxThumbSize,
-			img,
-			resize.Lanczos3,
-		)
-		file.image = img
-		file.ThumbWidth = img.Bounds().Dx()
-		file.ThumbHeight = img.Bounds().Dy()
+	sort.Sort(opts.SortBy.sorter(containers))
+	pinCover(containers, opts.Cover)
+
+	return pack(containers, opts.labelHeight(), opts.VerticalAlign)
+}
+
+// thumbSize returns the size of an image of given size resized
+// to fit into a size×size square, the same as resize.Thumbnail.
+func thumbSize(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
 	}
 
-	// sort media by height, aiming to have less empty space
-	// create a slice of pointers to the original files
-	containers := make([]MediaContainer, len(media))
-	for i := range media {
-		containers[i].Media = media[i]
+	if width > size {
+		height = max(1, height*size/width)
+		width = size
+	}
+	if height > size {
+		width = max(1, width*size/height)
+		height = size
 	}
 
-	// sort the slice of pointers by thumb height in descending order
-	sort.Sort(ByThumbHeightDesc(containers))
+	return width, height
+}
 
-	// calculate thumbnail image size
-	var (
-		rowWidth    int
-		totalWidth  int
-		totalHeight int
-		counter     int
-	)
+// pack lays out containers in rows of maxPerRow tiles, in the given order,
+// sets offsets for each media and returns the total size of the sprite.
+// Each row is as tall as its tallest tile, including labelHeight under each of them,
+// shorter tiles are aligned in it as given.
+func pack(containers []MediaContainer, labelHeight int, align VerticalAlign) (totalWidth, totalHeight int) {
+	sizes := make([]image.Point, len(containers))
 	for i, container := range containers {
-		if i == 0 {
-			totalHeight = container.Media.ThumbHeight
-			totalWidth = container.Media.ThumbWidth
-		}
-
-		if counter == maxPerRow {
-			totalHeight += container.Media.ThumbHeight
-			if rowWidth > totalWidth {
-				totalWidth = rowWidth
-			}
-			rowWidth = 0
-			counter = 0
-		}
-
-		rowWidth += container.Media.ThumbWidth
-		counter++
+		sizes[i] = image.Pt(container.Media.ThumbWidth, container.Media.ThumbHeight+labelHeight)
 	}
 
-	if rowWidth > totalWidth {
-		totalWidth = rowWidth
+	tiles, totalWidth, totalHeight := Layout(sizes)
+	align.align(tiles)
+
+	for i, container := range containers {
+		container.Media.ThumbXOffset = tiles[i].Min.X
+		container.Media.ThumbYOffset = tiles[i].Min.Y
+		container.Media.ThumbTotalWidth = totalWidth
+		container.Media.ThumbTotalHeight = totalHeight
 	}
 
-	img := image.NewRGBA(image.Rect(0, 0, totalWidth, totalHeight))
+	return totalWidth, totalHeight
+}
 
-	// draw files on thumbnail
+// Layout returns positions of tiles of given sizes in a sprite and the sprite size,
+// without drawing anything. Tiles are placed in the given order left to right,
+// maxPerRow per row; each row starts below the tallest tile of the previous one.
+func Layout(sizes []image.Point) (tiles []image.Rectangle, totalWidth, totalHeight int) {
 	var (
 		x         int
 		y         int
@@ -366,78 +1971,74 @@ func GenerateThumbnail(media []*Media, dir, format string) ([]byte, error) {
 		rowHeight int
 	)
 
-	for i, container := range containers {
-		if i == 0 {
-			rowHeight = container.Media.ThumbHeight
-		}
-
+	tiles = make([]image.Rectangle, len(sizes))
+	for i, size := range sizes {
 		if col == maxPerRow {
 			x = 0
 			col = 0
 			y += rowHeight
-			rowHeight = container.Media.ThumbHeight
+			rowHeight = 0
 		}
 
-		container.Media.ThumbXOffset = x
-		container.Media.ThumbYOffset = y
-		container.Media.ThumbTotalWidth = totalWidth
-		container.Media.ThumbTotalHeight = totalHeight
-
-		draw.Draw(
-			img,
-			image.Rect(x, y, x+container.Media.ThumbWidth, y+container.Media.ThumbHeight),
-			container.Media.image,
-			image.Point{0, 0},
-			draw.Src,
-		)
-		x += container.Media.ThumbWidth
-		col++
-	}
+		tiles[i] = image.Rect(x, y, x+size.X, y+size.Y)
 
-	var b bytes.Buffer
-	switch format {
-	case "png":
-		// encode thumbnail into PNG
-		if err := png.Encode(&b, img); err != nil {
-			return nil, fmt.Errorf("encoding thumbnail: %w", err)
+		x += size.X
+		if x > totalWidth {
+			totalWidth = x
 		}
-	case "jpg":
-		jpegOptions := jpeg.Options{
-			Quality: 95,
-		}
-		if err := jpeg.Encode(&b, img, &jpegOptions); err != nil {
-			return nil, fmt.Errorf("encoding thumbnail: %w", err)
+		if size.Y > rowHeight {
+			rowHeight = size.Y
 		}
-	default:
-		return nil, fmt.Errorf("unsupported format: %s", format)
+		col++
 	}
 
-	return b.Bytes(), nil
+	// rowHeight is the tallest tile of the last row, which may be partial
+	totalHeight = y + rowHeight
+
+	return tiles, totalWidth, totalHeight
 }
 
-func readImage(dir, path string) (image.Image, error) {
-	file, err := os.Open(filepath.Join(dir, path))
+func (o Options) readImage(dir, path string) (image.Image, error) {
+	content, err := o.readMedia(dir, path)
 	if err != nil {
 		return nil, fmt.Errorf("opening file: %w", err)
 	}
-	defer file.Close()
 
-	img, _, err := imageorient.Decode(file)
+	return decodeImage(content, filepath.Join(dir, path))
+}
+
+// decodeImage decodes the image, applying its EXIF orientation.
+// It's the only place orientation is applied: decoded images are upright,
+// and nothing encoded from them carries the orientation tag to be rotated again.
+// path is only used in errors.
+func decodeImage(content []byte, path string) (image.Image, error) {
+	img, _, err := imageorient.Decode(bytes.NewReader(content))
 	if err != nil {
-		return nil, fmt.Errorf("decoding image: %w", err)
+		return nil, &DecodeError{Path: path, Err: err}
 	}
 
 	return img, nil
 }
 
-func crc32sum(content []byte) string {
-	hash := crc32.NewIEEE()
-	if _, err := io.Copy(hash, bytes.NewReader(content)); err != nil {
-		log.Errorf("error calculating CRC32 checksum: %v", err)
-		return ""
+// readImageConfig returns dimensions of the image as decodeImage would decode it.
+func (o Options) readImageConfig(dir, path string) (image.Config, error) {
+	content, err := o.readMedia(dir, path)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("opening file: %w", err)
+	}
+
+	return decodeImageConfig(content, filepath.Join(dir, path))
+}
+
+// decodeImageConfig returns dimensions of the image as decodeImage would decode it.
+// path is only used in errors.
+func decodeImageConfig(content []byte, path string) (image.Config, error) {
+	config, _, err := imageorient.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return image.Config{}, &DecodeError{Path: path, Err: err}
 	}
 
-	return fmt.Sprintf("%x", hash.Sum32())
+	return config, nil
 }
 
 func contains(arr []string, needle string) bool {
@@ -454,14 +2055,11 @@ func fixUnicode(in string) string {
 	return norm.NFC.String(in)
 }
 
-func groupByType(media []*Media) map[string][]*Media {
+func groupByType(media []*Media, groups map[string]string) map[string][]*Media {
 	result := make(map[string][]*Media)
 
 	for _, file := range media {
-		ext := strings.Trim(filepath.Ext(file.Path), ".")
-		if ext == "jpeg" {
-			ext = "jpg"
-		}
+		ext := formatGroup(file.Path, groups)
 
 		if _, ok := result[ext]; !ok {
 			result[ext] = make([]*Media, 0)
@@ -491,6 +2089,21 @@ func diff(media []*Media, files []string) (toAdd, toDelete []string) {
 	return toAdd, toDelete
 }
 
+// withNewFiles returns media of files, with entries of files that are not in media yet.
+func withNewFiles(media []*Media, files []string) []*Media {
+	result := make([]*Media, 0, len(files))
+	for _, file := range media {
+		if contains(files, file.Path) {
+			result = append(result, file)
+		}
+	}
+	toAdd, _ := diff(media, files)
+	for _, file := range toAdd {
+		result = append(result, &Media{Path: file})
+	}
+	return result
+}
+
 func containsMedia(arr []*Media, needle string) bool {
 	for _, item := range arr {
 		if item.Path == needle {
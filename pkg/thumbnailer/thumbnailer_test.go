@@ -0,0 +1,2514 @@
+package thumbnailer
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func randomContainers(n int) []MediaContainer {
+	r := rand.New(rand.NewSource(1))
+
+	containers := make([]MediaContainer, n)
+	for i := range containers {
+		// one side is always maxThumbSize, like resize.Thumbnail does
+		short := 100 + r.Intn(maxThumbSize-100)
+		if r.Intn(2) == 0 {
+			containers[i].Media = &Media{ThumbWidth: maxThumbSize, ThumbHeight: short}
+		} else {
+			containers[i].Media = &Media{ThumbWidth: short, ThumbHeight: maxThumbSize}
+		}
+	}
+
+	return containers
+}
+
+func BenchmarkPack(b *testing.B) {
+	for _, sortBy := range []SortBy{SortByHeight, SortByWidth, SortByArea, SortByAspect, SortByName} {
+		b.Run(string(sortBy), func(b *testing.B) {
+			containers := randomContainers(maxPerRow * maxRows)
+
+			var area int
+			for i := 0; i < b.N; i++ {
+				sort.Sort(sortBy.sorter(containers))
+				w, h := pack(containers, 0, AlignTop)
+				area = w * h
+			}
+
+			b.ReportMetric(float64(area), "px²")
+		})
+	}
+}
+
+func TestLayout(t *testing.T) {
+	sizes := make([]image.Point, maxPerRow+2)
+	for i := range sizes {
+		sizes[i] = image.Pt(10, 20)
+	}
+	sizes[3] = image.Pt(30, 40)
+
+	tiles, w, h := Layout(sizes)
+
+	if w != (maxPerRow-1)*10+30 || h != 40+20 {
+		t.Errorf("got %dx%d sprite; want %dx%d", w, h, (maxPerRow-1)*10+30, 60)
+	}
+	if tiles[4].Min != image.Pt(60, 0) {
+		t.Errorf("got tile 4 at %v; want (60,0)", tiles[4].Min)
+	}
+	// tiles after maxPerRow wrap to the next row, below the tallest tile
+	if tiles[maxPerRow].Min != image.Pt(0, 40) || tiles[maxPerRow+1].Min != image.Pt(10, 40) {
+		t.Errorf("got wrapped tiles at %v and %v; want (0,40) and (10,40)", tiles[maxPerRow].Min, tiles[maxPerRow+1].Min)
+	}
+}
+
+func TestVerticalAlignCenter(t *testing.T) {
+	sizes := make([]image.Point, maxPerRow+2)
+	for i := range sizes {
+		sizes[i] = image.Pt(10, 20)
+	}
+	sizes[3] = image.Pt(30, 40)
+	sizes[maxPerRow+1] = image.Pt(10, 15)
+
+	tiles, _, h := Layout(sizes)
+	AlignCenter.align(tiles)
+
+	want := map[int]image.Point{
+		0:             image.Pt(0, 10), // (40-20)/2 below the top of the first row
+		3:             image.Pt(30, 0),
+		maxPerRow:     image.Pt(0, 40),
+		maxPerRow + 1: image.Pt(10, 42), // (20-15)/2 rounded down
+	}
+	for i, min := range want {
+		if tiles[i].Min != min {
+			t.Errorf("got tile %d at %v; want %v", i, tiles[i].Min, min)
+		}
+	}
+	if last := tiles[maxPerRow].Max.Y; last != h {
+		t.Errorf("got the tallest tile of the last row ending at %d; want sprite height %d", last, h)
+	}
+}
+
+func TestLayoutPartialLastRow(t *testing.T) {
+	// the last row's first tile is not the tallest one
+	sizes := make([]image.Point, maxPerRow+3)
+	for i := range sizes {
+		sizes[i] = image.Pt(30, 30)
+	}
+	sizes[maxPerRow] = image.Pt(30, 10)
+	sizes[maxPerRow+1] = image.Pt(20, 50)
+	sizes[maxPerRow+2] = image.Pt(40, 25)
+
+	tiles, w, h := Layout(sizes)
+
+	bounds := image.Rect(0, 0, w, h)
+	for i, a := range tiles {
+		if !a.In(bounds) {
+			t.Errorf("tile %d %v is out of sprite bounds %v", i, a, bounds)
+		}
+		for j, b := range tiles[i+1:] {
+			if a.Overlaps(b) {
+				t.Errorf("tile %d %v overlaps tile %d %v", i, a, i+1+j, b)
+			}
+		}
+	}
+	if h != 30+50 {
+		t.Errorf("got height %d; want %d", h, 30+50)
+	}
+}
+
+func TestPack(t *testing.T) {
+	media := []*Media{
+		{Path: "wide.jpg", Width: 1000, Height: 500},
+		{Path: "tall.jpg", Width: 300, Height: 900},
+		{Path: "small.jpg", Width: 100, Height: 50},
+	}
+
+	w, h := Pack(media, Options{SortBy: SortByName})
+
+	want := map[string][4]int{ // x, y, width, height
+		"small.jpg": {0, 0, 100, 50},
+		"tall.jpg":  {100, 0, 108, 324},
+		"wide.jpg":  {208, 0, 324, 162},
+	}
+	for _, m := range media {
+		got := [4]int{m.ThumbXOffset, m.ThumbYOffset, m.ThumbWidth, m.ThumbHeight}
+		if got != want[m.Path] {
+			t.Errorf("%s: got tile %v; want %v", m.Path, got, want[m.Path])
+		}
+		if m.ThumbTotalWidth != w || m.ThumbTotalHeight != h {
+			t.Errorf("%s: got sprite %dx%d; want %dx%d", m.Path, m.ThumbTotalWidth, m.ThumbTotalHeight, w, h)
+		}
+	}
+	if w != 532 || h != 324 {
+		t.Errorf("got sprite %dx%d; want 532x324", w, h)
+	}
+}
+
+type fakeUploader struct {
+	uploaded []string
+	deleted  []string
+}
+
+func (f *fakeUploader) Upload(key string, body []byte) error {
+	f.uploaded = append(f.uploaded, key)
+	return nil
+}
+
+func (f *fakeUploader) Delete(key string) error {
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func writeTestImage(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	switch filepath.Ext(path) {
+	case ".png":
+		err = png.Encode(f, img)
+	default:
+		err = jpeg.Encode(f, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackMatchesGenerateThumbnail(t *testing.T) {
+	tt := map[string]Options{
+		"default":       {},
+		"contact sheet": {ContactSheet: true, VerticalAlign: AlignCenter, Cover: "d.jpg"},
+		"long edge":     {ResizeMode: ResizeLongEdge, VerticalAlign: AlignBottom, SortBy: SortByName},
+		"stretch":       {ThumbMode: ThumbModeStretch, Cover: "b.jpg"},
+	}
+
+	for name, opts := range tt {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 200)
+			writeTestImage(t, filepath.Join(dir, "b.jpg"), 90, 300)
+			writeTestImage(t, filepath.Join(dir, "c.jpg"), 50, 40)
+			writeTestImage(t, filepath.Join(dir, "d.jpg"), 333, 500)
+
+			if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			generated, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+			if err != nil {
+				t.Fatalf("loading thumbs file: %v", err)
+			}
+
+			packed := make([]*Media, len(generated))
+			for i, m := range generated {
+				packed[i] = &Media{Path: m.Path, Width: m.Width, Height: m.Height}
+			}
+			Pack(packed, opts)
+
+			for i, m := range generated {
+				want := [6]int{m.ThumbXOffset, m.ThumbYOffset, m.ThumbWidth, m.ThumbHeight, m.ThumbTotalWidth, m.ThumbTotalHeight}
+				p := packed[i]
+				got := [6]int{p.ThumbXOffset, p.ThumbYOffset, p.ThumbWidth, p.ThumbHeight, p.ThumbTotalWidth, p.ThumbTotalHeight}
+				if got != want {
+					t.Errorf("%s: got tile %v; want %v as generated", m.Path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDirectoryMixedFormats(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpeg"), 20, 40)
+	writeTestImage(t, filepath.Join(dir, "c.png"), 30, 30)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	want := map[string]struct {
+		format      string
+		contentType string
+		sprite      string
+		aspect      float64
+	}{
+		"a.jpg":  {"jpg", "image/jpeg", "thumbnails_0.jpg", 2},
+		"b.jpeg": {"jpg", "image/jpeg", "thumbnails_0.jpg", 0.5},
+		"c.png":  {"png", "image/png", "thumbnails_0.png", 1},
+	}
+
+	if len(media) != len(want) {
+		t.Fatalf("got %d media; want %d", len(media), len(want))
+	}
+
+	for _, m := range media {
+		w := want[m.Path]
+		if m.ThumbFormat != w.format {
+			t.Errorf("%s: got format %q; want %q", m.Path, m.ThumbFormat, w.format)
+		}
+		if m.ThumbContentType != w.contentType {
+			t.Errorf("%s: got content type %q; want %q", m.Path, m.ThumbContentType, w.contentType)
+		}
+		if m.AspectRatio != w.aspect {
+			t.Errorf("%s: got aspect ratio %v; want %v", m.Path, m.AspectRatio, w.aspect)
+		}
+		if !strings.HasPrefix(m.ThumbPath, w.sprite+"?crc=") {
+			t.Errorf("%s: got thumb %q; want %s", m.Path, m.ThumbPath, w.sprite)
+		}
+		if _, err := os.Stat(filepath.Join(dir, w.sprite)); err != nil {
+			t.Errorf("%s: sprite %s not written: %v", m.Path, w.sprite, err)
+		}
+	}
+}
+
+func TestProcessDirectoryFormatGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpeg"), 20, 40)
+
+	opts := Options{FormatGroups: map[string]string{".jpeg": "jpeg"}}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, sprite := range []string{"thumbnails_0.jpg", "thumbnails_0.jpeg"} {
+		if _, err := os.Stat(filepath.Join(dir, sprite)); err != nil {
+			t.Errorf("sprite %s not written: %v", sprite, err)
+		}
+	}
+
+	opts.FormatGroups[".jpeg"] = "gif"
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err == nil {
+		t.Error("got nil error for unsupported sprite format")
+	}
+
+	// existing thumbnails are up to date, use another directory
+	dir = t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "b.jpeg"), 20, 40)
+
+	opts.FallbackFormat = "png"
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error with fallback format: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0.png")); err != nil {
+		t.Errorf("fallback sprite not written: %v", err)
+	}
+
+	// extensions without a dot or in upper case match too
+	dir = t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "b.jpeg"), 20, 40)
+
+	opts = Options{FormatGroups: map[string]string{"JPEG": "png"}}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0.png")); err != nil {
+		t.Errorf("sprite of normalized extension not written: %v", err)
+	}
+}
+
+func TestProcessDirectorySpriteFormatChange(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 20, 40)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{SpriteFormat: "jpg"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{SpriteFormat: "png"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{filepath.Join(dir, "thumbnails_0.png")}; !reflect.DeepEqual(up.uploaded, want) {
+		t.Errorf("got uploads %q; want %q", up.uploaded, want)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		if !strings.HasPrefix(m.ThumbPath, "thumbnails_0.png?crc=") {
+			t.Errorf("%s: got thumb %q; want thumbnails_0.png", m.Path, m.ThumbPath)
+		}
+		if m.ThumbFormat != "png" || m.ThumbContentType != "image/png" {
+			t.Errorf("%s: got format %q, content type %q; want png, image/png", m.Path, m.ThumbFormat, m.ThumbContentType)
+		}
+	}
+}
+
+func TestProcessDirectoryArchive(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	img, err := os.ReadFile(filepath.Join(dir, "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "photos.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"2001/b.jpg", "notes.txt", "../../x.jpg", "/abs.jpg", `..\y.jpg`, "2001/.hidden.jpg", "thumbnails_0.jpg", "empty.jpg"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "empty.jpg" {
+			continue
+		}
+		if _, err = w.Write(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{ReadArchives: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	var paths []string
+	for _, m := range media {
+		paths = append(paths, m.Path)
+		if m.ThumbPath == "" || m.Width != 40 {
+			t.Errorf("%s: no thumbnail", m.Path)
+		}
+	}
+	if want := []string{"a.jpg", "photos.zip/2001/b.jpg"}; strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("got media %q; want %q", paths, want)
+	}
+
+	if !contains(up.uploaded, filepath.Join(dir, "photos.zip/2001/b.jpg")) {
+		t.Errorf("archive entry not uploaded, got %q", up.uploaded)
+	}
+
+	defer func(size int64) { maxRemoteSize = size }(maxRemoteSize)
+	maxRemoteSize = 10
+	if _, err := readArchiveEntry(dir, "photos.zip", "2001/b.jpg"); err == nil || !strings.Contains(err.Error(), "larger than 10 bytes") {
+		t.Errorf("got %v; want an error for size over the limit", err)
+	}
+}
+
+func TestProcessDirectorySocialCard(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 200)
+	writeTestImage(t, filepath.Join(dir, "b.png"), 100, 300)
+
+	opts := Options{SocialCard: true, SocialCardWidth: 600, SocialCardHeight: 315}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, socialCardFile))
+	if err != nil {
+		t.Fatalf("social card not written: %v", err)
+	}
+	defer f.Close()
+
+	config, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 600 || config.Height != 315 {
+		t.Errorf("got %dx%d; want 600x315", config.Width, config.Height)
+	}
+
+	// the card itself is not treated as media
+	files, err := ScanDirectory(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got files %q; want a.jpg and b.png", files)
+	}
+}
+
+func TestProcessDirectoryDecodeError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.jpg"), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ProcessDirectory(dir, &fakeUploader{}, Options{})
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("got %v; want DecodeError", err)
+	}
+	if want := filepath.Join(dir, "broken.jpg"); decodeErr.Path != want {
+		t.Errorf("got path %q; want %q", decodeErr.Path, want)
+	}
+}
+
+func TestScanDirectoryUnicodeCollision(t *testing.T) {
+	dir := t.TempDir()
+
+	// "é" as a single code point (NFC) and as "e" + combining acute accent (NFD)
+	for _, name := range []string{"café.jpg", "café.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := ScanDirectory(dir, Options{})
+	if !errors.Is(err, ErrFilenameCollision) {
+		t.Errorf("got %v; want ErrFilenameCollision", err)
+	}
+}
+
+func TestProcessDirectoryEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	if err := os.WriteFile(filepath.Join(dir, "b.jpg"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 || media[0].Path != "a.jpg" {
+		t.Errorf("got %d media; want only a.jpg", len(media))
+	}
+}
+
+func TestProcessDirectoryExtraSizes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 1000, 500)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 500, 1000)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{ExtraSizes: []int{648}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	for _, m := range media {
+		thumb, ok := m.Thumbs[648]
+		if !ok {
+			t.Fatalf("%s: no 648px thumbnail", m.Path)
+		}
+		if !strings.HasPrefix(thumb.Path, "thumbnails_0_648.jpg?crc=") {
+			t.Errorf("%s: got thumb %q; want thumbnails_0_648.jpg", m.Path, thumb.Path)
+		}
+		if max(thumb.Width, thumb.Height) != 648 || max(m.ThumbWidth, m.ThumbHeight) != maxThumbSize {
+			t.Errorf("%s: got %dx%d and %dx%d tiles", m.Path, m.ThumbWidth, m.ThumbHeight, thumb.Width, thumb.Height)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0_648.jpg")); err != nil {
+		t.Errorf("sprite not written: %v", err)
+	}
+
+	// nothing changed, so nothing is regenerated
+	updated, err := ProcessDirectory(dir, up, Options{ExtraSizes: []int{648}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) != 0 {
+		t.Errorf("got %d updated; want 0", len(updated))
+	}
+}
+
+func TestProcessDirectoryBackfillDimensions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	// .thumbs.yml written before width and height were stored
+	old := `- path: a.jpg
+  thumb: thumbnails_0.jpg?crc=abc
+  thumb_width: 40
+  thumb_height: 20
+  thumb_total_width: 40
+  thumb_total_height: 20
+  blurhash: LKO2?U%2Tw=w]~RBVZRi};RPxuwH
+  blurhash_image_base64: data:image/jpeg;base64,AAAA
+`
+	if err := os.WriteFile(filepath.Join(dir, ".thumbs.yml"), []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := ProcessDirectory(dir, &fakeUploader{}, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) != 0 {
+		t.Errorf("got %d updated; want batch to be skipped", len(updated))
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if media[0].Width != 40 || media[0].Height != 20 {
+		t.Errorf("got %dx%d; want 40x20", media[0].Width, media[0].Height)
+	}
+}
+
+func TestScanDirectoryHiddenFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", ".cover.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		includeHidden bool
+		want          []string
+	}{
+		{false, []string{"a.jpg"}},
+		{true, []string{".cover.jpg", "a.jpg"}},
+	} {
+		files, err := ScanDirectory(dir, Options{IncludeHidden: tc.includeHidden})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Join(files, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("include hidden %t: got %q; want %q", tc.includeHidden, files, tc.want)
+		}
+	}
+}
+
+func TestScanDirectoryGeneratedLookalikes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"cat_thumb.png", "hero.800w.jpg", "og.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts Options
+		want []string
+	}{
+		{Options{}, []string{"cat_thumb.png", "hero.800w.jpg", "og.jpg"}},
+		{Options{VariantWidths: []int{800}}, []string{"cat_thumb.png", "og.jpg"}},
+		{Options{IndividualFormats: map[string]bool{"png": true}}, []string{"hero.800w.jpg", "og.jpg"}},
+		{Options{SocialCard: true}, []string{"cat_thumb.png", "hero.800w.jpg"}},
+	} {
+		files, err := ScanDirectory(dir, tc.opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Join(files, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%+v: got %q; want %q", tc.opts, files, tc.want)
+		}
+	}
+}
+
+func TestIsGenerated(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want bool
+	}{
+		{"thumbnails_0.jpg", Options{}, true},
+		{previewFile, Options{}, false},
+		{previewFile, Options{AnimatedPreview: true}, true},
+		{faviconFile, Options{}, false},
+		{faviconFile, Options{FaviconSource: "media/logo.png"}, true},
+	} {
+		if got := IsGenerated(tc.name, tc.opts); got != tc.want {
+			t.Errorf("%s with %+v: got %t; want %t", tc.name, tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestProcessDirectorySpritePrefix(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.png"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.png"), 20, 40)
+
+	opts := Options{SpritePrefix: "sprite-"}
+	for run := 0; run < 2; run++ {
+		if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+			t.Fatalf("run %d: unexpected error: %v", run, err)
+		}
+	}
+
+	// the sprite is written with the prefix and not picked up as media by the next run
+	refs := thumbPaths(t, dir)
+	if len(refs) != 2 {
+		t.Errorf("got media %q; want a.png and b.png", refs)
+	}
+	for path, ref := range refs {
+		if !strings.HasPrefix(ref, "sprite-0.png") {
+			t.Errorf("%s: got thumb %q; want sprite-0.png", path, ref)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0.png")); !os.IsNotExist(err) {
+		t.Errorf("sprite with the default prefix was written: %v", err)
+	}
+	files, err := ScanDirectory(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(files, ",") != "a.png,b.png" {
+		t.Errorf("got files %q; want a.png, b.png", files)
+	}
+}
+
+func TestProcessDirectoryForceBlurhashOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	thumbsFile := filepath.Join(dir, ".thumbs.yml")
+	media, err := LoadThumbsFile(thumbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBlurhash := media[0].Blurhash
+	media[0].Blurhash = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+	if err = SaveThumbsFile(thumbsFile, media); err != nil {
+		t.Fatal(err)
+	}
+
+	sprite := filepath.Join(dir, "thumbnails_0.jpg")
+	before, err := os.Stat(sprite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := &fakeUploader{}
+	updated, err := ProcessDirectory(dir, up, Options{ForceBlurhash: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) != 0 || len(up.uploaded) != 0 {
+		t.Errorf("got %d updated and uploads %q; want none", len(updated), up.uploaded)
+	}
+
+	after, err := os.Stat(sprite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("sprite was rewritten")
+	}
+
+	media, err = LoadThumbsFile(thumbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media[0].Blurhash != wantBlurhash {
+		t.Errorf("got blurhash %q; want %q", media[0].Blurhash, wantBlurhash)
+	}
+
+	// sprites are still checked, and regenerated for other changes
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, Options{ForceBlurhash: true, ExtraSizes: []int{100}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "thumbnails_0_100.jpg")); err != nil {
+		t.Errorf("sprite of the extra size was not written: %v", err)
+	}
+}
+
+func TestProcessDirectorySkipThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{SkipThumbnails: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 {
+		t.Fatalf("got %d media; want 1", len(media))
+	}
+
+	m := media[0]
+	if m.Width != 40 || m.Height != 20 || m.Blurhash == "" {
+		t.Errorf("got %dx%d, blurhash %q; want 40x20 with blurhash", m.Width, m.Height, m.Blurhash)
+	}
+	if m.ThumbPath != "" || m.ThumbWidth != 0 {
+		t.Errorf("got thumb %q of width %d; want none", m.ThumbPath, m.ThumbWidth)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0.jpg")); !os.IsNotExist(err) {
+		t.Errorf("sprite was written: %v", err)
+	}
+	if len(up.uploaded) != 1 || up.uploaded[0] != filepath.Join(dir, "a.jpg") {
+		t.Errorf("got uploaded %v; want only a.jpg", up.uploaded)
+	}
+}
+
+func TestGeneratePreviewDefaultFrameDuration(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	if err := generatePreview(&fakeUploader{}, []*Media{{Path: "a.jpg"}}, dir, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, previewFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(b, []byte("ANMF"))
+	if i < 0 || len(b) < i+8+15 {
+		t.Fatalf("no frame in preview")
+	}
+	// frame duration is a 24-bit little-endian value after the frame offsets and size
+	d := b[i+8+12:]
+	if got := int(d[0]) | int(d[1])<<8 | int(d[2])<<16; got != 500 {
+		t.Errorf("got frame duration %dms; want 500ms", got)
+	}
+}
+
+func TestGenerateFavicon(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "logo.png"), 40, 20)
+
+	up := &fakeUploader{}
+	if err := GenerateFavicon(up, filepath.Join(dir, "logo.png"), Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, faviconFile))
+	if err != nil {
+		t.Fatalf("reading favicon: %v", err)
+	}
+	if n := int(data[4]); n != len(faviconSizes) {
+		t.Errorf("got %d layers; want %d", n, len(faviconSizes))
+	}
+	if len(up.uploaded) != 1 || up.uploaded[0] != filepath.Join(dir, faviconFile) {
+		t.Errorf("got uploaded %v; want favicon", up.uploaded)
+	}
+}
+
+func TestProcessDirectoryAnimatedPNG(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "still.png"), 20, 20)
+	writeTestImage(t, filepath.Join(dir, "animated.png"), 20, 20)
+
+	// insert animation control chunk after IHDR, which is 8+25 bytes long with signature
+	path := filepath.Join(dir, "animated.png")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := []byte("\x00\x00\x00\x08acTL\x00\x00\x00\x01\x00\x00\x00\x00")
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	content = append(content[:33:33], append(chunk, content[33:]...)...)
+	if err = os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		if want := m.Path == "animated.png"; m.Animated != want {
+			t.Errorf("%s: got animated %t; want %t", m.Path, m.Animated, want)
+		}
+	}
+}
+
+func TestGenerateAtlases(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{filepath.Join(root, "a"), filepath.Join(root, "b")}
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestImage(t, filepath.Join(dir, "1.jpg"), 40, 20)
+		writeTestImage(t, filepath.Join(dir, "2.jpg"), 20, 40)
+		if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+			t.Fatalf("processing %s: %v", dir, err)
+		}
+	}
+
+	up := &fakeUploader{}
+	if err := GenerateAtlases(up, root, dirs, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tiles, err := loadAtlasFile(filepath.Join(root, atlasFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 4 {
+		t.Fatalf("got %d tiles; want 4", len(tiles))
+	}
+
+	atlas, err := Options{}.readImage(root, "thumbnails_atlas_0.jpg")
+	if err != nil {
+		t.Fatalf("reading atlas: %v", err)
+	}
+
+	for _, tile := range tiles {
+		if !strings.HasPrefix(tile.Atlas, "thumbnails_atlas_0.jpg?crc=") {
+			t.Errorf("%s: got atlas %q", tile.Path, tile.Atlas)
+		}
+		// test images are red
+		r, g, _, _ := atlas.At(tile.XOffset+tile.Width/2, tile.YOffset+tile.Height/2).RGBA()
+		if r>>8 < 200 || g>>8 > 50 {
+			t.Errorf("%s: tile is not drawn", tile.Path)
+		}
+	}
+	if tiles[0].Path != "a/1.jpg" && tiles[0].Path != "a/2.jpg" {
+		t.Errorf("got first tile path %q; want relative to root", tiles[0].Path)
+	}
+	if len(up.uploaded) != 1 {
+		t.Errorf("got uploaded %v; want a single atlas", up.uploaded)
+	}
+
+	// unchanged atlases are not written again
+	up = &fakeUploader{}
+	if err = GenerateAtlases(up, root, dirs, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(up.uploaded) != 0 {
+		t.Errorf("got uploaded %v for unchanged atlas", up.uploaded)
+	}
+	if kept, _ := loadAtlasFile(filepath.Join(root, atlasFile)); !reflect.DeepEqual(kept, tiles) {
+		t.Errorf("got tiles %+v; want them kept as %+v", kept, tiles)
+	}
+
+	// a changed sprite of any directory rewrites the atlas
+	writeTestImage(t, filepath.Join(dirs[1], "3.jpg"), 30, 30)
+	if _, err = ProcessDirectory(dirs[1], &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("processing %s: %v", dirs[1], err)
+	}
+	up = &fakeUploader{}
+	if err = GenerateAtlases(up, root, dirs, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(up.uploaded) != 1 {
+		t.Errorf("got uploaded %v; want the atlas rewritten", up.uploaded)
+	}
+}
+
+func TestProcessDirectoryDetectChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jpg")
+	writeTestImage(t, path, 40, 20)
+
+	opts := Options{DetectChanges: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// unchanged file is not uploaded again
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(up.uploaded) != 0 {
+		t.Errorf("got uploaded %v for unchanged directory; want none", up.uploaded)
+	}
+
+	writeTestImage(t, path, 20, 40)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	up = &fakeUploader{}
+	updated, err := ProcessDirectory(dir, up, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) != 1 {
+		t.Errorf("got %d updated; want 1", len(updated))
+	}
+	if len(up.uploaded) != 2 || up.uploaded[0] != path {
+		t.Errorf("got uploaded %v; want a.jpg and its sprite", up.uploaded)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if m := media[0]; m.Width != 20 || m.Height != 40 || m.Checksum == "" {
+		t.Errorf("got %dx%d with checksum %q; want 20x40 with checksum", m.Width, m.Height, m.Checksum)
+	}
+}
+
+// writePattern writes a grayscale PNG of a smooth random pattern
+// that looks the same at any size; rotated patterns are transposed.
+func writePattern(t *testing.T, path string, width, height int, rotated bool) {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(1))
+	var amplitudes [6][6]float64
+	for i := range amplitudes {
+		for j := range amplitudes[i] {
+			amplitudes[i][j] = r.Float64()*2 - 1
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			if rotated {
+				u, v = v, u
+			}
+			var sum float64
+			for i := range amplitudes {
+				for j := range amplitudes[i] {
+					sum += amplitudes[i][j] * math.Cos(float64(i)*math.Pi*u) * math.Cos(float64(j)*math.Pi*v)
+				}
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(max(0, min(255, 128+sum*20)))})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err = png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessDirectoryDedup(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, filepath.Join(dir, "a.png"), 60, 40, false)
+	writePattern(t, filepath.Join(dir, "a-copy.png"), 120, 80, false)
+	writePattern(t, filepath.Join(dir, "b.png"), 60, 40, true)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{Dedup: true, DedupThreshold: 4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	tiles := map[string]image.Point{}
+	for _, m := range media {
+		tiles[m.Path] = image.Pt(m.ThumbXOffset, m.ThumbYOffset)
+		// a-copy.png comes first and is kept
+		if m.ThumbTotalWidth != 120+60 {
+			t.Errorf("%s: got sprite width %d; want %d for two tiles", m.Path, m.ThumbTotalWidth, 120+60)
+		}
+	}
+	if tiles["a.png"] != tiles["a-copy.png"] {
+		t.Errorf("got tiles %v and %v of identical images; want the same", tiles["a.png"], tiles["a-copy.png"])
+	}
+	if tiles["a.png"] == tiles["b.png"] {
+		t.Errorf("got the same tile %v for different images", tiles["a.png"])
+	}
+}
+
+func TestProcessDirectoryAltText(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 20)
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg.txt"), []byte("A red square\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecarUploaded := func(up *fakeUploader) bool {
+		for _, key := range up.uploaded {
+			if key == filepath.Join(dir, "a.jpg.txt") {
+				return true
+			}
+		}
+		return false
+	}
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sidecarUploaded(up) {
+		t.Errorf("got uploaded %v; want no a.jpg.txt without UploadAltText", up.uploaded)
+	}
+
+	// the text is unchanged, but the sidecar was never uploaded
+	up = &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{UploadAltText: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	want := map[string]string{"a.jpg": "A red square", "b.jpg": ""}
+	for _, m := range media {
+		if m.Alt != want[m.Path] {
+			t.Errorf("%s: got alt %q; want %q", m.Path, m.Alt, want[m.Path])
+		}
+	}
+
+	if !sidecarUploaded(up) {
+		t.Errorf("got uploaded %v; want a.jpg.txt among them", up.uploaded)
+	}
+
+	up = &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{UploadAltText: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sidecarUploaded(up) {
+		t.Errorf("got uploaded %v; want no a.jpg.txt uploaded again", up.uploaded)
+	}
+}
+
+func TestProcessDirectoryLogger(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	var buf bytes.Buffer
+	opts := Options{Logger: log.New(&buf)}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("got %d log lines; want at least 2", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "dir="+dir) {
+			t.Errorf("log line %q has no dir field", line)
+		}
+	}
+}
+
+func TestProcessDirectoryStretch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 200)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 100, 300)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{ThumbMode: ThumbModeStretch}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		if m.ThumbWidth != maxThumbSize || m.ThumbHeight != maxThumbSize {
+			t.Errorf("%s: got tile %dx%d; want %dx%[3]d", m.Path, m.ThumbWidth, m.ThumbHeight, maxThumbSize)
+		}
+		if m.ThumbTotalWidth != 2*maxThumbSize || m.ThumbTotalHeight != maxThumbSize {
+			t.Errorf("%s: got sprite %dx%d; want %dx%d", m.Path, m.ThumbTotalWidth, m.ThumbTotalHeight, 2*maxThumbSize, maxThumbSize)
+		}
+	}
+
+	// switching back regenerates tiles with the aspect ratio kept
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if media, err = LoadThumbsFile(filepath.Join(dir, ".thumbs.yml")); err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		w, h := thumbSize(m.Width, m.Height, maxThumbSize)
+		if m.ThumbWidth != w || m.ThumbHeight != h {
+			t.Errorf("%s: got tile %dx%d; want %dx%d", m.Path, m.ThumbWidth, m.ThumbHeight, w, h)
+		}
+	}
+}
+
+func TestProcessDirectoryNoUpload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	if err := os.WriteFile(filepath.Join(dir, noUploadFile), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(up.uploaded) != 0 {
+		t.Errorf("got uploaded %v; want none", up.uploaded)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbnails_0.jpg")); err != nil {
+		t.Errorf("sprite was not written: %v", err)
+	}
+	if _, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml")); err != nil {
+		t.Errorf("loading thumbs file: %v", err)
+	}
+}
+
+func TestProcessDirectoryBlurhashMinSize(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "icon.png"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "photo.jpg"), 200, 100)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{BlurhashMinSize: 32}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		want := m.Path == "photo.jpg"
+		if got := m.Blurhash != "" && m.BlurhashImageBase64 != ""; got != want {
+			t.Errorf("%s: got blurhash %q; want one: %t", m.Path, m.Blurhash, want)
+		}
+	}
+}
+
+func TestGenerateThumbnailInfo(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 200)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 100, 300)
+
+	media := []*Media{{Path: "a.jpg"}, {Path: "b.jpg"}}
+	data, info, err := GenerateThumbnail(media, dir, "jpg", Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding sprite: %v", err)
+	}
+	want := SpriteInfo{TotalWidth: config.Width, TotalHeight: config.Height, Tiles: 2}
+	if info != want {
+		t.Errorf("got %+v; want %+v", info, want)
+	}
+}
+
+type bodyUploader struct {
+	fakeUploader
+	bodies map[string][]byte
+}
+
+func (b *bodyUploader) Upload(key string, body []byte) error {
+	b.bodies[key] = body
+	return b.fakeUploader.Upload(key, body)
+}
+
+// fileUploader records keys of files uploaded by streaming them.
+type fileUploader struct {
+	fakeUploader
+	files map[string]string // key -> content
+}
+
+func (f *fileUploader) UploadFile(key, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f.files[key] = string(b)
+	return nil
+}
+
+func TestProcessDirectoryStreamsSprites(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	up := &fileUploader{files: map[string]string{}}
+	if _, err := ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sprite := filepath.Join(dir, "thumbnails_0.jpg")
+	want, err := os.ReadFile(sprite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := up.files[sprite]; !ok || got != string(want) {
+		t.Errorf("sprite was not streamed from the file")
+	}
+	for _, key := range up.uploaded {
+		if key == sprite {
+			t.Errorf("sprite was uploaded from memory")
+		}
+	}
+}
+
+func TestProcessDirectoryMaxOriginalDimension(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 200)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 80, 60)
+
+	up := &bodyUploader{bodies: map[string][]byte{}}
+	if _, err := ProcessDirectory(dir, up, Options{MaxOriginalDimension: 100}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	want := map[string][4]int{
+		"a.jpg": {400, 200, 100, 50},
+		"b.jpg": {80, 60, 0, 0}, // uploaded as is
+	}
+	for _, m := range media {
+		if got := [4]int{m.Width, m.Height, m.StoredWidth, m.StoredHeight}; got != want[m.Path] {
+			t.Errorf("%s: got width, height, stored width and height %v; want %v", m.Path, got, want[m.Path])
+		}
+
+		config, err := jpeg.DecodeConfig(bytes.NewReader(up.bodies[filepath.Join(dir, m.Path)]))
+		if err != nil {
+			t.Fatalf("%s: decoding uploaded file: %v", m.Path, err)
+		}
+		w := m.Width
+		if m.StoredWidth != 0 {
+			w = m.StoredWidth
+		}
+		if config.Width != w {
+			t.Errorf("%s: uploaded image is %d wide; want %d", m.Path, config.Width, w)
+		}
+	}
+}
+
+func TestProcessDirectoryBaseURL(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "My Photos")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	opts := Options{BaseURL: "https://media.example.com/", MediaDir: root, NoCRCSuffix: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	m := media[0]
+	if want := "https://media.example.com/My%20Photos/a.jpg"; m.URL != want {
+		t.Errorf("got URL %q; want %q", m.URL, want)
+	}
+	if want := "https://media.example.com/My%20Photos/thumbnails_0.jpg"; m.ThumbURL != want {
+		t.Errorf("got thumb URL %q; want %q", m.ThumbURL, want)
+	}
+	if m.Path != "a.jpg" || m.ThumbPath != "thumbnails_0.jpg" {
+		t.Errorf("got paths %q and %q; want them relative", m.Path, m.ThumbPath)
+	}
+}
+
+func TestBackfillBlurhashes(t *testing.T) {
+	dir := t.TempDir()
+	if err := BackfillBlurhashes(dir, Options{}); !errors.Is(err, ErrThumbYamlNotFound) {
+		t.Fatalf("got %v; want ErrThumbYamlNotFound", err)
+	}
+
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 20) // not listed, ignored
+	media := []*Media{{Path: "a.jpg", ThumbPath: "thumbnails_0.jpg"}}
+	if err := SaveThumbsFile(filepath.Join(dir, ".thumbs.yml"), media); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BackfillBlurhashes(dir, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 || media[0].Blurhash == "" || media[0].ThumbPath != "thumbnails_0.jpg" {
+		t.Errorf("got %+v; want only a.jpg with blurhash", media)
+	}
+}
+
+func TestProcessDirectoryCover(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 100, 300)
+	writeTestImage(t, filepath.Join(dir, "cover.jpg"), 400, 200) // shortest, last by height
+	writeTestImage(t, filepath.Join(dir, "c.jpg"), 200, 300)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{Cover: "cover.jpg"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	tiles := make([]image.Rectangle, len(media))
+	for i, m := range media {
+		tiles[i] = image.Rect(m.ThumbXOffset, m.ThumbYOffset, m.ThumbXOffset+m.ThumbWidth, m.ThumbYOffset+m.ThumbHeight)
+		if m.Path == "cover.jpg" && tiles[i].Min != (image.Point{}) {
+			t.Errorf("got cover at %v; want it first", tiles[i].Min)
+		}
+	}
+	for i := range tiles {
+		for j := i + 1; j < len(tiles); j++ {
+			if tiles[i].Overlaps(tiles[j]) {
+				t.Errorf("tiles of %s and %s overlap", media[i].Path, media[j].Path)
+			}
+		}
+	}
+}
+
+func TestProcessDirectoryContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.png"), 20, 40)
+
+	opts := Options{ContentAddressed: true, DetectChanges: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before := thumbPaths(t, dir)
+
+	// only the JPEG sprite changes
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 60, 20)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after := thumbPaths(t, dir)
+
+	if after["a.jpg"] == before["a.jpg"] {
+		t.Errorf("got the same sprite name %q for changed content", after["a.jpg"])
+	}
+	if after["b.png"] != before["b.png"] {
+		t.Errorf("got sprite %q of unchanged content; want %q", after["b.png"], before["b.png"])
+	}
+
+	stale := filepath.Join(dir, before["a.jpg"])
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale sprite %s was not removed: %v", before["a.jpg"], err)
+	}
+	if want := []string{stale}; !reflect.DeepEqual(up.deleted, want) {
+		t.Errorf("got deleted %q; want %q", up.deleted, want)
+	}
+	for _, name := range after {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("current sprite %s is missing: %v", name, err)
+		}
+	}
+}
+
+func TestProcessDirectorySkipThumbnailsContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+
+	opts := Options{ContentAddressed: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sprite := filepath.Join(dir, thumbPaths(t, dir)["a.jpg"])
+
+	// the sprite is not referenced anymore and is not kept as a stale file
+	opts.SkipThumbnails = true
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := thumbPaths(t, dir)["a.jpg"]; got != "" {
+		t.Errorf("got thumb %q; want none", got)
+	}
+	if _, err := os.Stat(sprite); !os.IsNotExist(err) {
+		t.Errorf("sprite %s was not removed: %v", sprite, err)
+	}
+	if want := []string{sprite}; !reflect.DeepEqual(up.deleted, want) {
+		t.Errorf("got deleted %q; want %q", up.deleted, want)
+	}
+}
+
+// thumbPaths returns sprite file names of media in the thumbs file of dir by media path.
+func thumbPaths(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	result := make(map[string]string, len(media))
+	for _, m := range media {
+		result[m.Path] = m.ThumbPath
+	}
+	return result
+}
+
+func TestProcessDirectoryNoPrune(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 20, 40)
+
+	opts := Options{NoPrune: true, ContentAddressed: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	// b.jpg is not checked out, c.jpg is new
+	if err = os.Remove(filepath.Join(dir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "c.jpg"), 30, 30)
+
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	var paths []string
+	for _, m := range media {
+		paths = append(paths, m.Path)
+		if m.Path == "b.jpg" && m.ThumbPath != before[1].ThumbPath {
+			t.Errorf("got b.jpg thumb %q; want it kept as %q", m.ThumbPath, before[1].ThumbPath)
+		}
+	}
+	if want := "a.jpg,c.jpg,b.jpg"; strings.Join(paths, ",") != want {
+		t.Errorf("got media %v; want %s", paths, want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, before[1].ThumbPath)); err != nil {
+		t.Errorf("sprite of b.jpg was deleted: %v", err)
+	}
+
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, Options{NoPrune: true}); err == nil {
+		t.Error("got no error without content addressed thumbnails")
+	}
+}
+
+func TestProcessDirectoryContactSheet(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.png"), 100, 50)
+	writeTestImage(t, filepath.Join(dir, "b.png"), 50, 80)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{ContactSheet: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "thumbnails_0.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sprite, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decoding sprite: %v", err)
+	}
+
+	labelHeight := Options{ContactSheet: true}.labelHeight()
+	for _, m := range media {
+		if want := 80 + labelHeight; m.ThumbTotalHeight != want || sprite.Bounds().Dy() != want {
+			t.Errorf("%s: got total height %d, sprite height %d; want %d", m.Path, m.ThumbTotalHeight, sprite.Bounds().Dy(), want)
+		}
+		if m.ThumbLabelHeight != labelHeight {
+			t.Errorf("%s: got label height %d; want %d", m.Path, m.ThumbLabelHeight, labelHeight)
+		}
+
+		// some pixels of the label strip are dark
+		strip := image.Rect(m.ThumbXOffset, m.ThumbYOffset+m.ThumbHeight, m.ThumbXOffset+m.ThumbWidth, m.ThumbYOffset+m.ThumbHeight+labelHeight)
+		var dark int
+		for y := strip.Min.Y; y < strip.Max.Y; y++ {
+			for x := strip.Min.X; x < strip.Max.X; x++ {
+				if r, _, _, _ := sprite.At(x, y).RGBA(); r < 0x8000 {
+					dark++
+				}
+			}
+		}
+		if dark == 0 {
+			t.Errorf("%s: label was not drawn", m.Path)
+		}
+	}
+
+	// turning it off regenerates the sprite without labels
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	media, err = LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	for _, m := range media {
+		if m.ThumbTotalHeight != 80 || m.ThumbLabelHeight != 0 {
+			t.Errorf("%s: got total height %d, label height %d; want 80, 0", m.Path, m.ThumbTotalHeight, m.ThumbLabelHeight)
+		}
+	}
+}
+
+func TestProcessDirectoryDenylist(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 20)
+	writeTestImage(t, filepath.Join(dir, "placeholder.jpg"), 20, 20)
+
+	content, err := os.ReadFile(filepath.Join(dir, "placeholder.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := &fakeUploader{}
+	opts := Options{Denylist: map[string]bool{checksum(content): true}}
+	if _, err = ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 || media[0].Path != "a.jpg" {
+		t.Errorf("got %d media; want only a.jpg", len(media))
+	}
+	for _, key := range up.uploaded {
+		if filepath.Base(key) == "placeholder.jpg" {
+			t.Errorf("denylisted file was uploaded")
+		}
+	}
+
+	// unchanged files are not read again for their checksums
+	defer func() { osReadFile = os.ReadFile }()
+	var reads []string
+	osReadFile = func(name string) ([]byte, error) {
+		reads = append(reads, filepath.Base(name))
+		return os.ReadFile(name)
+	}
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range reads {
+		if name == "a.jpg" {
+			t.Errorf("unchanged a.jpg was read again, reads: %q", reads)
+			break
+		}
+	}
+}
+
+func TestProcessDirectoryVariants(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "wide.jpg"), 600, 300)
+	writeTestImage(t, filepath.Join(dir, "tall.jpg"), 300, 600)
+	writeTestImage(t, filepath.Join(dir, "small.jpg"), 200, 100)
+
+	opts := Options{VariantWidths: []int{400, 100, 800}, VariantMinWidth: 300}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	want := map[string][]Variant{
+		"wide.jpg": {{"wide.100w.jpg", 100, 50}, {"wide.400w.jpg", 400, 200}},
+	}
+	for _, m := range media {
+		if !reflect.DeepEqual(m.Variants, want[m.Path]) {
+			t.Errorf("%s: got variants %+v; want %+v", m.Path, m.Variants, want[m.Path])
+		}
+	}
+	for _, v := range want["wide.jpg"] {
+		if _, err := os.Stat(filepath.Join(dir, v.Path)); err != nil {
+			t.Errorf("variant was not written: %v", err)
+		}
+	}
+
+	// variants are not media
+	files, err := ScanDirectory(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(files, ","); got != "small.jpg,tall.jpg,wide.jpg" {
+		t.Errorf("got files %s", got)
+	}
+
+	// variants of widths not generated anymore are deleted
+	opts.VariantWidths = []int{400}
+	up := &fakeUploader{}
+	if _, err = ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{filepath.Join(dir, "wide.100w.jpg")}; !reflect.DeepEqual(up.deleted, want) {
+		t.Errorf("got deletes %q; want %q", up.deleted, want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "wide.100w.jpg")); !os.IsNotExist(err) {
+		t.Errorf("wide.100w.jpg was not removed: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "wide.400w.jpg")); err != nil {
+		t.Errorf("wide.400w.jpg was removed: %v", err)
+	}
+}
+
+func TestBlurhashImageSize(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 80, 40)
+
+	opts := Options{BlurhashImageSize: 16}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(media[0].BlurhashImageBase64, "data:image/jpeg;base64,"))
+	if err != nil {
+		t.Fatalf("decoding data URI: %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding preview image: %v", err)
+	}
+	if cfg.Width != 16 || cfg.Height != 8 {
+		t.Errorf("got preview image %dx%d; want 16x8", cfg.Width, cfg.Height)
+	}
+}
+
+func TestProcessDirectoryDiff(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	thumbsFile := filepath.Join(dir, ".thumbs.yml")
+	before, err := os.ReadFile(thumbsFile)
+	if err != nil {
+		t.Fatalf("reading thumbs file: %v", err)
+	}
+
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 30)
+
+	var (
+		out bytes.Buffer
+		up  fakeUploader
+	)
+	if _, err = ProcessDirectory(dir, &up, Options{Diff: &out}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if after, _ := os.ReadFile(thumbsFile); !bytes.Equal(before, after) {
+		t.Error("thumbs file was written")
+	}
+	if len(up.uploaded) > 0 {
+		t.Errorf("got uploads %q", up.uploaded)
+	}
+	if diff := out.String(); !strings.HasPrefix(diff, "--- "+thumbsFile) || !strings.Contains(diff, "\n+    - path: b.jpg\n") {
+		t.Errorf("got diff:\n%s", diff)
+	}
+}
+
+// readDir returns contents of all files in dir by their names.
+func readDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = content
+	}
+	return files
+}
+
+func TestProcessDirectoryDiffDryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 30)
+
+	opts := Options{ContentAddressed: true, VariantWidths: []int{200}, AnimatedPreview: true, SocialCard: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// changes the sprite, so the current one would be stale, and needs a variant
+	if err := os.Remove(filepath.Join(dir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "c.jpg"), 400, 300)
+	before := readDir(t, dir)
+
+	opts.Diff = io.Discard
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if after := readDir(t, dir); !reflect.DeepEqual(before, after) {
+		var names []string
+		for name := range after {
+			if !bytes.Equal(before[name], after[name]) {
+				names = append(names, name)
+			}
+		}
+		for name := range before {
+			if _, ok := after[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		t.Errorf("directory changed: %q", names)
+	}
+	if len(up.uploaded) > 0 || len(up.deleted) > 0 {
+		t.Errorf("got uploads %q, deletes %q", up.uploaded, up.deleted)
+	}
+}
+
+// writeRotatedImage writes a JPEG whose left half is red and right half is blue,
+// with EXIF orientation 6, so it's displayed upright rotated 90° clockwise: red on top.
+func writeRotatedImage(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, width/2, height), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// APP1 segment with a big-endian TIFF header and a single IFD entry: orientation (SHORT) 6
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	app1 := append([]byte{0xff, 0xe1, 0, 0}, exif...)
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(exif)+2))
+
+	content := append(append([]byte{0xff, 0xd8}, app1...), b.Bytes()[2:]...)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// isRed reports whether the color is close to red, allowing for compression artifacts.
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r>>8 > 200 && b>>8 < 60
+}
+
+func TestProcessDirectoryOrientation(t *testing.T) {
+	dir := t.TempDir()
+	writeRotatedImage(t, filepath.Join(dir, "a.jpg"), 80, 40)
+
+	up := &bodyUploader{bodies: map[string][]byte{}}
+	if _, err := ProcessDirectory(dir, up, Options{MaxOriginalDimension: 40}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	m := media[0]
+	if got := [4]int{m.Width, m.Height, m.StoredWidth, m.StoredHeight}; got != [4]int{40, 80, 20, 40} {
+		t.Errorf("got width, height, stored width and height %v; want upright [40 80 20 40]", got)
+	}
+
+	// derivatives are decoded without applying EXIF orientation,
+	// as viewers would if it was left in them, and must be upright already
+	original, err := jpeg.Decode(bytes.NewReader(up.bodies[filepath.Join(dir, "a.jpg")]))
+	if err != nil {
+		t.Fatalf("decoding uploaded original: %v", err)
+	}
+	if b := original.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("got uploaded original %dx%d; want 20x40", b.Dx(), b.Dy())
+	}
+	if !isRed(original.At(10, 5)) || isRed(original.At(10, 35)) {
+		t.Error("uploaded original is not upright")
+	}
+
+	f, err := os.Open(filepath.Join(dir, "thumbnails_0.jpg"))
+	if err != nil {
+		t.Fatalf("opening sprite: %v", err)
+	}
+	defer f.Close()
+	sprite, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("decoding sprite: %v", err)
+	}
+	if m.ThumbWidth != 40 || m.ThumbHeight != 80 {
+		t.Errorf("got tile %dx%d; want 40x80", m.ThumbWidth, m.ThumbHeight)
+	}
+	if !isRed(sprite.At(m.ThumbXOffset+20, m.ThumbYOffset+10)) || isRed(sprite.At(m.ThumbXOffset+20, m.ThumbYOffset+70)) {
+		t.Error("tile is not upright")
+	}
+}
+
+func TestProcessDirectoryAppendOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "c.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "d.jpg"), 40, 30)
+
+	opts := Options{AppendOnly: true, BatchSize: 2}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before := map[string][]byte{}
+	for _, name := range []string{"thumbnails_0.jpg", "thumbnails_1.jpg"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[name] = content
+	}
+
+	// would be in the first sprite otherwise
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{filepath.Join(dir, "a.jpg"), filepath.Join(dir, "thumbnails_2.jpg")}; !reflect.DeepEqual(up.uploaded, want) {
+		t.Errorf("got uploads %q; want %q", up.uploaded, want)
+	}
+	for name, content := range before {
+		if after, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(content, after) {
+			t.Errorf("%s was changed", name)
+		}
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	want := map[string]string{"a.jpg": "thumbnails_2.jpg", "b.jpg": "thumbnails_0.jpg", "c.jpg": "thumbnails_0.jpg", "d.jpg": "thumbnails_1.jpg"}
+	for _, m := range media {
+		if sprite, _, _ := strings.Cut(m.ThumbPath, "?"); sprite != want[m.Path] {
+			t.Errorf("%s: got sprite %s; want %s", m.Path, sprite, want[m.Path])
+		}
+	}
+}
+
+func TestProcessDirectoryStats(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 30)
+
+	stats := &Stats{}
+	opts := Options{Stats: stats}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := StatsSnapshot{Directories: 2, Added: 2, Deleted: 1, Sprites: 1}
+	if got := stats.Snapshot(); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestProcessDirectoryRename(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 30, 40)
+
+	opts := Options{DetectRenames: true}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	if err = os.Rename(filepath.Join(dir, "b.jpg"), filepath.Join(dir, "c.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &fakeUploader{}
+	updated, err := ProcessDirectory(dir, up, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) > 0 {
+		t.Errorf("got updated thumbnails %v; want none", updated)
+	}
+	if want := []string{filepath.Join(dir, "c.jpg")}; !reflect.DeepEqual(up.uploaded, want) {
+		t.Errorf("got uploads %q; want %q", up.uploaded, want)
+	}
+	if want := []string{filepath.Join(dir, "b.jpg")}; !reflect.DeepEqual(up.deleted, want) {
+		t.Errorf("got deletions %q; want %q", up.deleted, want)
+	}
+
+	after, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(after) != 2 || after[1].Path != "c.jpg" {
+		t.Fatalf("got media %+v", after)
+	}
+	if after[1].ThumbPath != before[1].ThumbPath || after[1].ThumbXOffset != before[1].ThumbXOffset || after[1].Blurhash != before[1].Blurhash {
+		t.Errorf("renamed file lost its thumbnail: got %+v; had %+v", after[1], before[1])
+	}
+}
+
+func TestProcessDirectoryIndividualFormats(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "logo.png"), 30, 30)
+	writeTestImage(t, filepath.Join(dir, "icon.png"), 20, 40)
+
+	opts := Options{IndividualFormats: map[string]bool{"png": true}}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+
+	want := map[string][3]any{
+		"a.jpg":    {"thumbnails_0.jpg", 80, 30},
+		"b.jpg":    {"thumbnails_0.jpg", 80, 30},
+		"icon.png": {"icon_thumb.png", 20, 40},
+		"logo.png": {"logo_thumb.png", 30, 30},
+	}
+	for _, m := range media {
+		sprite, _, _ := strings.Cut(m.ThumbPath, "?")
+		if got := [3]any{sprite, m.ThumbTotalWidth, m.ThumbTotalHeight}; got != want[m.Path] {
+			t.Errorf("%s: got thumb, total width and height %v; want %v", m.Path, got, want[m.Path])
+		}
+	}
+
+	// individual thumbnails are not media and are not regenerated
+	up := &fakeUploader{}
+	updated, err := ProcessDirectory(dir, up, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated) > 0 || len(up.uploaded) > 0 {
+		t.Errorf("got updated %v and uploads %q on the second run", updated, up.uploaded)
+	}
+}
+
+func TestVerifySprites(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mismatches, err := VerifySprites(dir, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("got mismatches %v for untouched sprites", mismatches)
+	}
+
+	sprite := filepath.Join(dir, "thumbnails_0.jpg")
+	if err = os.WriteFile(sprite, []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err = VerifySprites(dir, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Path != sprite || mismatches[0].Have != checksum([]byte("edited")) {
+		t.Errorf("got mismatches %+v; want one of %s", mismatches, sprite)
+	}
+}
+
+func TestProcessDirectoryBatch(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		writeTestImage(t, filepath.Join(dir, name), 40, 30)
+	}
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{BatchSize: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, err := os.ReadFile(filepath.Join(dir, "thumbnails_0.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "thumbnails_1.jpg"), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// left for the next full run
+	writeTestImage(t, filepath.Join(dir, "e.jpg"), 40, 30)
+
+	batch := 1
+	up := &fakeUploader{}
+	if _, err = ProcessDirectory(dir, up, Options{BatchSize: 2, Batch: &batch}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{filepath.Join(dir, "thumbnails_1.jpg")}; !reflect.DeepEqual(up.uploaded, want) {
+		t.Errorf("got uploads %q; want %q", up.uploaded, want)
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, "thumbnails_0.jpg")); !bytes.Equal(first, after) {
+		t.Error("thumbnails_0.jpg was changed")
+	}
+	mismatches, err := VerifySprites(dir, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("got mismatches %v after regenerating the batch", mismatches)
+	}
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 4 {
+		t.Errorf("got %d media; want 4, without the new file", len(media))
+	}
+}
+
+func TestProcessDirectoryDumpTiles(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "People")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 400, 300)
+
+	debug := t.TempDir()
+	opts := Options{MediaDir: root, DumpTilesDir: debug}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(debug, "People", "tile_a.jpg.png"))
+	if err != nil {
+		t.Fatalf("opening tile: %v", err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("decoding tile: %v", err)
+	}
+	if config.Width != 324 || config.Height != 243 {
+		t.Errorf("got tile %dx%d; want 324x243", config.Width, config.Height)
+	}
+}
+
+func TestProcessDirectoryCompressThumbsFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{CompressThumbsFile: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".thumbs.yml")); !os.IsNotExist(err) {
+		t.Errorf("expected .thumbs.yml to be removed, got %v", err)
+	}
+	f, err := os.Open(filepath.Join(dir, ".thumbs.yml.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = gzip.NewReader(f); err != nil {
+		t.Errorf("expected gzipped .thumbs.yml.gz: %v", err)
+	}
+
+	// read from the gzipped file without the option
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 || media[0].Path != "a.jpg" || media[0].ThumbPath == "" {
+		t.Errorf("got media %+v", media)
+	}
+
+	up := &fakeUploader{}
+	if _, err = ProcessDirectory(dir, up, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(up.uploaded) != 0 {
+		t.Errorf("got uploads %q after switching back; want none", up.uploaded)
+	}
+	if _, err = os.Stat(filepath.Join(dir, ".thumbs.yml.gz")); !os.IsNotExist(err) {
+		t.Errorf("expected .thumbs.yml.gz to be removed, got %v", err)
+	}
+}
+
+func TestProcessDirectoryAspectRatio(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "panorama.jpg"), 90, 30)
+	writeTestImage(t, filepath.Join(dir, "square.jpg"), 30, 30)
+	writeTestImage(t, filepath.Join(dir, "portrait.jpg"), 30, 60)
+
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, Options{MinAspectRatio: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	if len(media) != 1 || media[0].Path != "panorama.jpg" {
+		t.Errorf("got media %+v; want only panorama.jpg", media)
+	}
+	if want := []string{filepath.Join(dir, "panorama.jpg"), filepath.Join(dir, "thumbnails_0.jpg")}; !reflect.DeepEqual(up.uploaded, want) {
+		t.Errorf("got uploads %q; want %q", up.uploaded, want)
+	}
+}
+
+func TestProcessDirectoryMediaStream(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "People")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "b.jpg"), 30, 40)
+
+	var b bytes.Buffer
+	opts := Options{MediaDir: root, MediaStream: &b}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2:\n%s", len(lines), b.String())
+	}
+	for i, want := range []string{"a.jpg", "b.jpg"} {
+		var record struct {
+			Dir  string `json:"dir"`
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if record.Dir != "People" || record.Path != want {
+			t.Errorf("line %d: got %+v; want %s in People", i, record, want)
+		}
+	}
+}
+
+func TestEncodePNGOptimized(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+
+	var plain, optimized bytes.Buffer
+	if err := encodePNG(&plain, img, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := encodePNG(&optimized, img, Options{OptimizePNG: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if optimized.Len() > plain.Len() {
+		t.Errorf("optimized PNG is %d bytes; want at most %d", optimized.Len(), plain.Len())
+	}
+	decoded, err := png.Decode(&optimized)
+	if err != nil {
+		t.Fatalf("decoding optimized PNG: %v", err)
+	}
+	if got, want := decoded.At(120, 40), img.At(120, 40); !reflect.DeepEqual(color.RGBAModel.Convert(got), want) {
+		t.Errorf("got pixel %v; want %v", got, want)
+	}
+}
+
+func TestEncodePNGOptimizerTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+	defer func(cmd []string, timeout time.Duration) {
+		pngOptimizer, pngOptimizerTimeout = cmd, timeout
+	}(pngOptimizer, pngOptimizerTimeout)
+	pngOptimizer = []string{"sleep", "10"}
+	pngOptimizerTimeout = 50 * time.Millisecond
+
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	var b bytes.Buffer
+	start := time.Now()
+	if err := encodePNG(&b, img, Options{OptimizePNG: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("encoding took %s; want the optimizer stopped", elapsed)
+	}
+	if _, err := png.Decode(&b); err != nil {
+		t.Errorf("decoding PNG written without the optimizer: %v", err)
+	}
+}
+
+func TestProcessDirectoryMaxBatches(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestImage(t, filepath.Join(dir, name), 40, 30)
+	}
+
+	opts := Options{BatchSize: 1, MaxBatches: 2}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error without strict: %v", err)
+	}
+
+	opts.Strict = true
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); !errors.Is(err, ErrTooManyBatches) {
+		t.Errorf("got error %v; want %v", err, ErrTooManyBatches)
+	}
+
+	// all sprites of the directory are counted, not only the regenerated one
+	batch := 0
+	opts.Batch = &batch
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); !errors.Is(err, ErrTooManyBatches) {
+		t.Errorf("got error %v in batch mode; want %v", err, ErrTooManyBatches)
+	}
+
+	// nothing is uploaded for a new directory that is too large
+	dir = t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestImage(t, filepath.Join(dir, name), 40, 30)
+	}
+	opts.Batch = nil
+	up := &fakeUploader{}
+	if _, err := ProcessDirectory(dir, up, opts); !errors.Is(err, ErrTooManyBatches) {
+		t.Errorf("got error %v for a new directory; want %v", err, ErrTooManyBatches)
+	}
+	if len(up.uploaded) != 0 {
+		t.Errorf("got uploaded %v; want nothing", up.uploaded)
+	}
+}
+
+func TestWriteThumbnailReproduciblePNG(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.png"), 40, 30)
+	writeTestImage(t, filepath.Join(dir, "b.png"), 30, 40)
+
+	var sprite bytes.Buffer
+	media := []*Media{{Path: "a.png"}, {Path: "b.png"}}
+	if _, err := WriteThumbnail(&sprite, media, dir, "png", Options{ReproduciblePNG: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the same on any Go version
+	want := "1536bf2b5e60d64b3417be0fc0b2e81a9f130e5d6b7ed7323c8d06b2dbdc2a68"
+	if got := fmt.Sprintf("%x", sha256.Sum256(sprite.Bytes())); got != want {
+		t.Errorf("got sprite sha256 %s; want %s", got, want)
+	}
+	if _, err := png.Decode(&sprite); err != nil {
+		t.Errorf("decoding sprite: %v", err)
+	}
+}
+
+func TestProcessDirectoryResizeMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode          ResizeMode
+		width, height int
+	}{
+		{"", 200, 133},
+		{ResizeBox, 200, 133},
+		{ResizeLongEdge, 324, 215},
+	} {
+		dir := t.TempDir()
+		writeTestImage(t, filepath.Join(dir, "a.jpg"), 200, 133)
+
+		if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{ResizeMode: tt.mode}); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.mode, err)
+		}
+		media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+		if err != nil {
+			t.Fatalf("%q: loading thumbs file: %v", tt.mode, err)
+		}
+		if media[0].ThumbWidth != tt.width || media[0].ThumbHeight != tt.height {
+			t.Errorf("%q: got tile %dx%d; want %dx%d", tt.mode, media[0].ThumbWidth, media[0].ThumbHeight, tt.width, tt.height)
+		}
+	}
+}
+
+func TestProcessDirectoryResizeModeChange(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.jpg"), 200, 133)
+
+	for _, tt := range []struct {
+		mode  ResizeMode
+		width int
+	}{
+		{"", 200},
+		{ResizeLongEdge, 324},
+		{ResizeBox, 200},
+	} {
+		if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{ResizeMode: tt.mode}); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.mode, err)
+		}
+		media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+		if err != nil {
+			t.Fatalf("%q: loading thumbs file: %v", tt.mode, err)
+		}
+		if media[0].ThumbWidth != tt.width {
+			t.Errorf("%q: got tile width %d; want %d", tt.mode, media[0].ThumbWidth, tt.width)
+		}
+	}
+}
+
+func TestProcessDirectoryVerticalAlignChange(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "tall.jpg"), 40, 40)
+	writeTestImage(t, filepath.Join(dir, "short.jpg"), 40, 20)
+
+	for _, tt := range []struct {
+		align   VerticalAlign
+		offsetY int
+	}{
+		{"", 0},
+		{AlignBottom, 20},
+		{AlignTop, 0},
+	} {
+		if _, err := ProcessDirectory(dir, &fakeUploader{}, Options{VerticalAlign: tt.align}); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.align, err)
+		}
+		media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+		if err != nil {
+			t.Fatalf("%q: loading thumbs file: %v", tt.align, err)
+		}
+		for _, m := range media {
+			if m.Path == "short.jpg" && m.ThumbYOffset != tt.offsetY {
+				t.Errorf("%q: got offset %d; want %d", tt.align, m.ThumbYOffset, tt.offsetY)
+			}
+		}
+	}
+}
+
+func TestProcessDirectoryTransparentPNG(t *testing.T) {
+	dir := t.TempDir()
+
+	// left half opaque red, right half fully transparent
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ProcessDirectory(dir, &fakeUploader{}, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, err = os.Open(filepath.Join(dir, "thumbnails_0.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sprite, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decoding sprite: %v", err)
+	}
+
+	// the tile is 324x162
+	if _, _, _, a := sprite.At(40, 80).RGBA(); a != 0xffff {
+		t.Errorf("got alpha %#x of the opaque half; want 0xffff", a)
+	}
+	if _, _, _, a := sprite.At(280, 80).RGBA(); a != 0 {
+		t.Errorf("got alpha %#x of the transparent half; want 0", a)
+	}
+}
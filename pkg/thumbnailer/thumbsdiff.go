@@ -0,0 +1,34 @@
+package thumbnailer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/alsosee/thumbnailer/pkg/udiff"
+)
+
+// writeThumbsFileDiff writes a unified diff of the thumbs file
+// and what SaveThumbsFile would write for the media.
+func writeThumbsFileDiff(w io.Writer, path string, media []*Media) error {
+	current, err := readThumbsFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &ThumbsFileError{Path: path, Err: fmt.Errorf("reading file: %w", err)}
+	}
+
+	// SaveThumbsFile leaves the file as it is without media
+	updated := current
+	if len(media) > 0 {
+		updated, err = marshalThumbsFile(media)
+		if err != nil {
+			return &ThumbsFileError{Path: path, Err: fmt.Errorf("marshaling media: %w", err)}
+		}
+	}
+
+	if _, err = io.WriteString(w, udiff.Unified(path, path, current, updated)); err != nil {
+		return fmt.Errorf("writing diff: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const gzipExt = ".gz"
+
+// thumbsFilePath returns the path of the thumbs file of dir,
+// .thumbs.yml.gz if CompressThumbsFile is set.
+func (o Options) thumbsFilePath(dir string) string {
+	path := filepath.Join(dir, ".thumbs.yml")
+	if o.CompressThumbsFile {
+		path += gzipExt
+	}
+	return path
+}
+
+// counterpart returns the path of the gzipped thumbs file for a plain one and vice versa.
+func counterpart(path string) string {
+	if plain, ok := strings.CutSuffix(path, gzipExt); ok {
+		return plain
+	}
+	return path + gzipExt
+}
+
+// readThumbsFile returns the content of the thumbs file,
+// read from its plain or gzipped counterpart if it doesn't exist,
+// and decompressed if gzipped.
+func readThumbsFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		path = counterpart(path)
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(path, gzipExt) {
+		return content, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", path, err)
+	}
+	defer r.Close()
+
+	content, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", path, err)
+	}
+	return content, nil
+}
+
+// writeThumbsFile writes the content, gzipped if path ends with .gz,
+// and removes the counterpart of the file, so that it's not read instead.
+func writeThumbsFile(path string, content []byte) error {
+	if strings.HasSuffix(path, gzipExt) {
+		// no name and modification time in the header,
+		// so that the same content is compressed to the same bytes
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		content = b.Bytes()
+	}
+
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Remove(counterpart(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// variantName matches file names of variants, such as photo.480w.jpg
+var variantName = regexp.MustCompile(`\.\d+w\.[A-Za-z]+$`)
+
+// Variant is a standalone downscaled copy of an image, for srcset of responsive images.
+type Variant struct {
+	Path   string `yaml:"path" json:"path"`
+	Width  int    `yaml:"width" json:"width"`
+	Height int    `yaml:"height" json:"height"`
+}
+
+// wantsVariants reports whether variants are generated for the media:
+// local landscape images at least opts.VariantMinWidth wide.
+func (o Options) wantsVariants(file *Media) bool {
+	if len(o.VariantWidths) == 0 || isURL(file.Path) || !canReencode(strings.ToLower(filepath.Ext(file.Path))) {
+		return false
+	}
+	if _, _, ok := splitArchivePath(file.Path); ok {
+		return false
+	}
+	return file.Width > file.Height && file.Width >= o.VariantMinWidth
+}
+
+// variantWidths returns widths of variants of the media in ascending order,
+// only those narrower than it.
+func (o Options) variantWidths(file *Media) []int {
+	var widths []int
+	for _, width := range o.VariantWidths {
+		if width < file.Width {
+			widths = append(widths, width)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// updateVariants writes and uploads variants of media that don't have them
+// for all widths yet, and drops variants of media that don't need them anymore.
+// Files of dropped variants are then deleted with deleteStaleSprites.
+func updateVariants(up Uploader, media []*Media, dir string, opts Options) error {
+	for _, file := range media {
+		if !opts.wantsVariants(file) {
+			file.Variants = nil
+			continue
+		}
+
+		widths := opts.variantWidths(file)
+		if hasVariants(file, widths) {
+			continue
+		}
+
+		if err := writeVariants(up, file, widths, dir, opts); err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// variantPaths returns a set of variant file names of media.
+func variantPaths(media []*Media) map[string]bool {
+	result := make(map[string]bool)
+	for _, file := range media {
+		for _, variant := range file.Variants {
+			result[variant.Path] = true
+		}
+	}
+	return result
+}
+
+// hasVariants reports whether the media has variants of exactly given widths.
+func hasVariants(file *Media, widths []int) bool {
+	if len(file.Variants) != len(widths) {
+		return false
+	}
+	for i, variant := range file.Variants {
+		if variant.Width != widths[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeVariants decodes the image once and writes its variants of given widths next to it.
+func writeVariants(up Uploader, file *Media, widths []int, dir string, opts Options) error {
+	img, err := opts.readImageLimited(dir, file.Path)
+	if err != nil {
+		return fmt.Errorf("reading image: %w", err)
+	}
+
+	ext := filepath.Ext(file.Path)
+	base := strings.TrimSuffix(file.Path, ext)
+
+	file.Variants = nil
+	for _, width := range widths {
+		resized := resize.Resize(uint(width), 0, img, resize.Lanczos3)
+
+		b, err := reencode(resized, strings.ToLower(ext))
+		if err != nil {
+			return &EncodeError{Path: filepath.Join(dir, file.Path), Format: ext[1:], Err: err}
+		}
+
+		name := fmt.Sprintf("%s.%dw%s", base, width, ext)
+		path := filepath.Join(dir, name)
+		if !opts.dryRun() {
+			opts.logger().Infof("Writing %s", path)
+			if err = os.WriteFile(path, b, 0o644); err != nil {
+				return fmt.Errorf("writing variant: %w", err)
+			}
+		}
+		if err = up.Upload(path, b); err != nil {
+			return fmt.Errorf("uploading variant: %w", &UploadError{Path: path, Err: err})
+		}
+
+		file.Variants = append(file.Variants, Variant{
+			Path:   name,
+			Width:  resized.Bounds().Dx(),
+			Height: resized.Bounds().Dy(),
+		})
+	}
+
+	return nil
+}
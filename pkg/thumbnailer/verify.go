@@ -0,0 +1,100 @@
+package thumbnailer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SpriteMismatch describes a sprite whose content doesn't match
+// the checksum it is referenced with in .thumbs.yml.
+type SpriteMismatch struct {
+	Path string // path of the sprite file
+	Want string // checksum stored in .thumbs.yml
+	Have string // checksum of the file content, empty if the file is missing
+}
+
+func (m SpriteMismatch) String() string {
+	if m.Have == "" {
+		return fmt.Sprintf("%s: missing, want crc %s", m.Path, m.Want)
+	}
+	return fmt.Sprintf("%s: crc %s, want %s", m.Path, m.Have, m.Want)
+}
+
+// VerifySprites recalculates checksums of sprites referenced by media of the directory
+// and returns the ones that don't match their references. Nothing is written.
+// Sprites referenced without a checksum (see Options.NoCRCSuffix) can't be verified.
+// Directories without .thumbs.yml have nothing to verify.
+func VerifySprites(dir string, opts Options) ([]SpriteMismatch, error) {
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if errors.Is(err, ErrThumbYamlNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// each sprite is referenced by all of its tiles
+	want := map[string]string{}
+	for _, file := range media {
+		refs := []string{file.ThumbPath}
+		for _, thumb := range file.Thumbs {
+			refs = append(refs, thumb.Path)
+		}
+		for _, ref := range refs {
+			if name, sum, ok := spriteChecksum(ref, opts); ok {
+				want[name] = sum
+			}
+		}
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mismatches []SpriteMismatch
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		content, err := opts.readFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading thumbnail %q: %w", name, err)
+		}
+
+		var have string
+		if err == nil {
+			have = checksum(content)
+		}
+		if have != want[name] {
+			mismatches = append(mismatches, SpriteMismatch{Path: path, Want: want[name], Have: have})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// spriteChecksum returns the file name and checksum of a sprite reference
+// made by spriteName, false if the reference has no checksum.
+func spriteChecksum(ref string, opts Options) (name, sum string, ok bool) {
+	if ref == "" {
+		return "", "", false
+	}
+
+	if name, query, found := strings.Cut(ref, "?crc="); found {
+		return name, query, true
+	}
+
+	if opts.ContentAddressed {
+		// base.sum.format
+		parts := strings.Split(ref, ".")
+		if len(parts) >= 3 {
+			return ref, parts[len(parts)-2], true
+		}
+	}
+
+	return "", "", false
+}
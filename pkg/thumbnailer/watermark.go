@@ -0,0 +1,62 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// watermark width relative to the tile width
+	watermarkScale = 0.2
+
+	// distance from the tile edges relative to the tile width
+	watermarkMargin = 0.03
+)
+
+// LoadWatermark decodes a watermark image to be passed in Options.
+func LoadWatermark(path string) (image.Image, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening watermark: %w", err)
+	}
+
+	return decodeImage(content, path)
+}
+
+// applyWatermark returns a copy of the tile with the watermark drawn over it,
+// scaled relative to the tile size. The tile size is kept, so offsets are not affected.
+func applyWatermark(tile, watermark image.Image, position string) image.Image {
+	bounds := tile.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(result, result.Bounds(), tile, bounds.Min, draw.Src)
+
+	width := uint(float64(bounds.Dx()) * watermarkScale)
+	if width == 0 {
+		return result
+	}
+	mark := resize.Resize(width, 0, watermark, resize.Bilinear)
+	margin := int(float64(bounds.Dx()) * watermarkMargin)
+
+	size := mark.Bounds().Size()
+	var at image.Point
+	switch position {
+	case "top-left":
+		at = image.Pt(margin, margin)
+	case "top-right":
+		at = image.Pt(bounds.Dx()-size.X-margin, margin)
+	case "bottom-left":
+		at = image.Pt(margin, bounds.Dy()-size.Y-margin)
+	case "center":
+		at = image.Pt((bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2)
+	default: // bottom-right
+		at = image.Pt(bounds.Dx()-size.X-margin, bounds.Dy()-size.Y-margin)
+	}
+
+	draw.Draw(result, image.Rectangle{Min: at, Max: at.Add(size)}, mark, mark.Bounds().Min, draw.Over)
+
+	return result
+}
@@ -0,0 +1,86 @@
+package thumbnailer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"testing"
+)
+
+var watermarkColor = color.RGBA{B: 255, A: 255}
+
+// solid returns an image of the size filled with the color.
+func solid(width, height int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestApplyWatermark(t *testing.T) {
+	tile := solid(200, 100, color.RGBA{R: 255, A: 255})
+	watermark := solid(50, 25, watermarkColor)
+
+	// scaled to 40x20, 6px from the edges
+	tt := map[string]image.Rectangle{
+		"top-left":     image.Rect(6, 6, 46, 26),
+		"top-right":    image.Rect(154, 6, 194, 26),
+		"bottom-left":  image.Rect(6, 74, 46, 94),
+		"bottom-right": image.Rect(154, 74, 194, 94),
+		"center":       image.Rect(80, 40, 120, 60),
+		"":             image.Rect(154, 74, 194, 94),
+	}
+
+	for position, want := range tt {
+		t.Run(position, func(t *testing.T) {
+			got := applyWatermark(tile, watermark, position)
+			if got.Bounds() != tile.Bounds() {
+				t.Fatalf("got bounds %v; want %v", got.Bounds(), tile.Bounds())
+			}
+
+			for y := 0; y < 100; y++ {
+				for x := 0; x < 200; x++ {
+					p := image.Pt(x, y)
+					isMark := color.RGBAModel.Convert(got.At(x, y)) == watermarkColor
+					if p.In(want) != isMark {
+						t.Fatalf("got watermark %t at %v; want it in %v", isMark, p, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDirectoryWatermark(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, filepath.Join(dir, "a.png"), 600, 300)
+
+	opts := Options{Watermark: solid(50, 25, watermarkColor), WatermarkPosition: "top-left"}
+	if _, err := ProcessDirectory(dir, &fakeUploader{}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	media, err := LoadThumbsFile(filepath.Join(dir, ".thumbs.yml"))
+	if err != nil {
+		t.Fatalf("loading thumbs file: %v", err)
+	}
+	sprite, err := Options{}.readImage(dir, "thumbnails_0.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the 600x300 image is resized to a 324x162 tile, the watermark is 64x32, 9px from the edges
+	tile := media[0]
+	if tile.ThumbWidth != 324 || tile.ThumbHeight != 162 {
+		t.Fatalf("got tile %dx%d; want 324x162", tile.ThumbWidth, tile.ThumbHeight)
+	}
+	at := func(x, y int) color.Color {
+		return color.RGBAModel.Convert(sprite.At(tile.ThumbXOffset+x, tile.ThumbYOffset+y))
+	}
+	if got := at(9+32, 9+16); got != watermarkColor {
+		t.Errorf("got %v in the middle of the watermark; want %v", got, watermarkColor)
+	}
+	if got := at(324-10, 162-10); got == watermarkColor {
+		t.Errorf("got the watermark in the bottom-right corner")
+	}
+}
@@ -0,0 +1,57 @@
+package tinyfont
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestDraw(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 2*Advance, Height))
+	Draw(img, image.Point{}, "I-", color.White)
+
+	// rows of the "I" glyph, then of "-" shifted by Advance
+	want := []string{
+		" ###        ",
+		"  #         ",
+		"  #         ",
+		"  #   ##### ",
+		"  #         ",
+		"  #         ",
+		" ###        ",
+		"            ",
+	}
+	for y, row := range want {
+		var got strings.Builder
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			if img.GrayAt(x, y).Y != 0 {
+				got.WriteByte('#')
+			} else {
+				got.WriteByte(' ')
+			}
+		}
+		if got.String() != row {
+			t.Errorf("row %d: got %q; want %q", y, got.String(), row)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tt := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"photo.jpg", 9 * Advance, "photo.jpg"},
+		{"photo.jpg", 8 * Advance, "photo..."},
+		{"photo.jpg", Advance, "."},
+		{"photo.jpg", 0, ""},
+	}
+
+	for _, tc := range tt {
+		if got := Truncate(tc.s, tc.width); got != tc.want || Width(got) > tc.width {
+			t.Errorf("Truncate(%q, %d) = %q; want %q", tc.s, tc.width, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package udiff formats line differences between two texts as a unified diff,
+// like `diff -u`, using Myers' algorithm.
+package udiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// number of unchanged lines shown around changes
+const context = 3
+
+// op is a line of the edit script: kept (' '), deleted ('-') or inserted ('+').
+type op struct {
+	kind byte
+	text string
+}
+
+// Unified returns a unified diff of a and b labeled with oldName and newName,
+// or an empty string if they have the same lines.
+func Unified(oldName, newName string, a, b []byte) string {
+	ops := edits(lines(a), lines(b))
+
+	// positions of each op in a and b
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	for i, o := range ops {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if o.kind != '+' {
+			oldPos[i+1]++
+		}
+		if o.kind != '-' {
+			newPos[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+		}
+
+		// extend the hunk over changes separated by few unchanged lines
+		start, end := max(0, i-context), i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end = min(run, end+context)
+				break
+			}
+			end = run
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[start], oldPos[end]-oldPos[start]),
+			hunkRange(newPos[start], newPos[end]-newPos[start]),
+		)
+		for _, o := range ops[start:end] {
+			out.WriteByte(o.kind)
+			out.WriteString(o.text)
+			out.WriteByte('\n')
+		}
+
+		i = end
+	}
+
+	return out.String()
+}
+
+// hunkRange formats 1-based line range of a hunk starting after pos lines;
+// empty ranges refer to the line before them.
+func hunkRange(pos, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", pos+1)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, count)
+}
+
+func lines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// edits returns the shortest edit script turning a into b.
+func edits(a, b []string) []op {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+
+	// v holds the furthest x reached on each diagonal k = x - y,
+	// trace keeps it before each round to walk back from the end
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var ops []op
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{' ', a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, op{'+', b[prevY]})
+			} else {
+				ops = append(ops, op{'-', a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
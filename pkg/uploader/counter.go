@@ -0,0 +1,54 @@
+package uploader
+
+import "sync"
+
+// Counter wraps an Uploader and counts bytes of successful uploads.
+type Counter struct {
+	up    Uploader
+	mu    sync.Mutex
+	bytes int64
+}
+
+func NewCounter(up Uploader) *Counter {
+	return &Counter{up: up}
+}
+
+func (c *Counter) Upload(key string, body []byte) error {
+	if err := c.up.Upload(key, body); err != nil {
+		return err
+	}
+
+	c.add(int64(len(body)))
+	return nil
+}
+
+func (c *Counter) UploadFile(key, path string) error {
+	size, err := fileSize(path)
+	if err != nil {
+		return err
+	}
+	if err = uploadFile(c.up, key, path); err != nil {
+		return err
+	}
+
+	c.add(size)
+	return nil
+}
+
+func (c *Counter) add(n int64) {
+	c.mu.Lock()
+	c.bytes += n
+	c.mu.Unlock()
+}
+
+func (c *Counter) Delete(key string) error {
+	return c.up.Delete(key)
+}
+
+// Bytes returns the total size of uploaded bodies.
+func (c *Counter) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bytes
+}
@@ -0,0 +1,143 @@
+package uploader
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// deletedMark is written to the journal instead of a checksum for deleted keys.
+const deletedMark = "-"
+
+// Journal wraps an Uploader and records successfully uploaded keys
+// with a checksum of their content in a local file.
+// Keys found in the journal with the same checksum are not uploaded again,
+// so that an interrupted run can be resumed cheaply.
+// The journal file is safe to delete at any time.
+type Journal struct {
+	up   Uploader
+	file *os.File
+	done map[string]string // key -> checksum
+	mu   sync.Mutex
+}
+
+func NewJournal(up Uploader, path string) (*Journal, error) {
+	done, err := readJournal(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+
+	return &Journal{
+		up:   up,
+		file: f,
+		done: done,
+	}, nil
+}
+
+func readJournal(path string) (map[string]string, error) {
+	done := map[string]string{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue // ignore partially written lines
+		}
+
+		if sum == deletedMark {
+			delete(done, key)
+			continue
+		}
+		done[key] = sum
+	}
+
+	return done, scanner.Err()
+}
+
+func (j *Journal) Upload(key string, body []byte) error {
+	sum := fmt.Sprintf("%x", crc32.ChecksumIEEE(body))
+	return j.upload(key, sum, func() error { return j.up.Upload(key, body) })
+}
+
+func (j *Journal) UploadFile(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	hash := crc32.NewIEEE()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	sum := fmt.Sprintf("%x", hash.Sum32())
+	return j.upload(key, sum, func() error { return uploadFile(j.up, key, path) })
+}
+
+func (j *Journal) upload(key, sum string, upload func() error) error {
+	j.mu.Lock()
+	uploaded := j.done[key] == sum
+	j.mu.Unlock()
+
+	if uploaded {
+		log.Infof("Skipping %s, already uploaded according to journal", key)
+		return nil
+	}
+
+	if err := upload(); err != nil {
+		return err
+	}
+
+	return j.record(key, sum)
+}
+
+func (j *Journal) Delete(key string) error {
+	if err := j.up.Delete(key); err != nil {
+		return err
+	}
+
+	return j.record(key, deletedMark)
+}
+
+func (j *Journal) record(key, sum string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if sum == deletedMark {
+		delete(j.done, key)
+	} else {
+		j.done[key] = sum
+	}
+
+	if _, err := fmt.Fprintf(j.file, "%s %s\n", sum, key); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,51 @@
+package uploader
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type recorder struct {
+	uploaded []string
+}
+
+func (r *recorder) Upload(key string, body []byte) error {
+	r.uploaded = append(r.uploaded, key)
+	return nil
+}
+
+func (r *recorder) Delete(key string) error {
+	return nil
+}
+
+func TestJournalResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	first := &recorder{}
+	j, err := NewJournal(first, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = j.Upload("media/a.jpg", []byte("a"))
+	_ = j.Upload("media/b.jpg", []byte("b"))
+	_ = j.Delete("media/b.jpg")
+	j.Close()
+
+	second := &recorder{}
+	j, err = NewJournal(second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	_ = j.Upload("media/a.jpg", []byte("a"))  // same content, skipped
+	_ = j.Upload("media/b.jpg", []byte("b"))  // deleted, uploaded again
+	_ = j.Upload("media/c.jpg", []byte("c"))  // new
+	_ = j.Upload("media/a.jpg", []byte("a2")) // changed content
+
+	want := []string{"media/b.jpg", "media/c.jpg", "media/a.jpg"}
+	if !reflect.DeepEqual(second.uploaded, want) {
+		t.Errorf("got %q; want %q", second.uploaded, want)
+	}
+}
@@ -0,0 +1,117 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrUploadLimitExceeded = errors.New("upload limit exceeded")
+
+type Uploader interface {
+	Upload(key string, body []byte) error
+	Delete(key string) error
+}
+
+// FileUploader is implemented by uploaders that can stream the file at path
+// to key instead of holding its content in memory.
+type FileUploader interface {
+	UploadFile(key, path string) error
+}
+
+// uploadFile uploads the file at path to key, streaming it if up supports it.
+func uploadFile(up Uploader, key, path string) error {
+	if f, ok := up.(FileUploader); ok {
+		return f.UploadFile(key, path)
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return up.Upload(key, body)
+}
+
+// fileSize returns the size of the file at path.
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Limit wraps an Uploader and fails once the total number of uploaded bytes
+// would exceed the limit.
+type Limit struct {
+	up    Uploader
+	max   int64
+	total int64
+	mu    sync.Mutex
+}
+
+func NewLimit(up Uploader, max int64) *Limit {
+	return &Limit{
+		up:  up,
+		max: max,
+	}
+}
+
+func (l *Limit) Upload(key string, body []byte) error {
+	if err := l.reserve(key, int64(len(body))); err != nil {
+		return err
+	}
+	if err := l.up.Upload(key, body); err != nil {
+		l.refund(int64(len(body)))
+		return err
+	}
+	return nil
+}
+
+func (l *Limit) UploadFile(key, path string) error {
+	size, err := fileSize(path)
+	if err != nil {
+		return err
+	}
+	if err = l.reserve(key, size); err != nil {
+		return err
+	}
+	if err = uploadFile(l.up, key, path); err != nil {
+		l.refund(size)
+		return err
+	}
+	return nil
+}
+
+// reserve adds size to the total, or fails if it would exceed the limit.
+func (l *Limit) reserve(key string, size int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.total+size > l.max {
+		return fmt.Errorf(
+			"%w: uploading %s (%d bytes) after %d bytes would exceed the limit of %d bytes",
+			ErrUploadLimitExceeded,
+			key,
+			size,
+			l.total,
+			l.max,
+		)
+	}
+	l.total += size
+
+	return nil
+}
+
+// refund gives back size reserved for an upload that failed.
+func (l *Limit) refund(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total -= size
+}
+
+func (l *Limit) Delete(key string) error {
+	return l.up.Delete(key)
+}
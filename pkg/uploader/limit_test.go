@@ -0,0 +1,54 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLimit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "c.jpg")
+	if err := os.WriteFile(file, []byte("cccc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &recorder{}
+	l := NewLimit(first, 10)
+	if err := l.Upload("media/a.jpg", []byte("aaaa")); err != nil {
+		t.Fatalf("uploading a.jpg: %v", err)
+	}
+	if err := l.Upload("media/b.jpg", []byte("bbbb")); err != nil {
+		t.Fatalf("uploading b.jpg: %v", err)
+	}
+	if err := l.UploadFile("media/c.jpg", file); !errors.Is(err, ErrUploadLimitExceeded) {
+		t.Fatalf("got %v; want ErrUploadLimitExceeded", err)
+	}
+	if want := []string{"media/a.jpg", "media/b.jpg"}; !reflect.DeepEqual(first.uploaded, want) {
+		t.Errorf("got uploaded %q; want %q", first.uploaded, want)
+	}
+
+	// the limit is per run, the next one uploads the rest
+	second := &recorder{}
+	l = NewLimit(second, 10)
+	if err := l.UploadFile("media/c.jpg", file); err != nil {
+		t.Fatalf("uploading c.jpg: %v", err)
+	}
+	if want := []string{"media/c.jpg"}; !reflect.DeepEqual(second.uploaded, want) {
+		t.Errorf("got uploaded %q; want %q", second.uploaded, want)
+	}
+}
+
+func TestLimitRefundsFailedUploads(t *testing.T) {
+	l := NewLimit(failing{}, 4)
+	if err := l.Upload("media/a.jpg", []byte("aaaa")); err == nil {
+		t.Fatal("expected an error from the failing uploader")
+	}
+
+	// the failed upload doesn't use up the budget
+	l.up = &recorder{}
+	if err := l.Upload("media/a.jpg", []byte("aaaa")); err != nil {
+		t.Fatalf("uploading a.jpg after a failed upload: %v", err)
+	}
+}
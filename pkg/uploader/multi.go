@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// MultiPolicy decides whether a partially failed Multi request is an error.
+type MultiPolicy string
+
+const (
+	// RequireAll fails if any of the uploaders fails.
+	RequireAll MultiPolicy = "all"
+	// RequireAny fails only if all of the uploaders fail; other failures are logged.
+	RequireAny MultiPolicy = "any"
+)
+
+// Multi fans out each request to all wrapped uploaders concurrently,
+// e.g. to publish the same files to several buckets.
+type Multi struct {
+	ups    []Uploader
+	policy MultiPolicy
+}
+
+func NewMulti(policy MultiPolicy, ups ...Uploader) *Multi {
+	return &Multi{
+		ups:    ups,
+		policy: policy,
+	}
+}
+
+func (m *Multi) Upload(key string, body []byte) error {
+	return m.each(key, func(up Uploader) error {
+		return up.Upload(key, body)
+	})
+}
+
+func (m *Multi) UploadFile(key, path string) error {
+	return m.each(key, func(up Uploader) error {
+		return uploadFile(up, key, path)
+	})
+}
+
+func (m *Multi) Delete(key string) error {
+	return m.each(key, func(up Uploader) error {
+		return up.Delete(key)
+	})
+}
+
+func (m *Multi) each(key string, fn func(Uploader) error) error {
+	errs := make([]error, len(m.ups))
+
+	var wg sync.WaitGroup
+	for i, up := range m.ups {
+		wg.Add(1)
+		go func(i int, up Uploader) {
+			defer wg.Done()
+			if err := fn(up); err != nil {
+				errs[i] = fmt.Errorf("target %d: %w", i, err)
+			}
+		}(i, up)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if m.policy == RequireAny && len(failed) < len(m.ups) {
+		log.Warnf("%s failed for %d of %d targets: %v", key, len(failed), len(m.ups), errors.Join(failed...))
+		return nil
+	}
+
+	return errors.Join(failed...)
+}
@@ -0,0 +1,39 @@
+package uploader
+
+import (
+	"errors"
+	"testing"
+)
+
+type failing struct{}
+
+func (failing) Upload(key string, body []byte) error { return errors.New("unavailable") }
+func (failing) Delete(key string) error              { return errors.New("unavailable") }
+
+func TestMultiPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy  MultiPolicy
+		wantErr bool
+	}{
+		{RequireAll, true},
+		{RequireAny, false},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			ok := &recorder{}
+			m := NewMulti(tc.policy, ok, failing{})
+
+			err := m.Upload("media/a.jpg", []byte("a"))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v; want error: %t", err, tc.wantErr)
+			}
+			if len(ok.uploaded) != 1 {
+				t.Errorf("got %d uploads to the healthy target; want 1", len(ok.uploaded))
+			}
+		})
+	}
+
+	m := NewMulti(RequireAny, failing{}, failing{})
+	if err := m.Delete("media/a.jpg"); err == nil {
+		t.Error("got nil error when all targets failed")
+	}
+}
@@ -9,3 +9,11 @@ func NewNoOp() *NoOp {
 func (n *NoOp) Upload(key string, body []byte) error {
 	return nil
 }
+
+func (n *NoOp) UploadFile(key, path string) error {
+	return nil
+}
+
+func (n *NoOp) Delete(key string) error {
+	return nil
+}
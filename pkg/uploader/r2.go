@@ -2,7 +2,9 @@ package uploader
 
 import (
 	"context"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/alsosee/thumbnailer/pkg/r2"
 	"github.com/charmbracelet/log"
@@ -12,6 +14,9 @@ type R2 struct {
 	ctx  context.Context
 	r2   *r2.R2
 	trim string
+
+	// reports whether the key is uploaded as attachment
+	attachment func(key string) bool
 }
 
 func NewR2(ctx context.Context, r2 *r2.R2, trim string) *R2 {
@@ -22,10 +27,62 @@ func NewR2(ctx context.Context, r2 *r2.R2, trim string) *R2 {
 	}
 }
 
+// WithAttachments makes keys for which attachment returns true
+// served with "Content-Disposition: attachment", e.g. originals but not thumbnails.
+func (r2 *R2) WithAttachments(attachment func(key string) bool) *R2 {
+	r2.attachment = attachment
+	return r2
+}
+
+// WithTimeout makes each attempt of a request fail after d (0 for no limit),
+// so a stalled connection is retried and doesn't block the whole run.
+func (r2 *R2) WithTimeout(d time.Duration) *R2 {
+	if d > 0 {
+		r2.r2 = r2.r2.WithTimeout(d)
+	}
+	return r2
+}
+
 func (r2 *R2) Upload(key string, body []byte) error {
 	// R2 object key is the same as file path, relative to media directory
 	key = strings.TrimPrefix(key, r2.trim)
 
+	if r2.attachment != nil && r2.attachment(key) {
+		log.Infof("Uploading %s as attachment", key)
+		return r2.r2.UploadAttachment(r2.ctx, key, body)
+	}
+
 	log.Infof("Uploading %s", key)
 	return r2.r2.Upload(r2.ctx, key, body)
 }
+
+// UploadFile is like Upload, but streams the file at path instead of holding it in memory.
+func (r2 *R2) UploadFile(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	key = strings.TrimPrefix(key, r2.trim)
+
+	if r2.attachment != nil && r2.attachment(key) {
+		log.Infof("Uploading %s as attachment", key)
+		return r2.r2.UploadAttachmentReader(r2.ctx, key, f, info.Size())
+	}
+
+	log.Infof("Uploading %s", key)
+	return r2.r2.UploadReader(r2.ctx, key, f, info.Size())
+}
+
+func (r2 *R2) Delete(key string) error {
+	key = strings.TrimPrefix(key, r2.trim)
+
+	log.Infof("Deleting %s", key)
+	return r2.r2.Delete(r2.ctx, key)
+}
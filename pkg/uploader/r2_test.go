@@ -0,0 +1,267 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alsosee/thumbnailer/pkg/r2"
+)
+
+type object struct {
+	contentType string
+	body        string
+}
+
+// fakeS3 is a minimal path-style S3 server keeping objects in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]object // "bucket/key" -> object
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.objects[key] = object{contentType: r.Header.Get("Content-Type"), body: string(body)}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func TestR2Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	fake := &fakeS3{objects: map[string]object{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	up := NewR2(context.Background(), client, "media/")
+
+	for key, body := range map[string]string{
+		"media/People/a.jpg":              "jpeg",
+		"media/People/thumbnails_0.png":   "png",
+		"media/People/preview.webp":       "webp",
+		"media/People/notes.txt":          "text",
+		"media/People/to-be-deleted.jpeg": "jpeg",
+	} {
+		if err = up.Upload(key, []byte(body)); err != nil {
+			t.Fatalf("uploading %s: %v", key, err)
+		}
+	}
+	if err = up.Delete("media/People/to-be-deleted.jpeg"); err != nil {
+		t.Fatalf("deleting: %v", err)
+	}
+
+	want := map[string]object{
+		"bucket/People/a.jpg":            {"image/jpeg", "jpeg"},
+		"bucket/People/thumbnails_0.png": {"image/png", "png"},
+		"bucket/People/preview.webp":     {"image/webp", "webp"},
+		"bucket/People/notes.txt":        {"application/octet-stream", "text"},
+	}
+
+	if len(fake.objects) != len(want) {
+		t.Errorf("got %d objects; want %d: %v", len(fake.objects), len(want), fake.objects)
+	}
+	for key, w := range want {
+		if got := fake.objects[key]; got != w {
+			t.Errorf("%s: got %+v; want %+v", key, got, w)
+		}
+	}
+}
+
+func TestR2UploadFile(t *testing.T) {
+	fake := &fakeS3{objects: map[string]object{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "thumbnails_0.png")
+	if err = os.WriteFile(file, []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrappers pass the file down to R2 to be streamed
+	up := NewCounter(NewRateLimit(NewR2(context.Background(), client, dir+"/"), 100))
+	if err = up.UploadFile(file, file); err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+
+	want := object{"image/png", "png"}
+	if got := fake.objects["bucket/thumbnails_0.png"]; got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if got := up.Bytes(); got != 3 {
+		t.Errorf("got %d uploaded bytes; want 3", got)
+	}
+}
+
+func TestR2Attachments(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		dispositions = map[string]string{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		dispositions[r.URL.Path] = r.Header.Get("Content-Disposition")
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	up := NewR2(context.Background(), client, "media/").WithAttachments(func(key string) bool {
+		return !strings.HasPrefix(path.Base(key), "thumbnails_")
+	})
+	for _, key := range []string{"media/People/Jane Doe.jpg", "media/People/thumbnails_0.jpg"} {
+		if err = up.Upload(key, []byte("jpeg")); err != nil {
+			t.Fatalf("uploading %s: %v", key, err)
+		}
+	}
+
+	want := map[string]string{
+		"/bucket/People/Jane Doe.jpg":     `attachment; filename="Jane Doe.jpg"`,
+		"/bucket/People/thumbnails_0.jpg": "",
+	}
+	for key, w := range want {
+		if got := dispositions[key]; got != w {
+			t.Errorf("%s: got Content-Disposition %q; want %q", key, got, w)
+		}
+	}
+}
+
+func TestR2Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stall until the test is over
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	// a single attempt, so that only the timeout is measured
+	up := NewR2(context.Background(), client.WithoutRetries(), "media/").WithTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if err = up.Upload("media/People/a.jpg", []byte("jpeg")); err == nil {
+		t.Fatal("expected an error for a stalled upload")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("upload took %s to fail", elapsed)
+	}
+}
+
+func TestR2TimeoutPerAttempt(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+
+		// only the first attempt stalls
+		if first {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	up := NewR2(context.Background(), client, "media/").WithTimeout(200 * time.Millisecond)
+	if err = up.Upload("media/People/a.jpg", []byte("jpeg")); err != nil {
+		t.Errorf("got %v; want the stalled attempt retried", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts; want 2", attempts)
+	}
+}
+
+func TestR2Region(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	client, err := r2.NewWithRegion(server.URL, "eu-central-1", "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	if err = NewR2(context.Background(), client, "media/").Upload("media/a.jpg", []byte("jpeg")); err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	if !strings.Contains(authorization, "/eu-central-1/s3/aws4_request") {
+		t.Errorf("got Authorization %q; want it signed for eu-central-1", authorization)
+	}
+}
+
+func TestR2UserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	up := NewR2(context.Background(), client.WithUserAgent("alsosee-thumbnailer/1.2.3"), "media/")
+	if err = up.Upload("media/a.jpg", []byte("jpeg")); err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	if userAgent != "alsosee-thumbnailer/1.2.3" {
+		t.Errorf("got User-Agent %q; want %q", userAgent, "alsosee-thumbnailer/1.2.3")
+	}
+}
@@ -0,0 +1,94 @@
+package uploader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/alsosee/thumbnailer/pkg/r2"
+)
+
+const throttledRetries = 3
+
+// throttledBackoff is the wait before the first retry of a throttled request,
+// doubled after each one; replaced in tests
+var throttledBackoff = time.Second
+
+// RateLimit wraps an Uploader and limits the number of requests per second
+// across all concurrent uploads, using a token bucket.
+// Requests throttled by R2 are retried with exponential backoff,
+// the R2 client should not retry them too (see r2.R2.WithoutThrottleRetries).
+type RateLimit struct {
+	up    Uploader
+	rate  float64 // tokens per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimit(up Uploader, rate float64) *RateLimit {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimit{
+		up:     up,
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available.
+func (r *RateLimit) wait() {
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	// take a token, possibly going into debt that later callers have to wait for
+	r.tokens--
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+func (r *RateLimit) do(key string, fn func() error) error {
+	backoff := throttledBackoff
+	for attempt := 0; ; attempt++ {
+		r.wait()
+
+		err := fn()
+		if err == nil || !r2.IsThrottled(err) || attempt == throttledRetries {
+			return err
+		}
+
+		log.Warnf("Request for %s was throttled, retrying in %s", key, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (r *RateLimit) Upload(key string, body []byte) error {
+	return r.do(key, func() error { return r.up.Upload(key, body) })
+}
+
+func (r *RateLimit) UploadFile(key, path string) error {
+	return r.do(key, func() error { return uploadFile(r.up, key, path) })
+}
+
+func (r *RateLimit) Delete(key string) error {
+	return r.do(key, func() error { return r.up.Delete(key) })
+}
@@ -0,0 +1,89 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+
+	"github.com/alsosee/thumbnailer/pkg/r2"
+)
+
+// throttling fails the first n uploads as throttled by R2.
+type throttling struct {
+	n     int
+	calls int
+}
+
+func (f *throttling) Upload(key string, body []byte) error {
+	f.calls++
+	if f.calls <= f.n {
+		return &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}
+	}
+	return nil
+}
+
+func (f *throttling) Delete(key string) error {
+	return nil
+}
+
+func TestRateLimitRetriesThrottled(t *testing.T) {
+	defer func(d time.Duration) { throttledBackoff = d }(throttledBackoff)
+	throttledBackoff = time.Millisecond
+
+	tt := map[string]struct {
+		throttled int
+		wantCalls int
+		wantErr   bool
+	}{
+		"not throttled":       {throttled: 0, wantCalls: 1},
+		"throttled once":      {throttled: 1, wantCalls: 2},
+		"throttled too often": {throttled: 10, wantCalls: throttledRetries + 1, wantErr: true},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			up := &throttling{n: tc.throttled}
+			err := NewRateLimit(up, 1000).Upload("media/a.jpg", []byte("a"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr && !r2.IsThrottled(err) {
+				t.Errorf("got %v; want the throttling error", err)
+			}
+			if up.calls != tc.wantCalls {
+				t.Errorf("got %d calls; want %d", up.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRateLimitR2NotRetriedTwice(t *testing.T) {
+	defer func(d time.Duration) { throttledBackoff = d }(throttledBackoff)
+	throttledBackoff = time.Millisecond
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	client, err := r2.NewWithEndpoint(server.URL, "key", "secret", "bucket")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	up := NewRateLimit(NewR2(context.Background(), client.WithoutThrottleRetries(), ""), 1000)
+	if err = up.Upload("a.jpg", []byte("a")); !r2.IsThrottled(err) {
+		t.Fatalf("got %v; want a throttling error", err)
+	}
+	if got, want := requests.Load(), int32(throttledRetries+1); got != want {
+		t.Errorf("got %d requests; want %d", got, want)
+	}
+}
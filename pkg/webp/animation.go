@@ -0,0 +1,75 @@
+package webp
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+const (
+	vp8xFlagAnimation = 0x02
+	vp8xFlagAlpha     = 0x10
+
+	anmfDisposeToBackground = 0x01
+	anmfNoBlend             = 0x02
+)
+
+// EncodeAnimation writes frames to w as a looping animated lossless WebP,
+// showing each frame for the given duration.
+// Frames may have different sizes, they are centered on the canvas
+// that is as big as the largest frame.
+func EncodeAnimation(w io.Writer, frames []image.Image, duration time.Duration) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("webp: no frames")
+	}
+
+	var canvasWidth, canvasHeight int
+	for _, frame := range frames {
+		canvasWidth = max(canvasWidth, frame.Bounds().Dx())
+		canvasHeight = max(canvasHeight, frame.Bounds().Dy())
+	}
+	if canvasWidth > maxDimension || canvasHeight > maxDimension {
+		return fmt.Errorf("webp: invalid canvas size %dx%d", canvasWidth, canvasHeight)
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = vp8xFlagAnimation | vp8xFlagAlpha
+	putUint24(vp8x[4:], canvasWidth-1)
+	putUint24(vp8x[7:], canvasHeight-1)
+
+	// transparent background, infinite loop
+	anim := make([]byte, 6)
+
+	chunks := [][]byte{chunk("VP8X", vp8x), chunk("ANIM", anim)}
+
+	ms := int(duration / time.Millisecond)
+	for i, frame := range frames {
+		data, err := encodeVP8L(frame)
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+
+		width, height := frame.Bounds().Dx(), frame.Bounds().Dy()
+
+		anmf := make([]byte, 16, 16+len(data)+9)
+		// offsets are stored divided by 2
+		putUint24(anmf[0:], (canvasWidth-width)/4)
+		putUint24(anmf[3:], (canvasHeight-height)/4)
+		putUint24(anmf[6:], width-1)
+		putUint24(anmf[9:], height-1)
+		putUint24(anmf[12:], ms)
+		anmf[15] = anmfNoBlend | anmfDisposeToBackground
+		anmf = append(anmf, chunk("VP8L", data)...)
+
+		chunks = append(chunks, chunk("ANMF", anmf))
+	}
+
+	return writeRIFF(w, chunks...)
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
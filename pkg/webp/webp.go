@@ -0,0 +1,399 @@
+// Package webp implements a minimal lossless WebP (VP8L) encoder.
+//
+// Pixels are stored as Huffman-coded literals, without transforms,
+// backward references or color cache. That's enough for small images
+// such as blurhash previews, but larger images will not compress well.
+package webp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+const (
+	maxDimension = 1 << 14
+
+	// alphabet sizes of the five prefix codes: green (+ length prefixes), red, blue, alpha, distance
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+	numCodeLengthCodes      = 19
+)
+
+// order in which code length code lengths are written
+var codeLengthCodeOrder = [numCodeLengthCodes]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Encode writes the image to w in lossless WebP format.
+func Encode(w io.Writer, img image.Image) error {
+	data, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+
+	return writeRIFF(w, chunk("VP8L", data))
+}
+
+// encodeVP8L returns VP8L bitstream of the image.
+func encodeVP8L(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+		return nil, fmt.Errorf("webp: invalid image size %dx%d", width, height)
+	}
+
+	pixels := make([]color.NRGBA, 0, width*height)
+	opaque := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A != 255 {
+				opaque = false
+			}
+			pixels = append(pixels, c)
+		}
+	}
+
+	bw := &bitWriter{}
+
+	// VP8L header
+	bw.writeBits(0x2f, 8) // signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if opaque {
+		bw.writeBits(0, 1)
+	} else {
+		bw.writeBits(1, 1)
+	}
+	bw.writeBits(0, 3) // version
+
+	bw.writeBits(0, 1) // no transforms
+	bw.writeBits(0, 1) // no color cache
+	bw.writeBits(0, 1) // no meta prefix codes
+
+	var freqs [4][]int
+	freqs[0] = make([]int, numLiteralCodes+numLengthCodes)
+	for i := 1; i < 4; i++ {
+		freqs[i] = make([]int, numLiteralCodes)
+	}
+	for _, p := range pixels {
+		freqs[0][p.G]++
+		freqs[1][p.R]++
+		freqs[2][p.B]++
+		freqs[3][p.A]++
+	}
+
+	var codes [4]prefixCode
+	for i := range codes {
+		codes[i] = newPrefixCode(freqs[i], maxCodeLength)
+		codes[i].write(bw)
+	}
+
+	// distance code is never used, write a single-symbol simple code
+	writeSimpleCode(bw, 0)
+
+	for _, p := range pixels {
+		codes[0].writeSymbol(bw, int(p.G))
+		codes[1].writeSymbol(bw, int(p.R))
+		codes[2].writeSymbol(bw, int(p.B))
+		codes[3].writeSymbol(bw, int(p.A))
+	}
+
+	return bw.bytes(), nil
+}
+
+// chunk returns a RIFF chunk with given FourCC and payload, padded to even size.
+func chunk(fourCC string, payload []byte) []byte {
+	result := make([]byte, 8, 8+len(payload)+1)
+	copy(result, fourCC)
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(payload)))
+	result = append(result, payload...)
+	if len(payload)%2 == 1 {
+		result = append(result, 0)
+	}
+	return result
+}
+
+// writeRIFF writes WebP file header followed by the chunks.
+func writeRIFF(w io.Writer, chunks ...[]byte) error {
+	size := 4 // "WEBP"
+	for _, c := range chunks {
+		size += len(c)
+	}
+
+	var header [12]byte
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	copy(header[8:], "WEBP")
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bitWriter writes bits least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) writeBits(value uint32, n uint) {
+	b.acc |= uint64(value) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc = 0
+		b.nbits = 0
+	}
+	return b.buf
+}
+
+// prefixCode is a canonical Huffman code.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32 // bit-reversed canonical codes, ready to be written LSB first
+	single  int      // the only used symbol, or -1
+}
+
+func newPrefixCode(freqs []int, maxLength int) prefixCode {
+	lengths := huffmanLengths(freqs, maxLength)
+
+	pc := prefixCode{
+		lengths: lengths,
+		codes:   make([]uint32, len(lengths)),
+		single:  -1,
+	}
+
+	used := 0
+	for s, l := range lengths {
+		if l > 0 {
+			used++
+			pc.single = s
+		}
+	}
+	if used != 1 {
+		pc.single = -1
+	}
+
+	// assign canonical codes
+	var count [maxCodeLength + 2]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [maxCodeLength + 2]uint32
+	var code uint32
+	for l := 1; l <= maxCodeLength+1; l++ {
+		code = (code + uint32(count[l-1])) << 1
+		next[l] = code
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		pc.codes[s] = reverse(next[l], l)
+		next[l]++
+	}
+
+	return pc
+}
+
+// write writes the code lengths of the prefix code.
+func (pc prefixCode) write(bw *bitWriter) {
+	used := 0
+	for _, l := range pc.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+
+	if used <= 1 {
+		symbol := 0
+		if pc.single >= 0 {
+			symbol = pc.single
+		}
+		writeSimpleCode(bw, symbol)
+		return
+	}
+
+	// tokens for code lengths: literal lengths 0-15, 17 and 18 for runs of zeros
+	type token struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []token
+	for i := 0; i < len(pc.lengths); {
+		l := pc.lengths[i]
+		if l != 0 {
+			tokens = append(tokens, token{symbol: l})
+			i++
+			continue
+		}
+
+		run := 1
+		for i+run < len(pc.lengths) && pc.lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			tokens = append(tokens, token{symbol: 18, extra: uint32(run - 11), extraBits: 7})
+		case run >= 3:
+			tokens = append(tokens, token{symbol: 17, extra: uint32(run - 3), extraBits: 3})
+		default:
+			for j := 0; j < run; j++ {
+				tokens = append(tokens, token{symbol: 0})
+			}
+		}
+		i += run
+	}
+
+	freqs := make([]int, numCodeLengthCodes)
+	for _, t := range tokens {
+		freqs[t.symbol]++
+	}
+	clc := newPrefixCode(freqs, maxCodeLengthCodeLength)
+
+	numCodes := 4
+	for i := numCodeLengthCodes - 1; i >= 4; i-- {
+		if clc.lengths[codeLengthCodeOrder[i]] != 0 {
+			numCodes = i + 1
+			break
+		}
+	}
+
+	bw.writeBits(0, 1) // normal code
+	bw.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		bw.writeBits(uint32(clc.lengths[codeLengthCodeOrder[i]]), 3)
+	}
+	bw.writeBits(0, 1) // code lengths for the whole alphabet follow
+
+	for _, t := range tokens {
+		clc.writeSymbol(bw, t.symbol)
+		if t.extraBits > 0 {
+			bw.writeBits(t.extra, t.extraBits)
+		}
+	}
+}
+
+func (pc prefixCode) writeSymbol(bw *bitWriter, symbol int) {
+	if pc.single >= 0 {
+		return // single-symbol codes take no bits
+	}
+	bw.writeBits(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+// writeSimpleCode writes a simple prefix code with a single symbol.
+func writeSimpleCode(bw *bitWriter, symbol int) {
+	bw.writeBits(1, 1) // simple code
+	bw.writeBits(0, 1) // one symbol
+	if symbol < 2 {
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(symbol), 1)
+		return
+	}
+	bw.writeBits(1, 1)
+	bw.writeBits(uint32(symbol), 8)
+}
+
+// huffmanLengths returns code lengths of a Huffman code for given frequencies,
+// limited to maxLength. A single used symbol gets length 1.
+func huffmanLengths(freqs []int, maxLength int) []int {
+	lengths := make([]int, len(freqs))
+
+	f := make([]int, len(freqs))
+	copy(f, freqs)
+
+	for {
+		type node struct {
+			weight  int
+			symbols []int
+		}
+
+		var nodes []node
+		for s, w := range f {
+			if w > 0 {
+				nodes = append(nodes, node{weight: w, symbols: []int{s}})
+			}
+		}
+
+		switch len(nodes) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[nodes[0].symbols[0]] = 1
+			return lengths
+		}
+
+		for i := range lengths {
+			lengths[i] = 0
+		}
+
+		// repeatedly merge two lightest nodes; every merge adds one bit
+		// to the length of all symbols in the merged nodes
+		for len(nodes) > 1 {
+			sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+			a, b := nodes[0], nodes[1]
+			merged := node{
+				weight:  a.weight + b.weight,
+				symbols: append(append([]int{}, a.symbols...), b.symbols...),
+			}
+			for _, s := range merged.symbols {
+				lengths[s]++
+			}
+			nodes = append([]node{merged}, nodes[2:]...)
+		}
+
+		tooLong := false
+		for _, l := range lengths {
+			if l > maxLength {
+				tooLong = true
+				break
+			}
+		}
+		if !tooLong {
+			return lengths
+		}
+
+		// flatten the distribution and try again
+		for s, w := range f {
+			if w > 0 {
+				f[s] = w/2 + 1
+			}
+		}
+	}
+}
+
+func reverse(code uint32, length int) uint32 {
+	var result uint32
+	for i := 0; i < length; i++ {
+		result = result<<1 | code&1
+		code >>= 1
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bitReader reads bits least significant bit first, like VP8L decoders do.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBits(n int) int {
+	var v int
+	for i := 0; i < n; i++ {
+		bit := int(r.data[r.pos/8]>>(r.pos%8)) & 1
+		v |= bit << i
+		r.pos++
+	}
+	return v
+}
+
+// huffman is a canonical prefix code decoded one bit at a time,
+// most significant bit of the code first.
+type huffman struct {
+	single int
+	codes  map[[2]int]int // (length, code) -> symbol
+}
+
+func newHuffman(lengths []int) huffman {
+	h := huffman{single: -1, codes: map[[2]int]int{}}
+
+	var symbols []int
+	for s, l := range lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) == 1 {
+		h.single = symbols[0]
+		return h
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool { return lengths[symbols[i]] < lengths[symbols[j]] })
+
+	code, prevLen := 0, 0
+	for _, s := range symbols {
+		code <<= lengths[s] - prevLen
+		prevLen = lengths[s]
+		h.codes[[2]int{lengths[s], code}] = s
+		code++
+	}
+
+	return h
+}
+
+func (h huffman) read(t *testing.T, r *bitReader) int {
+	if h.single >= 0 {
+		return h.single
+	}
+
+	code := 0
+	for l := 1; l <= maxCodeLength; l++ {
+		code = code<<1 | r.readBits(1)
+		if s, ok := h.codes[[2]int{l, code}]; ok {
+			return s
+		}
+	}
+
+	t.Fatalf("invalid prefix code at bit %d", r.pos)
+	return 0
+}
+
+func readPrefixCode(t *testing.T, r *bitReader, alphabetSize int) huffman {
+	lengths := make([]int, alphabetSize)
+
+	if r.readBits(1) == 1 { // simple code
+		numSymbols := r.readBits(1) + 1
+		symbol := r.readBits(1 + 7*r.readBits(1))
+		lengths[symbol] = 1
+		if numSymbols == 2 {
+			lengths[r.readBits(8)] = 1
+		}
+		return newHuffman(lengths)
+	}
+
+	clcLengths := make([]int, numCodeLengthCodes)
+	numCodes := r.readBits(4) + 4
+	for i := 0; i < numCodes; i++ {
+		clcLengths[codeLengthCodeOrder[i]] = r.readBits(3)
+	}
+	if r.readBits(1) != 0 {
+		t.Fatal("max_symbol is not supported")
+	}
+
+	clc := newHuffman(clcLengths)
+	for i := 0; i < alphabetSize; {
+		switch s := clc.read(t, r); s {
+		case 17:
+			i += r.readBits(3) + 3
+		case 18:
+			i += r.readBits(7) + 11
+		case 16:
+			t.Fatal("repeat code is not expected")
+		default:
+			lengths[i] = s
+			i++
+		}
+	}
+
+	return newHuffman(lengths)
+}
+
+func decode(t *testing.T, b []byte) *image.NRGBA {
+	t.Helper()
+
+	if string(b[0:4]) != "RIFF" || string(b[8:16]) != "WEBPVP8L" {
+		t.Fatalf("invalid header %q", b[:16])
+	}
+	if got := int(binary.LittleEndian.Uint32(b[4:])); got != 0 && got != len(b)-8 {
+		t.Fatalf("RIFF size %d; want %d", got, len(b)-8)
+	}
+
+	r := &bitReader{data: b[20:]}
+	if sig := r.readBits(8); sig != 0x2f {
+		t.Fatalf("invalid signature %x", sig)
+	}
+	width := r.readBits(14) + 1
+	height := r.readBits(14) + 1
+	r.readBits(1) // alpha hint
+	if v := r.readBits(3); v != 0 {
+		t.Fatalf("version %d", v)
+	}
+	if r.readBits(1) != 0 || r.readBits(1) != 0 || r.readBits(1) != 0 {
+		t.Fatal("transforms, color cache and meta codes are not expected")
+	}
+
+	green := readPrefixCode(t, r, numLiteralCodes+numLengthCodes)
+	red := readPrefixCode(t, r, numLiteralCodes)
+	blue := readPrefixCode(t, r, numLiteralCodes)
+	alpha := readPrefixCode(t, r, numLiteralCodes)
+	readPrefixCode(t, r, numDistanceCodes)
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			g := green.read(t, r)
+			if g >= numLiteralCodes {
+				t.Fatalf("backward reference is not expected")
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				G: uint8(g),
+				R: uint8(red.read(t, r)),
+				B: uint8(blue.read(t, r)),
+				A: uint8(alpha.read(t, r)),
+			})
+		}
+	}
+
+	return img
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tt := map[string]func(x, y int) color.NRGBA{
+		"solid": func(x, y int) color.NRGBA {
+			return color.NRGBA{R: 10, G: 20, B: 30, A: 255}
+		},
+		"gradient": func(x, y int) color.NRGBA {
+			return color.NRGBA{R: uint8(x * 8), G: uint8(y * 8), B: uint8(x * y), A: 255}
+		},
+		"noise with alpha": func(x, y int) color.NRGBA {
+			v := uint8((x*7919 + y*104729) % 251)
+			return color.NRGBA{R: v, G: v * 3, B: v * 7, A: v * 11}
+		},
+	}
+
+	for name, fn := range tt {
+		t.Run(name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, 32, 21))
+			for y := 0; y < 21; y++ {
+				for x := 0; x < 32; x++ {
+					src.SetNRGBA(x, y, fn(x, y))
+				}
+			}
+
+			var b bytes.Buffer
+			if err := Encode(&b, src); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := decode(t, b.Bytes())
+			if !bytes.Equal(got.Pix, src.Pix) {
+				t.Errorf("decoded image differs from the source")
+			}
+		})
+	}
+}
+
+func TestEncodeAnimation(t *testing.T) {
+	frames := []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 20, 10)),
+		image.NewNRGBA(image.Rect(0, 0, 10, 30)),
+	}
+
+	var b bytes.Buffer
+	if err := EncodeAnimation(&b, frames, 250*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data := b.Bytes()
+	if got := int(binary.LittleEndian.Uint32(data[4:])); got != len(data)-8 {
+		t.Fatalf("RIFF size %d; want %d", got, len(data)-8)
+	}
+
+	// walk chunks
+	var fourCCs []string
+	for pos := 12; pos < len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		payload := data[pos+8 : pos+8+size]
+		fourCCs = append(fourCCs, fourCC)
+
+		switch fourCC {
+		case "VP8X":
+			if w, h := uint24(payload[4:])+1, uint24(payload[7:])+1; w != 20 || h != 30 {
+				t.Errorf("got canvas %dx%d; want 20x30", w, h)
+			}
+		case "ANMF":
+			if d := uint24(payload[12:]); d != 250 {
+				t.Errorf("got duration %d; want 250", d)
+			}
+			decode(t, append([]byte("RIFF\x00\x00\x00\x00WEBP"), payload[16:]...))
+		}
+
+		pos += 8 + size + size%2
+	}
+
+	want := []string{"VP8X", "ANIM", "ANMF", "ANMF"}
+	if strings.Join(fourCCs, ",") != strings.Join(want, ",") {
+		t.Errorf("got chunks %v; want %v", fourCCs, want)
+	}
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}